@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrMiss is returned by backends for missing keys.
+var ErrMiss = errors.New("cache miss")
+
+// Backend is a key-value store with expiration used as a cache. Zero ttl
+// means the key never expires.
+type Backend interface {
+	// Get returns ErrMiss when key is missing.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// MGet returns values in the order of keys, nil for missing ones.
+	MGet(ctx context.Context, keys ...string) ([][]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// SetNX stores value only if key is missing and reports whether it did.
+	SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(ctx context.Context, keys ...string) error
+	// DeleteIfEqual atomically deletes key if it holds value, which releases
+	// locks taken with SetNX.
+	DeleteIfEqual(ctx context.Context, key string, value []byte) (bool, error)
+	// Incr increments the counter stored in key, starting from zero, and
+	// resets its ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
+
+// PubSub is implemented by backends able to broadcast messages to every
+// instance sharing the backend.
+type PubSub interface {
+	Publish(ctx context.Context, channel string, message []byte) error
+	// Subscribe passes messages published to channel to onMessage until ctx
+	// is done or the subscription breaks. Messages published while there is
+	// no subscription are lost, onSubscribe is called once it is
+	// established.
+	Subscribe(ctx context.Context, channel string, onSubscribe func(), onMessage func(message []byte)) error
+}
+
+// Ranking is implemented by backends able to keep members of a set ordered
+// by score.
+type Ranking interface {
+	IncrScore(ctx context.Context, key string, member string, delta float64) error
+	// TopMembers returns at most n members with the highest scores, highest
+	// first.
+	TopMembers(ctx context.Context, key string, n int) ([]string, error)
+}
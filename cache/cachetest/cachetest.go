@@ -0,0 +1,262 @@
+// Package cachetest checks that cache backends behave the same way.
+package cachetest
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"twitter/cache"
+)
+
+type Harness struct {
+	Backend cache.Backend
+	// Advance moves the clock used by the backend to expire keys.
+	Advance func(d time.Duration)
+}
+
+// RunBackendTests runs the behavioral tests every cache.Backend must pass.
+// PubSub and Ranking are only tested if the backend implements them.
+func RunBackendTests(t *testing.T, newHarness func(t *testing.T) Harness) {
+	ctx := context.Background()
+
+	t.Run("GetMissing", func(t *testing.T) {
+		b := newHarness(t).Backend
+		_, err := b.Get(ctx, "missing")
+		require.ErrorIs(t, err, cache.ErrMiss)
+	})
+
+	t.Run("SetAndGet", func(t *testing.T) {
+		b := newHarness(t).Backend
+		require.NoError(t, b.Set(ctx, "key", []byte("first"), 0))
+		require.NoError(t, b.Set(ctx, "key", []byte("second"), 0))
+		value, err := b.Get(ctx, "key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("second"), value)
+	})
+
+	t.Run("MGetReturnsNilForMissingKeys", func(t *testing.T) {
+		b := newHarness(t).Backend
+		require.NoError(t, b.Set(ctx, "a", []byte("1"), 0))
+		require.NoError(t, b.Set(ctx, "c", []byte("3"), 0))
+		values, err := b.MGet(ctx, "a", "b", "c")
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("1"), nil, []byte("3")}, values)
+	})
+
+	t.Run("SetNXKeepsExistingValue", func(t *testing.T) {
+		b := newHarness(t).Backend
+		stored, err := b.SetNX(ctx, "key", []byte("first"), time.Minute)
+		require.NoError(t, err)
+		require.True(t, stored)
+		stored, err = b.SetNX(ctx, "key", []byte("second"), time.Minute)
+		require.NoError(t, err)
+		require.False(t, stored)
+		value, err := b.Get(ctx, "key")
+		require.NoError(t, err)
+		require.Equal(t, []byte("first"), value)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		b := newHarness(t).Backend
+		require.NoError(t, b.Set(ctx, "a", []byte("1"), 0))
+		require.NoError(t, b.Set(ctx, "b", []byte("2"), 0))
+		require.NoError(t, b.Delete(ctx, "a", "b", "missing"))
+		values, err := b.MGet(ctx, "a", "b")
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{nil, nil}, values)
+	})
+
+	t.Run("DeleteIfEqual", func(t *testing.T) {
+		b := newHarness(t).Backend
+		require.NoError(t, b.Set(ctx, "lock", []byte("owner"), time.Minute))
+		deleted, err := b.DeleteIfEqual(ctx, "lock", []byte("other"))
+		require.NoError(t, err)
+		require.False(t, deleted)
+		deleted, err = b.DeleteIfEqual(ctx, "lock", []byte("owner"))
+		require.NoError(t, err)
+		require.True(t, deleted)
+		_, err = b.Get(ctx, "lock")
+		require.ErrorIs(t, err, cache.ErrMiss)
+		deleted, err = b.DeleteIfEqual(ctx, "lock", []byte("owner"))
+		require.NoError(t, err)
+		require.False(t, deleted)
+	})
+
+	t.Run("Incr", func(t *testing.T) {
+		b := newHarness(t).Backend
+		for want := int64(1); want <= 3; want++ {
+			counter, err := b.Incr(ctx, "counter", time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, want, counter)
+		}
+		value, err := b.Get(ctx, "counter")
+		require.NoError(t, err)
+		require.Equal(t, []byte("3"), value)
+	})
+
+	t.Run("KeysExpire", func(t *testing.T) {
+		h := newHarness(t)
+		require.NoError(t, h.Backend.Set(ctx, "key", []byte("value"), 2*time.Second))
+		_, err := h.Backend.Incr(ctx, "counter", 2*time.Second)
+		require.NoError(t, err)
+
+		h.Advance(time.Second)
+		_, err = h.Backend.Get(ctx, "key")
+		require.NoError(t, err)
+
+		h.Advance(2 * time.Second)
+		_, err = h.Backend.Get(ctx, "key")
+		require.ErrorIs(t, err, cache.ErrMiss)
+		counter, err := h.Backend.Incr(ctx, "counter", 2*time.Second)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), counter)
+	})
+
+	t.Run("PubSub", func(t *testing.T) {
+		pubsub, ok := newHarness(t).Backend.(cache.PubSub)
+		if !ok {
+			t.Skip("backend has no pub/sub")
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		subscribed := make(chan struct{})
+		received := make(chan []byte, 1)
+		done := make(chan error)
+		go func() {
+			done <- pubsub.Subscribe(ctx, "channel", func() { close(subscribed) }, func(message []byte) {
+				received <- message
+			})
+		}()
+
+		select {
+		case <-subscribed:
+		case <-time.After(time.Second):
+			t.Fatal("subscription was not established")
+		}
+		require.NoError(t, pubsub.Publish(ctx, "channel", []byte("hello")))
+		select {
+		case message := <-received:
+			require.Equal(t, []byte("hello"), message)
+		case <-time.After(time.Second):
+			t.Fatal("message was not received")
+		}
+		cancel()
+		require.Error(t, <-done)
+	})
+	t.Run("Ranking", func(t *testing.T) {
+		ranking, ok := newHarness(t).Backend.(cache.Ranking)
+		if !ok {
+			t.Skip("backend has no ranking")
+		}
+		require.NoError(t, ranking.IncrScore(ctx, "ranking", "a", 1))
+		require.NoError(t, ranking.IncrScore(ctx, "ranking", "b", 2))
+		require.NoError(t, ranking.IncrScore(ctx, "ranking", "c", 1))
+		require.NoError(t, ranking.IncrScore(ctx, "ranking", "a", 2))
+
+		members, err := ranking.TopMembers(ctx, "ranking", 2)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, members)
+		members, err = ranking.TopMembers(ctx, "ranking", 10)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b", "c"}, members)
+		members, err = ranking.TopMembers(ctx, "missing", 10)
+		require.NoError(t, err)
+		require.Empty(t, members)
+	})
+}
+
+type QueueHarness struct {
+	Queue cache.Queue
+	// ClaimIdle is the idle time after which unacknowledged messages are
+	// received again.
+	ClaimIdle time.Duration
+	// Advance moves the clock used by the queue to measure idle time.
+	Advance func(d time.Duration)
+}
+
+// RunQueueTests runs the behavioral tests every cache.Queue must pass.
+func RunQueueTests(t *testing.T, newHarness func(t *testing.T) QueueHarness) {
+	ctx := context.Background()
+
+	payloads := func(messages []cache.Message) []string {
+		result := make([]string, 0, len(messages))
+		for _, message := range messages {
+			result = append(result, string(message.Payload))
+		}
+		return result
+	}
+
+	t.Run("ReceiveInOrder", func(t *testing.T) {
+		q := newHarness(t).Queue
+		for _, payload := range []string{"a", "b", "c"} {
+			require.NoError(t, q.Enqueue(ctx, []byte(payload)))
+		}
+		messages, err := q.Receive(ctx, "consumer", 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, payloads(messages))
+		messages, err = q.Receive(ctx, "consumer", 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"c"}, payloads(messages))
+		messages, err = q.Receive(ctx, "consumer", 2, 0)
+		require.NoError(t, err)
+		require.Empty(t, messages)
+	})
+
+	t.Run("ReceiveBlocksUntilEnqueued", func(t *testing.T) {
+		q := newHarness(t).Queue
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_ = q.Enqueue(ctx, []byte("late"))
+		}()
+		messages, err := q.Receive(ctx, "consumer", 1, time.Second)
+		require.NoError(t, err)
+		require.Equal(t, []string{"late"}, payloads(messages))
+	})
+
+	t.Run("UnacknowledgedMessagesAreClaimed", func(t *testing.T) {
+		h := newHarness(t)
+		require.NoError(t, h.Queue.Enqueue(ctx, []byte("first")))
+		require.NoError(t, h.Queue.Enqueue(ctx, []byte("second")))
+		messages, err := h.Queue.Receive(ctx, "crashed", 2, 0)
+		require.NoError(t, err)
+		require.Len(t, messages, 2)
+		require.NoError(t, h.Queue.Ack(ctx, messages[1].Id))
+
+		messages, err = h.Queue.Receive(ctx, "other", 2, 0)
+		require.NoError(t, err)
+		require.Empty(t, messages)
+
+		h.Advance(h.ClaimIdle)
+		messages, err = h.Queue.Receive(ctx, "other", 2, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"first"}, payloads(messages))
+	})
+
+	t.Run("Requeue", func(t *testing.T) {
+		h := newHarness(t)
+		require.NoError(t, h.Queue.Enqueue(ctx, []byte("first")))
+		require.NoError(t, h.Queue.Enqueue(ctx, []byte("second")))
+		messages, err := h.Queue.Receive(ctx, "consumer", 1, 0)
+		require.NoError(t, err)
+		require.NoError(t, h.Queue.Requeue(ctx, messages[0], []byte("retried")))
+
+		h.Advance(h.ClaimIdle)
+		messages, err = h.Queue.Receive(ctx, "consumer", 3, 0)
+		require.NoError(t, err)
+		require.Equal(t, []string{"second", "retried"}, payloads(messages))
+	})
+
+	t.Run("DeadLetter", func(t *testing.T) {
+		h := newHarness(t)
+		require.NoError(t, h.Queue.Enqueue(ctx, []byte("poison")))
+		messages, err := h.Queue.Receive(ctx, "consumer", 1, 0)
+		require.NoError(t, err)
+		require.NoError(t, h.Queue.DeadLetter(ctx, messages[0], "failed"))
+
+		h.Advance(h.ClaimIdle)
+		messages, err = h.Queue.Receive(ctx, "consumer", 1, 0)
+		require.NoError(t, err)
+		require.Empty(t, messages)
+	})
+}
@@ -0,0 +1,124 @@
+package memcache
+
+import (
+	"bytes"
+	"context"
+	"github.com/bradfitz/gomemcache/memcache"
+	"time"
+	"twitter/cache"
+)
+
+// Backend stores cached values in memcached. The memcached protocol has no
+// pub/sub, so local caches in front of it only rely on their TTL. Calls do
+// not observe ctx, timeouts are set on the client.
+type Backend struct {
+	client *memcache.Client
+}
+
+func NewBackend(client *memcache.Client) *Backend {
+	return &Backend{client: client}
+}
+
+// expiration converts ttl to memcached seconds, rounding up so short ttls
+// don't turn into "never expires".
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+func (b *Backend) Get(ctx context.Context, key string) ([]byte, error) {
+	it, err := b.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, cache.ErrMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	return it.Value, nil
+}
+
+func (b *Backend) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	items, err := b.client.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		if it, ok := items[key]; ok {
+			values[i] = it.Value
+		}
+	}
+	return values, nil
+}
+
+func (b *Backend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return b.client.Set(&memcache.Item{Key: key, Value: value, Expiration: expiration(ttl)})
+}
+
+func (b *Backend) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	err := b.client.Add(&memcache.Item{Key: key, Value: value, Expiration: expiration(ttl)})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Backend) Delete(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		err := b.client.Delete(key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteIfEqual swaps the value for an already expired one: memcached has no
+// conditional delete, but CAS makes the swap fail if the key was changed
+// after it was read.
+func (b *Backend) DeleteIfEqual(ctx context.Context, key string, value []byte) (bool, error) {
+	it, err := b.client.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(it.Value, value) {
+		return false, nil
+	}
+	it.Expiration = -1
+	err = b.client.CompareAndSwap(it)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *Backend) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	for {
+		counter, err := b.client.Increment(key, 1)
+		if err == nil {
+			if ttl > 0 {
+				err = b.client.Touch(key, expiration(ttl))
+			}
+			return int64(counter), err
+		}
+		if err != memcache.ErrCacheMiss {
+			return 0, err
+		}
+		// memcached only increments existing keys, a concurrent Add of the
+		// first value makes this one fail and retry the increment
+		err = b.client.Add(&memcache.Item{Key: key, Value: []byte("1"), Expiration: expiration(ttl)})
+		if err == nil {
+			return 1, nil
+		}
+		if err != memcache.ErrNotStored {
+			return 0, err
+		}
+	}
+}
+
+var _ cache.Backend = (*Backend)(nil)
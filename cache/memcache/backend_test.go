@@ -0,0 +1,39 @@
+package memcache
+
+import (
+	"github.com/bradfitz/gomemcache/memcache"
+	"os"
+	"testing"
+	"time"
+	"twitter/cache/cachetest"
+)
+
+// TestBackend needs a memcached server, its address is taken from
+// MEMCACHED_URL.
+func TestBackend(t *testing.T) {
+	addr := os.Getenv("MEMCACHED_URL")
+	if addr == "" {
+		t.Skip("MEMCACHED_URL is not set")
+	}
+	cachetest.RunBackendTests(t, func(t *testing.T) cachetest.Harness {
+		client := memcache.New(addr)
+		if err := client.DeleteAll(); err != nil {
+			t.Fatal(err)
+		}
+		return cachetest.Harness{Backend: NewBackend(client), Advance: time.Sleep}
+	})
+}
+
+func TestExpirationRoundsUp(t *testing.T) {
+	for ttl, want := range map[time.Duration]int32{
+		0:                       0,
+		time.Millisecond:        1,
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		24 * time.Hour:          86400,
+	} {
+		if got := expiration(ttl); got != want {
+			t.Errorf("expiration(%v) = %v, want %v", ttl, got, want)
+		}
+	}
+}
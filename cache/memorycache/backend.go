@@ -0,0 +1,219 @@
+package memorycache
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"twitter/cache"
+)
+
+type item struct {
+	value []byte
+	// expiresAt is zero for keys without expiration.
+	expiresAt time.Time
+}
+
+// Backend keeps cached values in process memory. It is meant for tests and
+// single instance deployments: expired keys are only dropped when they are
+// accessed, and published messages reach subscribers of the same Backend.
+type Backend struct {
+	mu          sync.Mutex
+	items       map[string]item
+	subscribers map[string]map[chan []byte]struct{}
+	rankings    map[string]map[string]float64
+	now         func() time.Time
+}
+
+func NewBackend() *Backend {
+	return NewBackendWithClock(time.Now)
+}
+
+// NewBackendWithClock creates a backend expiring keys by the given clock.
+func NewBackendWithClock(now func() time.Time) *Backend {
+	return &Backend{
+		items:       map[string]item{},
+		subscribers: map[string]map[chan []byte]struct{}{},
+		rankings:    map[string]map[string]float64{},
+		now:         now,
+	}
+}
+
+// lookup must be called with mu held.
+func (b *Backend) lookup(key string) (item, bool) {
+	it, ok := b.items[key]
+	if !ok {
+		return item{}, false
+	}
+	if !it.expiresAt.IsZero() && !b.now().Before(it.expiresAt) {
+		delete(b.items, key)
+		return item{}, false
+	}
+	return it, true
+}
+
+// store must be called with mu held.
+func (b *Backend) store(key string, value []byte, ttl time.Duration) {
+	it := item{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		it.expiresAt = b.now().Add(ttl)
+	}
+	b.items[key] = it
+}
+
+func (b *Backend) Get(ctx context.Context, key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	it, ok := b.lookup(key)
+	if !ok {
+		return nil, cache.ErrMiss
+	}
+	return append([]byte(nil), it.value...), nil
+}
+
+func (b *Backend) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		it, ok := b.lookup(key)
+		if ok {
+			values[i] = append([]byte(nil), it.value...)
+		}
+	}
+	return values, nil
+}
+
+func (b *Backend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store(key, value, ttl)
+	return nil
+}
+
+func (b *Backend) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.lookup(key)
+	if ok {
+		return false, nil
+	}
+	b.store(key, value, ttl)
+	return true, nil
+}
+
+func (b *Backend) Delete(ctx context.Context, keys ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range keys {
+		delete(b.items, key)
+	}
+	return nil
+}
+
+func (b *Backend) DeleteIfEqual(ctx context.Context, key string, value []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	it, ok := b.lookup(key)
+	if !ok || !bytes.Equal(it.value, value) {
+		return false, nil
+	}
+	delete(b.items, key)
+	return true, nil
+}
+
+func (b *Backend) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var counter int64
+	it, ok := b.lookup(key)
+	if ok {
+		var err error
+		counter, err = strconv.ParseInt(string(it.value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	counter++
+	b.store(key, []byte(strconv.FormatInt(counter, 10)), ttl)
+	return counter, nil
+}
+
+func (b *Backend) Publish(ctx context.Context, channel string, message []byte) error {
+	b.mu.Lock()
+	subscribers := make([]chan []byte, 0, len(b.subscribers[channel]))
+	for subscriber := range b.subscribers[channel] {
+		subscribers = append(subscribers, subscriber)
+	}
+	b.mu.Unlock()
+	for _, subscriber := range subscribers {
+		select {
+		case subscriber <- append([]byte(nil), message...):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (b *Backend) Subscribe(ctx context.Context, channel string, onSubscribe func(), onMessage func(message []byte)) error {
+	messages := make(chan []byte, 64)
+	b.mu.Lock()
+	if b.subscribers[channel] == nil {
+		b.subscribers[channel] = map[chan []byte]struct{}{}
+	}
+	b.subscribers[channel][messages] = struct{}{}
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.subscribers[channel], messages)
+		b.mu.Unlock()
+	}()
+
+	onSubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message := <-messages:
+			onMessage(message)
+		}
+	}
+}
+
+func (b *Backend) IncrScore(ctx context.Context, key string, member string, delta float64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rankings[key] == nil {
+		b.rankings[key] = map[string]float64{}
+	}
+	b.rankings[key][member] += delta
+	return nil
+}
+
+func (b *Backend) TopMembers(ctx context.Context, key string, n int) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	scores := b.rankings[key]
+	members := make([]string, 0, len(scores))
+	for member := range scores {
+		members = append(members, member)
+	}
+	// ties are ordered like in redis sorted sets
+	sort.Slice(members, func(i, j int) bool {
+		if scores[members[i]] != scores[members[j]] {
+			return scores[members[i]] > scores[members[j]]
+		}
+		return members[i] > members[j]
+	})
+	if len(members) > n {
+		members = members[:n]
+	}
+	return members, nil
+}
+
+var _ cache.Backend = (*Backend)(nil)
+var _ cache.PubSub = (*Backend)(nil)
+var _ cache.Ranking = (*Backend)(nil)
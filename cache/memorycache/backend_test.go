@@ -0,0 +1,25 @@
+package memorycache
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"twitter/cache/cachetest"
+)
+
+func TestBackend(t *testing.T) {
+	cachetest.RunBackendTests(t, func(t *testing.T) cachetest.Harness {
+		var mu sync.Mutex
+		now := time.Now()
+		b := NewBackendWithClock(func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		})
+		return cachetest.Harness{Backend: b, Advance: func(d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			now = now.Add(d)
+		}}
+	})
+}
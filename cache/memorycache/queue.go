@@ -0,0 +1,153 @@
+package memorycache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+	"twitter/cache"
+)
+
+type delivery struct {
+	message     cache.Message
+	deliveredAt time.Time
+}
+
+// Queue keeps messages in process memory. Like a redis stream read by a
+// consumer group, it redelivers messages left unacknowledged for claimIdle.
+type Queue struct {
+	mu        sync.Mutex
+	lastId    int64
+	ready     []cache.Message
+	pending   []delivery
+	dead      []cache.Message
+	claimIdle time.Duration
+	now       func() time.Time
+	// enqueued is closed and replaced on every enqueue to wake up receivers.
+	enqueued chan struct{}
+}
+
+func NewQueue(claimIdle time.Duration) *Queue {
+	return NewQueueWithClock(claimIdle, time.Now)
+}
+
+// NewQueueWithClock creates a queue measuring idle time of messages by the
+// given clock.
+func NewQueueWithClock(claimIdle time.Duration, now func() time.Time) *Queue {
+	return &Queue{
+		claimIdle: claimIdle,
+		now:       now,
+		enqueued:  make(chan struct{}),
+	}
+}
+
+func (q *Queue) Enqueue(ctx context.Context, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.enqueue(payload)
+	return nil
+}
+
+// enqueue must be called with mu held.
+func (q *Queue) enqueue(payload []byte) {
+	q.lastId++
+	q.ready = append(q.ready, cache.Message{
+		Id:      strconv.FormatInt(q.lastId, 10),
+		Payload: append([]byte(nil), payload...),
+	})
+	close(q.enqueued)
+	q.enqueued = make(chan struct{})
+}
+
+func (q *Queue) Receive(ctx context.Context, consumer string, count int, block time.Duration) ([]cache.Message, error) {
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		q.mu.Lock()
+		received := q.receive(count)
+		enqueued := q.enqueued
+		q.mu.Unlock()
+		if len(received) > 0 || block <= 0 {
+			return received, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, nil
+		case <-enqueued:
+		}
+	}
+}
+
+// receive must be called with mu held.
+func (q *Queue) receive(count int) []cache.Message {
+	now := q.now()
+	var received []cache.Message
+	for i := range q.pending {
+		if len(received) == count {
+			return received
+		}
+		if now.Sub(q.pending[i].deliveredAt) >= q.claimIdle {
+			q.pending[i].deliveredAt = now
+			received = append(received, q.pending[i].message)
+		}
+	}
+	for len(q.ready) > 0 && len(received) < count {
+		message := q.ready[0]
+		q.ready = q.ready[1:]
+		q.pending = append(q.pending, delivery{message: message, deliveredAt: now})
+		received = append(received, message)
+	}
+	return received
+}
+
+func (q *Queue) Ack(ctx context.Context, ids ...string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		q.ack(id)
+	}
+	return nil
+}
+
+// ack must be called with mu held.
+func (q *Queue) ack(id string) bool {
+	for i, d := range q.pending {
+		if d.message.Id == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Queue) Requeue(ctx context.Context, message cache.Message, payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ack(message.Id)
+	q.enqueue(payload)
+	return nil
+}
+
+func (q *Queue) DeadLetter(ctx context.Context, message cache.Message, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.ack(message.Id) {
+		q.dead = append(q.dead, message)
+	}
+	return nil
+}
+
+// DeadLetters returns the dead-lettered messages.
+func (q *Queue) DeadLetters() []cache.Message {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]cache.Message(nil), q.dead...)
+}
+
+var _ cache.Queue = (*Queue)(nil)
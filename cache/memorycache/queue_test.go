@@ -0,0 +1,25 @@
+package memorycache
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"twitter/cache/cachetest"
+)
+
+func TestQueue(t *testing.T) {
+	cachetest.RunQueueTests(t, func(t *testing.T) cachetest.QueueHarness {
+		var mu sync.Mutex
+		now := time.Now()
+		q := NewQueueWithClock(time.Minute, func() time.Time {
+			mu.Lock()
+			defer mu.Unlock()
+			return now
+		})
+		return cachetest.QueueHarness{Queue: q, ClaimIdle: time.Minute, Advance: func(d time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			now = now.Add(d)
+		}}
+	})
+}
@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+type Message struct {
+	Id      string
+	Payload []byte
+}
+
+// Queue is a durable queue shared by instances with at-least-once delivery: a
+// received message is delivered again, possibly to another consumer, until
+// it is acknowledged.
+type Queue interface {
+	Enqueue(ctx context.Context, payload []byte) error
+	// Receive waits up to block for at most count messages. Messages left
+	// unacknowledged by other consumers for too long are received again.
+	Receive(ctx context.Context, consumer string, count int, block time.Duration) ([]Message, error)
+	Ack(ctx context.Context, ids ...string) error
+	// Requeue atomically acknowledges message and enqueues payload in its
+	// place at the end of the queue.
+	Requeue(ctx context.Context, message Message, payload []byte) error
+	// DeadLetter atomically acknowledges message and moves it to the queue
+	// of messages that failed to be processed.
+	DeadLetter(ctx context.Context, message Message, reason string) error
+}
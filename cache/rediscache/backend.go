@@ -0,0 +1,164 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+	"twitter/cache"
+)
+
+var deleteIfEqualScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// Backend stores cached values in a single redis node or a redis cluster.
+type Backend struct {
+	client redis.UniversalClient
+}
+
+func NewBackend(client redis.UniversalClient) *Backend {
+	return &Backend{client: client}
+}
+
+func (b *Backend) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := b.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, cache.ErrMiss
+	}
+	return value, err
+}
+
+// MGet reads keys with a single MGET. A cluster rejects MGET of keys from
+// different slots, there keys are read with single key reads pipelined to
+// the nodes owning them.
+func (b *Backend) MGet(ctx context.Context, keys ...string) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if _, ok := b.client.(*redis.ClusterClient); ok {
+		return b.pipelinedGet(ctx, keys)
+	}
+	replies, err := b.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i, reply := range replies {
+		// missing keys are nil replies
+		if value, ok := reply.(string); ok {
+			values[i] = []byte(value)
+		}
+	}
+	return values, nil
+}
+
+func (b *Backend) pipelinedGet(ctx context.Context, keys []string) ([][]byte, error) {
+	pipe := b.client.Pipeline()
+	commands := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		commands[i] = pipe.Get(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([][]byte, len(keys))
+	for i, command := range commands {
+		value, err := command.Bytes()
+		if err == nil {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+func (b *Backend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return b.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (b *Backend) SetNX(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	return b.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (b *Backend) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	pipe := b.client.Pipeline()
+	for _, key := range keys {
+		pipe.Del(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (b *Backend) DeleteIfEqual(ctx context.Context, key string, value []byte) (bool, error) {
+	deleted, err := deleteIfEqualScript.Run(ctx, b.client, []string{key}, value).Int()
+	return deleted == 1, err
+}
+
+func (b *Backend) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	pipe := b.client.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	if ttl > 0 {
+		pipe.Expire(ctx, key, ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (b *Backend) Publish(ctx context.Context, channel string, message []byte) error {
+	return b.client.Publish(ctx, channel, message).Err()
+}
+
+func (b *Backend) Subscribe(ctx context.Context, channel string, onSubscribe func(), onMessage func(message []byte)) error {
+	pubsub := b.client.Subscribe(ctx, channel)
+	defer pubsub.Close()
+	// Receive blocks on the connection regardless of ctx, closing the
+	// subscription interrupts it
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = pubsub.Close()
+		case <-stop:
+		}
+	}()
+	for {
+		received, err := pubsub.Receive(ctx)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return err
+		}
+		switch message := received.(type) {
+		case *redis.Subscription:
+			onSubscribe()
+		case *redis.Message:
+			onMessage([]byte(message.Payload))
+		}
+	}
+}
+
+func (b *Backend) IncrScore(ctx context.Context, key string, member string, delta float64) error {
+	return b.client.ZIncrBy(ctx, key, delta, member).Err()
+}
+
+func (b *Backend) TopMembers(ctx context.Context, key string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	return b.client.ZRevRange(ctx, key, 0, int64(n-1)).Result()
+}
+
+var _ cache.Backend = (*Backend)(nil)
+var _ cache.PubSub = (*Backend)(nil)
+var _ cache.Ranking = (*Backend)(nil)
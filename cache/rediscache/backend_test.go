@@ -0,0 +1,34 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"twitter/cache/cachetest"
+)
+
+func TestBackend(t *testing.T) {
+	cachetest.RunBackendTests(t, func(t *testing.T) cachetest.Harness {
+		server := miniredis.RunT(t)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		return cachetest.Harness{Backend: NewBackend(client), Advance: server.FastForward}
+	})
+}
+
+func TestMGetReadsKeysWithOneCommand(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	require.NoError(t, server.Set("a", "1"))
+	require.NoError(t, server.Set("c", "3"))
+	commands := server.CommandCount()
+
+	values, err := NewBackend(client).MGet(context.Background(), "a", "b", "c")
+
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("1"), nil, []byte("3")}, values)
+	require.Equal(t, commands+1, server.CommandCount())
+}
@@ -0,0 +1,92 @@
+package rediscache
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"time"
+)
+
+// Mode is the topology of the redis deployment.
+type Mode string
+
+const (
+	ModeStandalone Mode = "standalone"
+	ModeSentinel   Mode = "sentinel"
+	ModeCluster    Mode = "cluster"
+)
+
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(name)); mode {
+	case ModeStandalone, ModeSentinel, ModeCluster:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown redis mode %q", name)
+	}
+}
+
+type ClientOptions struct {
+	Mode Mode
+	// Addrs are addresses of the server in standalone mode, of sentinels in
+	// sentinel mode and of seed nodes in cluster mode.
+	Addrs []string
+	// MasterName is the name of the master monitored by sentinels.
+	MasterName       string
+	Username         string
+	Password         string
+	SentinelPassword string
+	// DB is only supported by standalone and sentinel modes.
+	DB int
+	// TLS enables TLS verified against the system roots.
+	TLS          bool
+	PoolSize     int
+	MinIdleConns int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// NewClient creates a client for the topology given by options.Mode.
+func NewClient(options ClientOptions) (redis.UniversalClient, error) {
+	universal := &redis.UniversalOptions{
+		Addrs:            options.Addrs,
+		MasterName:       options.MasterName,
+		Username:         options.Username,
+		Password:         options.Password,
+		SentinelPassword: options.SentinelPassword,
+		DB:               options.DB,
+		PoolSize:         options.PoolSize,
+		MinIdleConns:     options.MinIdleConns,
+		DialTimeout:      options.DialTimeout,
+		ReadTimeout:      options.ReadTimeout,
+		WriteTimeout:     options.WriteTimeout,
+	}
+	if options.TLS {
+		universal.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	switch options.Mode {
+	case ModeStandalone, "":
+		if len(options.Addrs) > 1 {
+			return nil, errors.New("standalone redis mode takes a single address")
+		}
+		return redis.NewClient(universal.Simple()), nil
+	case ModeSentinel:
+		if options.MasterName == "" || len(options.Addrs) == 0 {
+			return nil, errors.New("sentinel redis mode needs a master name and sentinel addresses")
+		}
+		return redis.NewFailoverClient(universal.Failover()), nil
+	case ModeCluster:
+		if len(options.Addrs) == 0 {
+			return nil, errors.New("cluster redis mode needs seed node addresses")
+		}
+		if options.DB != 0 {
+			return nil, errors.New("redis cluster only supports database 0")
+		}
+		return redis.NewClusterClient(universal.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", options.Mode)
+	}
+}
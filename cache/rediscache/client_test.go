@@ -0,0 +1,67 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestNewClientPicksClientByMode(t *testing.T) {
+	client, err := NewClient(ClientOptions{Mode: ModeSentinel, Addrs: []string{"localhost:26379"}, MasterName: "mymaster"})
+	require.NoError(t, err)
+	require.IsType(t, &redis.Client{}, client)
+	_ = client.Close()
+
+	client, err = NewClient(ClientOptions{Mode: ModeCluster, Addrs: []string{"localhost:7000", "localhost:7001"}, TLS: true})
+	require.NoError(t, err)
+	require.IsType(t, &redis.ClusterClient{}, client)
+	require.NotNil(t, client.(*redis.ClusterClient).Options().TLSConfig)
+	_ = client.Close()
+}
+
+func TestNewClientValidatesOptions(t *testing.T) {
+	for name, options := range map[string]ClientOptions{
+		"standalone with many addresses": {Mode: ModeStandalone, Addrs: []string{"a:6379", "b:6379"}},
+		"sentinel without master":        {Mode: ModeSentinel, Addrs: []string{"localhost:26379"}},
+		"cluster without addresses":      {Mode: ModeCluster},
+		"cluster with database":          {Mode: ModeCluster, Addrs: []string{"localhost:7000"}, DB: 1},
+		"unknown mode":                   {Mode: "replicated"},
+	} {
+		_, err := NewClient(options)
+		require.Error(t, err, name)
+	}
+}
+
+func TestStandaloneClientUsesCredentialsAndDatabase(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+	server.Select(2)
+	require.NoError(t, server.Set("key", "value"))
+
+	client, err := NewClient(ClientOptions{
+		Mode:        ModeStandalone,
+		Addrs:       []string{server.Addr()},
+		Password:    "secret",
+		DB:          2,
+		PoolSize:    3,
+		DialTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	value, err := client.Get(context.Background(), "key").Result()
+	require.NoError(t, err)
+	require.Equal(t, "value", value)
+	require.Equal(t, 3, client.(*redis.Client).Options().PoolSize)
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("Cluster")
+	require.NoError(t, err)
+	require.Equal(t, ModeCluster, mode)
+	_, err = ParseMode("replicated")
+	require.Error(t, err)
+}
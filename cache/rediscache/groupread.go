@@ -0,0 +1,64 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"time"
+)
+
+// GroupReadArgs selects entries read by ReadGroup.
+type GroupReadArgs struct {
+	Stream   string
+	Group    string
+	Consumer string
+	// ClaimIdle is how long an entry stays unacknowledged before another
+	// consumer takes it over.
+	ClaimIdle time.Duration
+	Count     int
+	// Block is how long to wait for new entries, zero does not wait.
+	Block time.Duration
+}
+
+// ReadGroup returns at most Count entries of a stream for a consumer of the
+// group. Entries abandoned by other consumers are returned first, new ones
+// only if there are none.
+func ReadGroup(ctx context.Context, client redis.UniversalClient, args GroupReadArgs) ([]redis.XMessage, error) {
+	claimed, _, err := client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+		Stream:   args.Stream,
+		Group:    args.Group,
+		Consumer: args.Consumer,
+		MinIdle:  args.ClaimIdle,
+		Start:    "0-0",
+		Count:    int64(args.Count),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(claimed) > 0 {
+		return claimed, nil
+	}
+
+	block := args.Block
+	if block <= 0 {
+		// zero blocks forever in redis, negative values do not block
+		block = -1
+	}
+	streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    args.Group,
+		Consumer: args.Consumer,
+		Streams:  []string{args.Stream, ">"},
+		Count:    int64(args.Count),
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var received []redis.XMessage
+	for _, stream := range streams {
+		received = append(received, stream.Messages...)
+	}
+	return received, nil
+}
@@ -0,0 +1,129 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"sync"
+	"time"
+	"twitter/cache"
+)
+
+const payloadField = "payload"
+
+// Queue is a redis stream read by a consumer group. The stream and its
+// dead-letter stream share a hash tag, so they can be updated atomically in
+// a cluster.
+type Queue struct {
+	client    redis.UniversalClient
+	stream    string
+	group     string
+	claimIdle time.Duration
+
+	// groupMu guards groupCreated, Receive may be called concurrently.
+	groupMu      sync.Mutex
+	groupCreated bool
+}
+
+// NewQueue creates a queue on the stream named name. Messages unacknowledged
+// for claimIdle are taken over by other consumers.
+func NewQueue(client redis.UniversalClient, name string, group string, claimIdle time.Duration) *Queue {
+	return &Queue{
+		client:    client,
+		stream:    "{" + name + "}",
+		group:     group,
+		claimIdle: claimIdle,
+	}
+}
+
+func (q *Queue) deadLetterStream() string {
+	return q.stream + ":dead"
+}
+
+// ensureGroup creates the consumer group once, a failed attempt is repeated
+// by the next call.
+func (q *Queue) ensureGroup(ctx context.Context) error {
+	q.groupMu.Lock()
+	defer q.groupMu.Unlock()
+	if q.groupCreated {
+		return nil
+	}
+	err := q.client.XGroupCreateMkStream(ctx, q.stream, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	q.groupCreated = true
+	return nil
+}
+
+func (q *Queue) Enqueue(ctx context.Context, payload []byte) error {
+	return q.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.stream,
+		Values: map[string]interface{}{payloadField: payload},
+	}).Err()
+}
+
+func (q *Queue) Receive(ctx context.Context, consumer string, count int, block time.Duration) ([]cache.Message, error) {
+	err := q.ensureGroup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	received, err := ReadGroup(ctx, q.client, GroupReadArgs{
+		Stream:    q.stream,
+		Group:     q.group,
+		Consumer:  consumer,
+		ClaimIdle: q.claimIdle,
+		Count:     count,
+		Block:     block,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages(received), nil
+}
+
+func (q *Queue) Ack(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	pipe := q.client.TxPipeline()
+	pipe.XAck(ctx, q.stream, q.group, ids...)
+	pipe.XDel(ctx, q.stream, ids...)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (q *Queue) Requeue(ctx context.Context, message cache.Message, payload []byte) error {
+	pipe := q.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.stream,
+		Values: map[string]interface{}{payloadField: payload},
+	})
+	pipe.XAck(ctx, q.stream, q.group, message.Id)
+	pipe.XDel(ctx, q.stream, message.Id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (q *Queue) DeadLetter(ctx context.Context, message cache.Message, reason string) error {
+	pipe := q.client.TxPipeline()
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.deadLetterStream(),
+		Values: map[string]interface{}{payloadField: message.Payload, "reason": reason, "id": message.Id},
+	})
+	pipe.XAck(ctx, q.stream, q.group, message.Id)
+	pipe.XDel(ctx, q.stream, message.Id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func messages(xMessages []redis.XMessage) []cache.Message {
+	result := make([]cache.Message, 0, len(xMessages))
+	for _, xMessage := range xMessages {
+		payload, _ := xMessage.Values[payloadField].(string)
+		result = append(result, cache.Message{Id: xMessage.ID, Payload: []byte(payload)})
+	}
+	return result
+}
+
+var _ cache.Queue = (*Queue)(nil)
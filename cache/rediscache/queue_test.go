@@ -0,0 +1,98 @@
+package rediscache
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"twitter/cache/cachetest"
+)
+
+func TestQueue(t *testing.T) {
+	cachetest.RunQueueTests(t, func(t *testing.T) cachetest.QueueHarness {
+		server := miniredis.RunT(t)
+		now := time.Now()
+		server.SetTime(now)
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		return cachetest.QueueHarness{
+			Queue:     NewQueue(client, "queue", "group", time.Minute),
+			ClaimIdle: time.Minute,
+			Advance: func(d time.Duration) {
+				now = now.Add(d)
+				server.SetTime(now)
+			},
+		}
+	})
+}
+
+func TestQueueKeepsDeadLettersInTheSameSlot(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	q := NewQueue(client, "pd:writebehind", "group", time.Minute)
+	ctx := context.Background()
+	require.NoError(t, q.Enqueue(ctx, []byte("poison")))
+	messages, err := q.Receive(ctx, "consumer", 1, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.DeadLetter(ctx, messages[0], "failed"))
+
+	dead, err := client.XRange(ctx, "{pd:writebehind}:dead", "-", "+").Result()
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	require.Equal(t, "poison", dead[0].Values["payload"])
+	require.Equal(t, "failed", dead[0].Values["reason"])
+	length, err := client.XLen(ctx, "{pd:writebehind}").Result()
+	require.NoError(t, err)
+	require.Zero(t, length)
+}
+
+func TestQueueReceivesConcurrently(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	q := NewQueue(client, "queue", "group", time.Minute)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, q.Enqueue(ctx, []byte("message")))
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	received := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(consumer string) {
+			defer wg.Done()
+			messages, err := q.Receive(ctx, consumer, 10, 0)
+			assert.NoError(t, err)
+			mu.Lock()
+			received += len(messages)
+			mu.Unlock()
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	require.Equal(t, 10, received)
+}
+
+func TestQueueCreatesGroupAfterFailure(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	q := NewQueue(client, "queue", "group", time.Minute)
+	ctx := context.Background()
+
+	server.SetError("unavailable")
+	_, err := q.Receive(ctx, "consumer", 1, 0)
+	require.Error(t, err)
+	server.SetError("")
+	require.NoError(t, q.Enqueue(ctx, []byte("message")))
+	messages, err := q.Receive(ctx, "consumer", 1, 0)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+}
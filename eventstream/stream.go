@@ -0,0 +1,155 @@
+// Package eventstream publishes post events to a redis stream, from which
+// downstream systems read them with consumer groups.
+package eventstream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strings"
+	"time"
+	"twitter/cache/rediscache"
+	"twitter/storage"
+)
+
+const (
+	idField    = "id"
+	typeField  = "type"
+	eventField = "event"
+)
+
+// Stream keeps published events in a redis stream. Offsets of events are ids
+// of their stream entries.
+type Stream struct {
+	client redis.UniversalClient
+	name   string
+	maxLen int64
+}
+
+// NewStream creates a stream trimmed to about maxLen events, which bounds how
+// far back events can be replayed. Zero maxLen keeps all events.
+func NewStream(client redis.UniversalClient, name string, maxLen int64) *Stream {
+	return &Stream{client: client, name: name, maxLen: maxLen}
+}
+
+type Message struct {
+	Offset string
+	Event  storage.Event
+	// Err is set for entries which are not valid events. They are
+	// acknowledged and skipped by consumers.
+	Err error
+}
+
+// Publish appends events to the stream in order.
+func (s *Stream) Publish(ctx context.Context, events []storage.Event) error {
+	pipe := s.client.Pipeline()
+	for _, event := range events {
+		rawEvent, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.name,
+			MaxLen: s.maxLen,
+			Approx: true,
+			Values: map[string]interface{}{
+				idField:    event.Id,
+				typeField:  string(event.Type),
+				eventField: rawEvent,
+			},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Range returns at most count events from offset on, "-" being the oldest
+// retained one. Offsets prefixed with "(" are exclusive, so passing the last
+// returned offset that way continues a replay.
+func (s *Stream) Range(ctx context.Context, offset string, count int) ([]Message, error) {
+	entries, err := s.client.XRangeN(ctx, s.name, offset, "+", int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return messages(entries), nil
+}
+
+// CreateGroup creates a consumer group reading events after offset: "$" for
+// new events only, "0" for all retained ones. An existing group is left as
+// it is.
+func (s *Stream) CreateGroup(ctx context.Context, group string, offset string) error {
+	err := s.client.XGroupCreateMkStream(ctx, s.name, group, offset).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// ResetGroup makes group read events after offset again. Events the group
+// received but did not acknowledge are forgotten, they are delivered again if
+// they follow offset.
+func (s *Stream) ResetGroup(ctx context.Context, group string, offset string) error {
+	pipe := s.client.TxPipeline()
+	pipe.XGroupDestroy(ctx, s.name, group)
+	pipe.XGroupCreateMkStream(ctx, s.name, group, offset)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Consumer reads events as a member of a consumer group, every event is
+// delivered to one member of the group. Events received by a member which
+// did not acknowledge them for claimIdle are delivered to another one.
+type Consumer struct {
+	stream    *Stream
+	group     string
+	name      string
+	claimIdle time.Duration
+}
+
+func (s *Stream) Consumer(group string, name string, claimIdle time.Duration) *Consumer {
+	return &Consumer{stream: s, group: group, name: name, claimIdle: claimIdle}
+}
+
+// Read waits up to block for at most count events, zero block does not
+// wait. Events abandoned by other members are returned first.
+func (c *Consumer) Read(ctx context.Context, count int, block time.Duration) ([]Message, error) {
+	received, err := rediscache.ReadGroup(ctx, c.stream.client, rediscache.GroupReadArgs{
+		Stream:    c.stream.name,
+		Group:     c.group,
+		Consumer:  c.name,
+		ClaimIdle: c.claimIdle,
+		Count:     count,
+		Block:     block,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages(received), nil
+}
+
+// Ack marks events as processed by the group. They stay in the stream for
+// other groups and replays.
+func (c *Consumer) Ack(ctx context.Context, offsets ...string) error {
+	if len(offsets) == 0 {
+		return nil
+	}
+	return c.stream.client.XAck(ctx, c.stream.name, c.group, offsets...).Err()
+}
+
+func messages(entries []redis.XMessage) []Message {
+	result := make([]Message, 0, len(entries))
+	for _, entry := range entries {
+		message := Message{Offset: entry.ID}
+		rawEvent, ok := entry.Values[eventField].(string)
+		if !ok {
+			message.Err = fmt.Errorf("entry %s has no event", entry.ID)
+		} else if err := json.Unmarshal([]byte(rawEvent), &message.Event); err != nil {
+			message.Err = fmt.Errorf("entry %s has malformed event - %w", entry.ID, err)
+		}
+		result = append(result, message)
+	}
+	return result
+}
+
+var _ storage.EventPublisher = (*Stream)(nil)
@@ -0,0 +1,136 @@
+package eventstream
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"twitter/generator"
+	"twitter/storage"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+var ctx = context.Background()
+
+func newTestStream(t *testing.T) (*Stream, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewStream(client, "posts:events", 1000), server
+}
+
+func newEvents(texts ...string) []storage.Event {
+	events := make([]storage.Event, 0, len(texts))
+	for _, text := range texts {
+		events = append(events, storage.Event{
+			Id:         idGenerator.NewPostID().Hex(),
+			Type:       storage.EventPostCreated,
+			Post:       storage.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: text},
+			OccurredAt: time.Now().UTC().Truncate(time.Millisecond),
+		})
+	}
+	return events
+}
+
+func texts(messages []Message) []string {
+	result := make([]string, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, message.Event.Post.Text)
+	}
+	return result
+}
+
+func offsets(messages []Message) []string {
+	result := make([]string, 0, len(messages))
+	for _, message := range messages {
+		result = append(result, message.Offset)
+	}
+	return result
+}
+
+func TestPublishAndRange(t *testing.T) {
+	s, _ := newTestStream(t)
+	events := newEvents("a", "b", "c")
+	require.NoError(t, s.Publish(ctx, events))
+
+	messages, err := s.Range(ctx, "-", 2)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	require.Equal(t, events[0], messages[0].Event)
+	require.NoError(t, messages[0].Err)
+
+	messages, err = s.Range(ctx, "("+messages[1].Offset, 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"c"}, texts(messages))
+}
+
+func TestGroupsReceiveEveryEventOnce(t *testing.T) {
+	s, _ := newTestStream(t)
+	require.NoError(t, s.CreateGroup(ctx, "search", "$"))
+	require.NoError(t, s.CreateGroup(ctx, "analytics", "$"))
+	require.NoError(t, s.CreateGroup(ctx, "search", "$"))
+	require.NoError(t, s.Publish(ctx, newEvents("a", "b")))
+
+	first := s.Consumer("search", "first", time.Minute)
+	second := s.Consumer("search", "second", time.Minute)
+	messages, err := first.Read(ctx, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, texts(messages))
+	messages, err = second.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, texts(messages))
+
+	messages, err = s.Consumer("analytics", "first", time.Minute).Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, texts(messages))
+}
+
+func TestUnacknowledgedEventsAreClaimed(t *testing.T) {
+	s, server := newTestStream(t)
+	now := time.Now()
+	server.SetTime(now)
+	require.NoError(t, s.CreateGroup(ctx, "search", "0"))
+	require.NoError(t, s.Publish(ctx, newEvents("a", "b")))
+
+	crashed := s.Consumer("search", "crashed", time.Minute)
+	messages, err := crashed.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.NoError(t, crashed.Ack(ctx, messages[1].Offset))
+
+	other := s.Consumer("search", "other", time.Minute)
+	messages, err = other.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+	server.SetTime(now.Add(time.Minute))
+	messages, err = other.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, texts(messages))
+}
+
+func TestResetGroupReplaysFromOffset(t *testing.T) {
+	s, _ := newTestStream(t)
+	require.NoError(t, s.CreateGroup(ctx, "search", "0"))
+	require.NoError(t, s.Publish(ctx, newEvents("a", "b", "c")))
+	consumer := s.Consumer("search", "first", time.Minute)
+	messages, err := consumer.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.NoError(t, consumer.Ack(ctx, offsets(messages)...))
+
+	require.NoError(t, s.ResetGroup(ctx, "search", messages[0].Offset))
+	messages, err = consumer.Read(ctx, 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, texts(messages))
+}
+
+func TestMalformedEntriesAreReported(t *testing.T) {
+	s, _ := newTestStream(t)
+	require.NoError(t, s.client.XAdd(ctx, &redis.XAddArgs{Stream: s.name, Values: map[string]interface{}{eventField: "{"}}).Err())
+
+	messages, err := s.Range(ctx, "-", 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	require.Error(t, messages[0].Err)
+}
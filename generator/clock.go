@@ -0,0 +1,47 @@
+package generator
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// monotonicClock turns wall clock readings into timestamps that never go
+// back. When the wall clock steps back, e.g. corrected by NTP, the last
+// timestamp is reused until the wall clock passes it again, so ids stay
+// ordered at the cost of their time lagging a little.
+type monotonicClock struct {
+	now  func() time.Time
+	unit time.Duration
+	last int64
+}
+
+// next returns the current timestamp and whether it is later than the one
+// returned before.
+func (c *monotonicClock) next() (int64, bool) {
+	timestamp := c.now().UnixNano() / int64(c.unit)
+	if timestamp > c.last {
+		c.last = timestamp
+		return timestamp, true
+	}
+	return c.last, false
+}
+
+// skip moves the timestamp a unit ahead once every id of the current one is
+// taken. The wall clock catches up with it shortly.
+func (c *monotonicClock) skip() int64 {
+	c.last++
+	return c.last
+}
+
+// putMillis writes milliseconds since the epoch as 4 bytes of seconds and 2
+// bytes of milliseconds within the second. The seconds take the place of the
+// timestamp of object ids, so ids of different generators sort by time to
+// the second and MongoDB still reads their creation time.
+func putMillis(b []byte, millis int64) {
+	binary.BigEndian.PutUint32(b[:4], uint32(millis/1000))
+	binary.BigEndian.PutUint16(b[4:6], uint16(millis%1000))
+}
+
+func putSeconds(b []byte, seconds int64) {
+	binary.BigEndian.PutUint32(b[:4], uint32(seconds))
+}
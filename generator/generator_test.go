@@ -0,0 +1,189 @@
+package generator
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+	"twitter/storage"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func requireOrdered(t *testing.T, ids ...storage.PostID) {
+	for i := 1; i < len(ids); i++ {
+		require.Less(t, ids[i-1].Hex(), ids[i].Hex())
+	}
+}
+
+func TestSnowflakeLayout(t *testing.T) {
+	g := NewSnowflakeGenerator(0x0102)
+	clock := &fakeClock{now: time.Unix(1656000000, 123*int64(time.Millisecond))}
+	g.clock.now = clock.Now
+
+	first, second := g.NewPostID(), g.NewPostID()
+	require.Equal(t, "62b48e00007b010200000000", first.Hex())
+	require.Equal(t, "62b48e00007b010200000001", second.Hex())
+
+	clock.now = clock.now.Add(time.Millisecond)
+	require.Equal(t, "62b48e00007c010200000000", g.NewPostID().Hex())
+}
+
+func TestSnowflakeSurvivesClockGoingBack(t *testing.T) {
+	g := NewSnowflakeGenerator(1)
+	clock := &fakeClock{now: time.Unix(1656000000, 0)}
+	g.clock.now = clock.Now
+
+	first := g.NewPostID()
+	clock.now = clock.now.Add(-time.Second)
+	second := g.NewPostID()
+	clock.now = clock.now.Add(time.Second + time.Millisecond)
+	third := g.NewPostID()
+
+	requireOrdered(t, first, second, third)
+	require.Equal(t, first[:6], second[:6])
+}
+
+func TestSnowflakeSequenceOverflowTakesNextMillisecond(t *testing.T) {
+	g := NewSnowflakeGenerator(1)
+	clock := &fakeClock{now: time.Unix(1656000000, 0)}
+	g.clock.now = clock.Now
+
+	first := g.NewPostID()
+	g.sequence = 1<<32 - 1
+	second := g.NewPostID()
+	third := g.NewPostID()
+
+	requireOrdered(t, first, second, third)
+	require.Equal(t, "62b48e000001000100000000", second.Hex())
+
+	// the wall clock catching up does not reuse the skipped millisecond
+	clock.now = clock.now.Add(time.Millisecond)
+	requireOrdered(t, third, g.NewPostID())
+}
+
+func TestSnowflakeNodesDoNotCollide(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1656000000, 0)}
+	first, second := NewSnowflakeGenerator(1), NewSnowflakeGenerator(2)
+	first.clock.now, second.clock.now = clock.Now, clock.Now
+	seen := map[storage.PostID]bool{}
+	for i := 0; i < 1000; i++ {
+		seen[first.NewPostID()] = true
+		seen[second.NewPostID()] = true
+	}
+	require.Len(t, seen, 2000)
+}
+
+func TestUlidIncrementsWithinMillisecond(t *testing.T) {
+	g := NewUlidGenerator()
+	clock := &fakeClock{now: time.Unix(1656000000, 5*int64(time.Millisecond))}
+	g.clock.now = clock.Now
+	g.entropy = bytes.NewReader(bytes.Repeat([]byte{0x10}, 12))
+
+	first, second := g.NewPostID(), g.NewPostID()
+	require.Equal(t, "62b48e000005101010101010", first.Hex())
+	require.Equal(t, "62b48e000005101010101011", second.Hex())
+
+	clock.now = clock.now.Add(-time.Millisecond)
+	third := g.NewPostID()
+	require.Equal(t, "62b48e000005101010101012", third.Hex())
+
+	clock.now = clock.now.Add(2 * time.Millisecond)
+	require.Equal(t, "62b48e000006101010101010", g.NewPostID().Hex())
+}
+
+func TestUlidRandomOverflowTakesNextMillisecond(t *testing.T) {
+	g := NewUlidGenerator()
+	clock := &fakeClock{now: time.Unix(1656000000, 0)}
+	g.clock.now = clock.Now
+	g.entropy = bytes.NewReader(append(bytes.Repeat([]byte{0xff}, 6), bytes.Repeat([]byte{0x01}, 6)...))
+
+	first, second := g.NewPostID(), g.NewPostID()
+	require.Equal(t, "62b48e000000ffffffffffff", first.Hex())
+	require.Equal(t, "62b48e000001010101010101", second.Hex())
+}
+
+func TestKsuidLayout(t *testing.T) {
+	g := NewKsuidGenerator()
+	clock := &fakeClock{now: time.Unix(1656000000, 999*int64(time.Millisecond))}
+	g.clock.now = clock.Now
+	g.entropy = bytes.NewReader(bytes.Repeat([]byte{0x20}, 8))
+
+	first, second := g.NewPostID(), g.NewPostID()
+	require.Equal(t, "62b48e002020202020202020", first.Hex())
+	require.Equal(t, "62b48e002020202020202021", second.Hex())
+}
+
+func TestIdsSortWithObjectIds(t *testing.T) {
+	objectIds := NewObjectIdGenerator()
+	clock := &fakeClock{now: time.Unix(1656000000, 0)}
+	objectIds.now = clock.Now
+	older := objectIds.NewPostID()
+
+	clock.now = clock.now.Add(time.Second)
+	snowflakes, ulids, ksuids := NewSnowflakeGenerator(1<<16-1), NewUlidGenerator(), NewKsuidGenerator()
+	snowflakes.clock.now, ulids.clock.now, ksuids.clock.now = clock.Now, clock.Now, clock.Now
+	newer := []storage.PostID{snowflakes.NewPostID(), ulids.NewPostID(), ksuids.NewPostID()}
+
+	clock.now = clock.now.Add(time.Second)
+	newest := objectIds.NewPostID()
+	for _, id := range newer {
+		requireOrdered(t, older, id, newest)
+	}
+}
+
+func TestGeneratorsDoNotCollide(t *testing.T) {
+	generators := map[string]storage.IdGenerator{
+		"objectid":  NewObjectIdGenerator(),
+		"snowflake": NewSnowflakeGenerator(1),
+		"ulid":      NewUlidGenerator(),
+		"ksuid":     NewKsuidGenerator(),
+	}
+	for name, g := range generators {
+		g := g
+		t.Run(name, func(t *testing.T) {
+			var mu sync.Mutex
+			seen := map[storage.PostID]bool{}
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ids := make([]storage.PostID, 0, 10000)
+					for j := 0; j < 10000; j++ {
+						ids = append(ids, g.NewPostID())
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					for _, id := range ids {
+						seen[id] = true
+					}
+				}()
+			}
+			wg.Wait()
+			require.Len(t, seen, 80000)
+		})
+	}
+}
+
+func TestIdsOfOneGoroutineAreOrdered(t *testing.T) {
+	for name, g := range map[string]storage.IdGenerator{
+		"snowflake": NewSnowflakeGenerator(1),
+		"ulid":      NewUlidGenerator(),
+		"ksuid":     NewKsuidGenerator(),
+	} {
+		previous := g.NewPostID()
+		for i := 0; i < 10000; i++ {
+			id := g.NewPostID()
+			require.Less(t, previous.Hex(), id.Hex(), name)
+			previous = id
+		}
+	}
+}
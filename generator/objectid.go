@@ -0,0 +1,43 @@
+package generator
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+	"twitter/storage"
+)
+
+// ObjectIdGenerator mints ids laid out as MongoDB object ids: seconds since
+// the epoch, 5 random bytes chosen once per generator and a counter starting
+// at a random value.
+type ObjectIdGenerator struct {
+	process [5]byte
+	counter uint32
+	now     func() time.Time
+}
+
+func NewObjectIdGenerator() *ObjectIdGenerator {
+	g := &ObjectIdGenerator{now: time.Now}
+	var seed [4]byte
+	_, err := rand.Read(g.process[:])
+	if err == nil {
+		_, err = rand.Read(seed[:])
+	}
+	if err != nil {
+		panic(err)
+	}
+	g.counter = binary.BigEndian.Uint32(seed[:])
+	return g
+}
+
+func (g *ObjectIdGenerator) NewPostID() storage.PostID {
+	var id storage.PostID
+	binary.BigEndian.PutUint32(id[:4], uint32(g.now().Unix()))
+	copy(id[4:9], g.process[:])
+	counter := atomic.AddUint32(&g.counter, 1)
+	id[9], id[10], id[11] = byte(counter>>16), byte(counter>>8), byte(counter)
+	return id
+}
+
+var _ storage.IdGenerator = (*ObjectIdGenerator)(nil)
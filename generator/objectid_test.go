@@ -0,0 +1,37 @@
+package generator
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+	"twitter/storage"
+)
+
+func TestObjectIdsAreUniqueAndOrdered(t *testing.T) {
+	g := NewObjectIdGenerator()
+	now := time.Unix(1656000000, 0)
+	g.now = func() time.Time { return now }
+	g.counter = 0
+	first, second := g.NewPostID(), g.NewPostID()
+	require.Less(t, first.Hex(), second.Hex())
+	require.Equal(t, "62b48e00", first.Hex()[:8])
+
+	var mu sync.Mutex
+	seen := map[storage.PostID]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				id := g.NewPostID()
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Len(t, seen, 8000)
+}
@@ -1,12 +1,91 @@
 package generator
 
-import "math/rand"
-
-func GetRandomKey() string {
-	alphaBet := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	rand.Shuffle(len(alphaBet), func(i, j int) {
-		alphaBet[i], alphaBet[j] = alphaBet[j], alphaBet[i]
-	})
-	id := string(alphaBet[:10])
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+	"twitter/storage"
+)
+
+// randomGenerator mints ids of a timestamp followed by random bytes. Ids
+// minted within one timestamp increment the random bytes of the first one,
+// as monotonic ULIDs do, so they keep the order they were minted in.
+type randomGenerator struct {
+	mu      sync.Mutex
+	clock   monotonicClock
+	put     func(b []byte, timestamp int64)
+	random  []byte
+	entropy io.Reader
+}
+
+func newRandomGenerator(unit time.Duration, put func(b []byte, timestamp int64), randomLen int) randomGenerator {
+	return randomGenerator{
+		clock:   monotonicClock{now: time.Now, unit: unit},
+		put:     put,
+		random:  make([]byte, randomLen),
+		entropy: rand.Reader,
+	}
+}
+
+func (g *randomGenerator) NewPostID() storage.PostID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	timestamp, later := g.clock.next()
+	if later {
+		g.reseed()
+	} else if !increment(g.random) {
+		timestamp = g.clock.skip()
+		g.reseed()
+	}
+	var id storage.PostID
+	timeLen := len(id) - len(g.random)
+	g.put(id[:timeLen], timestamp)
+	copy(id[timeLen:], g.random)
 	return id
 }
+
+func (g *randomGenerator) reseed() {
+	_, err := io.ReadFull(g.entropy, g.random)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// increment adds one to b read as a big endian number, it reports false if b
+// overflows.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UlidGenerator mints ids like ULIDs: a millisecond timestamp and 48 random
+// bits. It needs no configuration, two instances collide only if they draw
+// the same random bits within a millisecond.
+type UlidGenerator struct {
+	randomGenerator
+}
+
+func NewUlidGenerator() *UlidGenerator {
+	return &UlidGenerator{newRandomGenerator(time.Millisecond, putMillis, 6)}
+}
+
+// KsuidGenerator mints ids like KSUIDs: a timestamp in seconds and 64 random
+// bits, trading precision of the time for less chance of collisions.
+type KsuidGenerator struct {
+	randomGenerator
+}
+
+func NewKsuidGenerator() *KsuidGenerator {
+	return &KsuidGenerator{newRandomGenerator(time.Second, putSeconds, 8)}
+}
+
+var (
+	_ storage.IdGenerator = (*UlidGenerator)(nil)
+	_ storage.IdGenerator = (*KsuidGenerator)(nil)
+)
@@ -0,0 +1,47 @@
+package generator
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+	"twitter/storage"
+)
+
+// SnowflakeGenerator mints ids of a millisecond timestamp, the node id and a
+// sequence number restarting every millisecond. Ids never collide as long as
+// every running instance has its own node id, without any coordination
+// between them.
+type SnowflakeGenerator struct {
+	mu       sync.Mutex
+	node     uint16
+	clock    monotonicClock
+	sequence uint32
+}
+
+func NewSnowflakeGenerator(node uint16) *SnowflakeGenerator {
+	return &SnowflakeGenerator{
+		node:  node,
+		clock: monotonicClock{now: time.Now, unit: time.Millisecond},
+	}
+}
+
+func (g *SnowflakeGenerator) NewPostID() storage.PostID {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	millis, later := g.clock.next()
+	if later {
+		g.sequence = 0
+	} else {
+		g.sequence++
+		if g.sequence == 0 {
+			millis = g.clock.skip()
+		}
+	}
+	var id storage.PostID
+	putMillis(id[:6], millis)
+	binary.BigEndian.PutUint16(id[6:8], g.node)
+	binary.BigEndian.PutUint32(id[8:], g.sequence)
+	return id
+}
+
+var _ storage.IdGenerator = (*SnowflakeGenerator)(nil)
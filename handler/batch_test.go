@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"testing"
+	"twitter/generator"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+func TestGetPostsByIdsReturnsFoundAndMissing(t *testing.T) {
+	s := inmemorystorage.NewStorage()
+	first := storage.PostData{Id: idGenerator.NewPostID(), Text: "first", AuthorId: "user1"}
+	second := storage.PostData{Id: idGenerator.NewPostID(), Text: "second", AuthorId: "user2"}
+	require.NoError(t, s.Save(context.Background(), first))
+	require.NoError(t, s.Save(context.Background(), second))
+	missing := idGenerator.NewPostID().Hex()
+
+	ids := []string{second.Id.Hex(), missing, first.Id.Hex(), "UNKNOWNURL", missing}
+	recorder, _ := doRequest(t, s, http.MethodGet, "/api/v1/posts?ids="+strings.Join(ids, ","), "")
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response PostsByIdsResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, []storage.PostData{second, first}, response.Posts)
+	require.Equal(t, []string{missing, "UNKNOWNURL"}, response.MissingIds)
+}
+
+func TestGetPostsByIdsValidatesIds(t *testing.T) {
+	tooMany := strings.TrimSuffix(strings.Repeat("abc,", maxBatchSize+1), ",")
+	for _, path := range []string{
+		"/api/v1/posts",
+		"/api/v1/posts?ids=",
+		"/api/v1/posts?ids=a,,b",
+		"/api/v1/posts?ids=a&ids=b",
+		"/api/v1/posts?ids=" + tooMany,
+	} {
+		recorder, problem := doRequest(t, inmemorystorage.NewStorage(), http.MethodGet, path, "")
+		require.Equal(t, http.StatusBadRequest, recorder.Code, path)
+		require.Equal(t, CodeValidationFailed, problem.Code, path)
+	}
+}
+
+func TestGetPostsByIdsMatchesIdsInAnyCase(t *testing.T) {
+	s := inmemorystorage.NewStorage()
+	post := storage.PostData{Id: idGenerator.NewPostID(), Text: "first", AuthorId: "user1"}
+	require.NoError(t, s.Save(context.Background(), post))
+	missing := strings.ToUpper(idGenerator.NewPostID().Hex())
+
+	ids := []string{strings.ToUpper(post.Id.Hex()), missing, strings.ToLower(missing)}
+	recorder, _ := doRequest(t, s, http.MethodGet, "/api/v1/posts?ids="+strings.Join(ids, ","), "")
+
+	require.Equal(t, http.StatusOK, recorder.Code)
+	var response PostsByIdsResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	require.Equal(t, []storage.PostData{post}, response.Posts)
+	require.Equal(t, []string{missing}, response.MissingIds)
+}
@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"twitter/cache/rediscache"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+	"twitter/storage/rediscachedstorage"
+)
+
+func TestTimelineReadYourWritesAfterPost(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	router := newTestRouter(rediscachedstorage.NewStorage(inmemorystorage.NewStorage(), rediscache.NewBackend(client), nil, rediscachedstorage.DefaultConfig()))
+
+	getTimeline := func() storage.PostsByUser {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/users/user1/posts", nil))
+		require.Equal(t, http.StatusOK, recorder.Code)
+		var page storage.PostsByUser
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &page))
+		return page
+	}
+	require.Empty(t, getTimeline().Posts)
+
+	for i, text := range []string{"first", "second"} {
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/posts", strings.NewReader(`{"text":"`+text+`"}`))
+		request.Header.Set(userIdHeader, "user1")
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		require.Len(t, getTimeline().Posts, i+1)
+	}
+}
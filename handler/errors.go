@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"twitter/logging"
+	"twitter/storage"
+)
+
+const problemContentType = "application/problem+json"
+
+// ErrorCode is a stable machine-readable identifier of an error. Clients
+// should branch on codes, never on titles or details.
+type ErrorCode string
+
+const (
+	CodeValidationFailed ErrorCode = "validation_failed"
+	CodeInvalidPageToken ErrorCode = "invalid_page_token"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodePostNotFound     ErrorCode = "post_not_found"
+	CodeRouteNotFound    ErrorCode = "route_not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeIdCollision      ErrorCode = "id_collision"
+	CodeInternal         ErrorCode = "internal"
+)
+
+var errorCodeStatuses = map[ErrorCode]int{
+	CodeValidationFailed: http.StatusBadRequest,
+	CodeInvalidPageToken: http.StatusBadRequest,
+	CodeUnauthorized:     http.StatusUnauthorized,
+	CodeForbidden:        http.StatusForbidden,
+	CodePostNotFound:     http.StatusNotFound,
+	CodeRouteNotFound:    http.StatusNotFound,
+	CodeMethodNotAllowed: http.StatusMethodNotAllowed,
+	CodeIdCollision:      http.StatusConflict,
+	CodeInternal:         http.StatusInternalServerError,
+}
+
+// Problem is an RFC 7807 problem details body extended with the error code
+// and the id of the request.
+type Problem struct {
+	Type      string    `json:"type"`
+	Title     string    `json:"title"`
+	Status    int       `json:"status"`
+	Detail    string    `json:"detail,omitempty"`
+	Instance  string    `json:"instance,omitempty"`
+	Code      ErrorCode `json:"code"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+type apiError struct {
+	code   ErrorCode
+	detail string
+}
+
+func (e *apiError) Error() string {
+	return string(e.code) + ": " + e.detail
+}
+
+func newApiError(code ErrorCode, detail string) error {
+	return &apiError{code: code, detail: detail}
+}
+
+// classifyError maps errors returned by handlers and storages to the public
+// error taxonomy. Anything unknown is an internal error whose details must not
+// leak to the client.
+func classifyError(err error) (ErrorCode, string) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.code, apiErr.detail
+	case errors.Is(err, storage.ErrorNotFound), errors.Is(err, storage.ErrorInvalidId):
+		return CodePostNotFound, "Post with the requested id does not exist"
+	case errors.Is(err, storage.ErrorInvalidPage):
+		return CodeInvalidPageToken, "Page token is invalid or was issued for another page size"
+	case errors.Is(err, storage.ErrorCollision):
+		return CodeIdCollision, "Failed to allocate a unique post id, the request may be retried"
+	default:
+		return CodeInternal, "Internal server error"
+	}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code, detail := classifyError(err)
+	status := errorCodeStatuses[code]
+	logger := logging.FromContext(r.Context())
+	if code == CodeInternal {
+		logger.Error("request failed", "error", err)
+	} else {
+		logger.Debug("request rejected", "code", code, "error", err)
+	}
+
+	rawResponse, err := json.Marshal(Problem{
+		Type:      "urn:blogapp:problem:" + string(code),
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestId: RequestIdFromContext(r.Context()),
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, err = w.Write(rawResponse)
+	if err != nil {
+		logger.Error("failed to write response", "error", err)
+	}
+}
+
+func handleRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newApiError(CodeRouteNotFound, "No such endpoint"))
+}
+
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newApiError(CodeMethodNotAllowed, "Method "+r.Method+" is not supported by the endpoint"))
+}
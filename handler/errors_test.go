@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"twitter/storage"
+)
+
+func doRequest(t *testing.T, s storage.Storage, method, path, body string) (*httptest.ResponseRecorder, Problem) {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	request.Header.Set(userIdHeader, "user1")
+	recorder := httptest.NewRecorder()
+	newTestRouter(s).ServeHTTP(recorder, request)
+
+	var problem Problem
+	if recorder.Header().Get("Content-Type") == problemContentType {
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &problem))
+	}
+	return recorder, problem
+}
+
+func TestStorageErrorsAreMappedToProblems(t *testing.T) {
+	cases := []struct {
+		name   string
+		err    error
+		method string
+		path   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"not found", fmt.Errorf("no posts - %w", storage.ErrorNotFound), http.MethodGet, "/api/v1/posts/abc", "", http.StatusNotFound, CodePostNotFound},
+		{"invalid id", fmt.Errorf("invalid id - %w", storage.ErrorInvalidId), http.MethodGet, "/api/v1/posts/UNKNOWNURL", "", http.StatusNotFound, CodePostNotFound},
+		{"invalid page", fmt.Errorf("invalid page - %w", storage.ErrorInvalidPage), http.MethodGet, "/api/v1/users/user1/posts?page=zzz", "", http.StatusBadRequest, CodeInvalidPageToken},
+		{"collision", fmt.Errorf("too much attempts - %w", storage.ErrorCollision), http.MethodPost, "/api/v1/posts", `{"text":"hi"}`, http.StatusConflict, CodeIdCollision},
+		{"internal", fmt.Errorf("something went wrong - %w", storage.CommonStorageError), http.MethodPost, "/api/v1/posts", `{"text":"hi"}`, http.StatusInternalServerError, CodeInternal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			recorder, problem := doRequest(t, &stubStorage{err: c.err}, c.method, c.path, c.body)
+
+			require.Equal(t, c.status, recorder.Code)
+			require.Equal(t, problemContentType, recorder.Header().Get("Content-Type"))
+			require.Equal(t, c.code, problem.Code)
+			require.Equal(t, c.status, problem.Status)
+			require.NotEmpty(t, problem.RequestId)
+			require.NotContains(t, problem.Detail, "storage")
+		})
+	}
+}
+
+func TestValidationProblems(t *testing.T) {
+	recorder, problem := doRequest(t, &stubStorage{}, http.MethodGet, "/api/v1/users/user1/posts?size=1000", "")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Equal(t, CodeValidationFailed, problem.Code)
+
+	recorder, problem = doRequest(t, &stubStorage{}, http.MethodPost, "/api/v1/posts", "{not json")
+	require.Equal(t, http.StatusBadRequest, recorder.Code)
+	require.Equal(t, CodeValidationFailed, problem.Code)
+}
+
+func TestRouterProblems(t *testing.T) {
+	recorder, problem := doRequest(t, &stubStorage{}, http.MethodGet, "/api/v2/unknown", "")
+	require.Equal(t, http.StatusNotFound, recorder.Code)
+	require.Equal(t, CodeRouteNotFound, problem.Code)
+
+	recorder, problem = doRequest(t, &stubStorage{}, http.MethodDelete, "/api/v1/posts", "")
+	require.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+	require.Equal(t, CodeMethodNotAllowed, problem.Code)
+}
@@ -3,21 +3,35 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"twitter/health"
+	"twitter/logging"
 	"twitter/storage"
 )
 
+const (
+	minPageSize  = 1
+	maxPageSize  = 100
+	maxBatchSize = 100
+)
+
 type PublicationRequestData struct {
 	Text string `json:"text"`
 }
 
+type PostsByIdsResponse struct {
+	Posts      []storage.PostData `json:"posts"`
+	MissingIds []string           `json:"missingIds"`
+}
+
 type HttpHandler struct {
 	Storage storage.Storage
+	Ids     storage.IdGenerator
+	Health  *health.Checker
 }
 
 func isValidUserId(userId string) bool {
@@ -32,20 +46,36 @@ func isValidUserId(userId string) bool {
 	}
 }
 
+func writeJson(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	rawResponse, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(rawResponse)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("failed to write response", "error", err)
+		return
+	}
+}
+
 func (h *HttpHandler) HandlePublication(w http.ResponseWriter, r *http.Request) {
 	var publicationData PublicationRequestData
 	err := json.NewDecoder(r.Body).Decode(&publicationData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, newApiError(CodeValidationFailed, "Request body is not a valid post: "+err.Error()))
 		return
 	}
-	userId := r.Header.Get("System-Design-User-Id")
+	userId := r.Header.Get(userIdHeader)
 	if !isValidUserId(userId) {
-		http.Error(w, "Provided userId is not valid", http.StatusUnauthorized)
+		writeError(w, r, newApiError(CodeUnauthorized, "Provided userId is not valid"))
 		return
 	}
 	postData := storage.PostData{
-		Id:             primitive.NewObjectID(),
+		Id:             h.Ids.NewPostID(),
 		Text:           publicationData.Text,
 		AuthorId:       userId,
 		CreatedAt:      time.Now().String(),
@@ -53,22 +83,11 @@ func (h *HttpHandler) HandlePublication(w http.ResponseWriter, r *http.Request)
 	}
 	err = h.Storage.Save(r.Context(), postData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	rawResponse, err := json.Marshal(postData)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(rawResponse)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+	writeJson(w, r, http.StatusOK, postData)
 }
 
 func (h *HttpHandler) HandleGetPublication(w http.ResponseWriter, r *http.Request) {
@@ -77,28 +96,62 @@ func (h *HttpHandler) HandleGetPublication(w http.ResponseWriter, r *http.Reques
 
 	post, err := h.Storage.GetPostById(r.Context(), postId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
-	rawResponse, err := json.Marshal(post)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	writeJson(w, r, http.StatusOK, post)
+}
+
+func (h *HttpHandler) HandleGetPublicationsByIds(w http.ResponseWriter, r *http.Request) {
+	idsParam := r.URL.Query()["ids"]
+	if len(idsParam) != 1 {
+		writeError(w, r, newApiError(CodeValidationFailed, "Exactly 1 query param \"ids\" is required"))
 		return
 	}
+	ids := strings.Split(idsParam[0], ",")
+	if len(ids) > maxBatchSize {
+		writeError(w, r, newApiError(CodeValidationFailed,
+			fmt.Sprintf("query param \"ids\" should contain at most %d ids", maxBatchSize)))
+		return
+	}
+	for _, id := range ids {
+		if id == "" {
+			writeError(w, r, newApiError(CodeValidationFailed, "query param \"ids\" should not contain empty ids"))
+			return
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(rawResponse)
+	posts, err := h.Storage.GetPostsByIds(r.Context(), ids)
 	if err != nil {
-		fmt.Println(err.Error())
+		writeError(w, r, err)
 		return
 	}
+
+	found := make(map[string]bool, len(posts))
+	for _, post := range posts {
+		found[post.Id.Hex()] = true
+	}
+	// ids are matched in canonical form but reported missing as requested
+	response := PostsByIdsResponse{Posts: posts, MissingIds: []string{}}
+	for _, id := range ids {
+		key := id
+		postId, err := storage.ParsePostID(id)
+		if err == nil {
+			key = postId.Hex()
+		}
+		if !found[key] {
+			found[key] = true
+			response.MissingIds = append(response.MissingIds, id)
+		}
+	}
+	writeJson(w, r, http.StatusOK, response)
 }
 
 func (h *HttpHandler) HandleGetPublicationsByUser(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	if len(parts) < 2 {
-		http.Error(w, "No userId in url", http.StatusBadRequest)
+		writeError(w, r, newApiError(CodeValidationFailed, "No userId in url"))
 		return
 	}
 	userId := parts[len(parts)-2]
@@ -108,18 +161,23 @@ func (h *HttpHandler) HandleGetPublicationsByUser(w http.ResponseWriter, r *http
 	pageIdParam := r.URL.Query()["page"]
 	pageId := ""
 	if len(pageSizeParam) > 1 {
-		http.Error(w, "More than 1 query param \"size\"", http.StatusBadRequest)
+		writeError(w, r, newApiError(CodeValidationFailed, "More than 1 query param \"size\""))
 		return
 	} else if len(pageSizeParam) == 1 {
 		i, err := strconv.Atoi(pageSizeParam[0])
 		if err != nil {
-			http.Error(w, "query param \"size\" should be integer", http.StatusBadRequest)
+			writeError(w, r, newApiError(CodeValidationFailed, "query param \"size\" should be integer"))
+			return
+		}
+		if i < minPageSize || i > maxPageSize {
+			writeError(w, r, newApiError(CodeValidationFailed,
+				fmt.Sprintf("query param \"size\" should be between %d and %d", minPageSize, maxPageSize)))
 			return
 		}
 		pageSize = i
 	}
 	if len(pageIdParam) > 1 {
-		http.Error(w, "More than 1 query param \"page\"", http.StatusBadRequest)
+		writeError(w, r, newApiError(CodeValidationFailed, "More than 1 query param \"page\""))
 		return
 	} else if len(pageIdParam) == 1 {
 		pageId = pageIdParam[0]
@@ -127,61 +185,61 @@ func (h *HttpHandler) HandleGetPublicationsByUser(w http.ResponseWriter, r *http
 
 	posts, err := h.Storage.GetPostsByUserId(r.Context(), userId, pageSize, pageId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	rawResponse, err := json.Marshal(posts)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(rawResponse)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+	writeJson(w, r, http.StatusOK, posts)
 }
 
 func (h *HttpHandler) HandleRoot(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
 	_, err := w.Write([]byte("Hello from Server!"))
 	if err != nil {
-		fmt.Println(err.Error())
+		logging.FromContext(r.Context()).Error("failed to write response", "error", err)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
 }
 
-func (h *HttpHandler) HandlePing(w http.ResponseWriter, r *http.Request) {
-	return
+func (h *HttpHandler) HandleLive(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, r, http.StatusOK, map[string]health.Status{"status": health.StatusOk})
+}
+
+func (h *HttpHandler) HandleReady(w http.ResponseWriter, r *http.Request) {
+	report := h.Health.Check(r.Context())
+
+	status := http.StatusOK
+	if !report.Ready() {
+		status = http.StatusServiceUnavailable
+	}
+	writeJson(w, r, status, report)
 }
 
 func (h *HttpHandler) HandleUpdatePublication(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	postId := parts[len(parts)-1]
 
+	userId := r.Header.Get(userIdHeader)
+	if !isValidUserId(userId) {
+		writeError(w, r, newApiError(CodeUnauthorized, "Provided userId is not valid"))
+		return
+	}
+
 	post, err := h.Storage.GetPostById(r.Context(), postId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, r, err)
 		return
 	}
 
 	var publicationData PublicationRequestData
 	err = json.NewDecoder(r.Body).Decode(&publicationData)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-	userId := r.Header.Get("System-Design-User-Id")
-	if !isValidUserId(userId) {
-		http.Error(w, "Provided userId is not valid", http.StatusUnauthorized)
+		writeError(w, r, newApiError(CodeValidationFailed, "Request body is not a valid post: "+err.Error()))
 		return
 	}
 
 	if userId != post.AuthorId {
-		http.Error(w, "This post is published by another user", http.StatusForbidden)
+		writeError(w, r, newApiError(CodeForbidden, "This post is published by another user"))
 		return
 	}
 
@@ -190,20 +248,9 @@ func (h *HttpHandler) HandleUpdatePublication(w http.ResponseWriter, r *http.Req
 
 	err = h.Storage.Update(r.Context(), post)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	rawResponse, err := json.Marshal(post)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(rawResponse)
-	if err != nil {
-		fmt.Println(err.Error())
-		return
-	}
+	writeJson(w, r, http.StatusOK, post)
 }
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gorilla/mux"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"twitter/logging"
+	"twitter/metrics"
+)
+
+const (
+	requestIdHeader = "X-Request-Id"
+	userIdHeader    = "System-Design-User-Id"
+)
+
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._\-]{1,128}$`)
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += n
+	return n, err
+}
+
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return template
+}
+
+func metricsMiddleware(m *metrics.Metrics) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			recorder := newResponseRecorder(w)
+			next.ServeHTTP(recorder, r)
+			m.ObserveHttpRequest(routeTemplate(r), r.Method, recorder.status, time.Since(start))
+		})
+	}
+}
+
+type requestIdKey struct{}
+
+func RequestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+func newRequestId() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// requestIdMiddleware reuses the request id sent by the client or a proxy in
+// front of us, generates one otherwise, and attaches a logger carrying the id
+// to the request context.
+func requestIdMiddleware(logger *logging.Logger) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestId := r.Header.Get(requestIdHeader)
+			if !validRequestId.MatchString(requestId) {
+				requestId = newRequestId()
+			}
+			w.Header().Set(requestIdHeader, requestId)
+
+			ctx := context.WithValue(r.Context(), requestIdKey{}, requestId)
+			ctx = logging.WithContext(ctx, logger.With("requestId", requestId))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := newResponseRecorder(w)
+		next.ServeHTTP(recorder, r)
+		logging.FromContext(r.Context()).Info("request handled",
+			"method", r.Method,
+			"route", routeTemplate(r),
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"durationMs", float64(time.Since(start).Microseconds())/1000,
+			"userId", r.Header.Get(userIdHeader),
+		)
+	})
+}
@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"twitter/logging"
+	"twitter/metrics"
+)
+
+func TestMetricsMiddlewareUsesRouteTemplate(t *testing.T) {
+	m := metrics.New()
+	r := mux.NewRouter()
+	r.Use(metricsMiddleware(m))
+	r.HandleFunc("/api/v1/posts/{postId:\\w+}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/posts/first", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/posts/second", nil))
+
+	expected := `
+# HELP blog_http_requests_total Number of handled HTTP requests by route template, method and status.
+# TYPE blog_http_requests_total counter
+blog_http_requests_total{method="GET",route="/api/v1/posts/{postId:\\w+}",status="404"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "blog_http_requests_total"))
+}
+
+func TestRequestIdIsPropagatedAndLogged(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := mux.NewRouter()
+	r.Use(requestIdMiddleware(logging.New(buf, logging.LevelInfo)))
+	r.Use(accessLogMiddleware)
+	r.HandleFunc("/api/v1/posts", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("created"))
+	})
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/posts", nil)
+	request.Header.Set(requestIdHeader, "client-request-1")
+	request.Header.Set(userIdHeader, "user1")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+
+	require.Equal(t, "client-request-1", recorder.Header().Get(requestIdHeader))
+	record := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "client-request-1", record["requestId"])
+	require.Equal(t, "/api/v1/posts", record["route"])
+	require.Equal(t, http.MethodPost, record["method"])
+	require.Equal(t, 200.0, record["status"])
+	require.Equal(t, 7.0, record["bytes"])
+	require.Equal(t, "user1", record["userId"])
+}
+
+func TestInvalidRequestIdIsReplaced(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(requestIdMiddleware(logging.New(ioutil.Discard, logging.LevelInfo)))
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, w.Header().Get(requestIdHeader), RequestIdFromContext(r.Context()))
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.Header.Set(requestIdHeader, "bad id\n")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+
+	require.Len(t, recorder.Header().Get(requestIdHeader), 32)
+}
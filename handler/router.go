@@ -2,19 +2,35 @@ package handler
 
 import (
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 	"net/http"
+	"twitter/health"
+	"twitter/logging"
+	"twitter/metrics"
 	"twitter/storage"
+	"twitter/tracing"
 )
 
-func CreateRouterFromStorage(cachedStorage storage.Storage) *mux.Router {
+func CreateRouterFromStorage(cachedStorage storage.Storage, ids storage.IdGenerator, checker *health.Checker, m *metrics.Metrics, logger *logging.Logger) *mux.Router {
 	handler := &HttpHandler{
 		Storage: cachedStorage,
+		Ids:     ids,
+		Health:  checker,
 	}
 
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(handleRouteNotFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(handleMethodNotAllowed)
+	r.Use(requestIdMiddleware(logger))
+	r.Use(otelmux.Middleware(tracing.ServiceName))
+	r.Use(metricsMiddleware(m))
+	r.Use(accessLogMiddleware)
 	r.HandleFunc("/", handler.HandleRoot)
-	r.HandleFunc("/maintenance/ping", handler.HandlePing).Methods(http.MethodGet)
+	r.HandleFunc("/maintenance/live", handler.HandleLive).Methods(http.MethodGet)
+	r.HandleFunc("/maintenance/ready", handler.HandleReady).Methods(http.MethodGet)
+	r.Handle("/metrics", m.Handler()).Methods(http.MethodGet)
 	r.HandleFunc("/api/v1/posts", handler.HandlePublication).Methods(http.MethodPost)
+	r.HandleFunc("/api/v1/posts", handler.HandleGetPublicationsByIds).Methods(http.MethodGet)
 	r.HandleFunc("/api/v1/posts/{postId:\\w+}", handler.HandleGetPublication).Methods(http.MethodGet)
 	r.HandleFunc("/api/v1/posts/{postId:\\w+}", handler.HandleUpdatePublication).Methods(http.MethodPatch)
 	r.HandleFunc("/api/v1/users/{userId:\\w+}/posts", handler.HandleGetPublicationsByUser).Methods(http.MethodGet)
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"twitter/generator"
+	"twitter/health"
+	"twitter/logging"
+	"twitter/metrics"
+	"twitter/storage"
+	"twitter/storage/instrumentedstorage"
+	"twitter/tracing"
+)
+
+type stubStorage struct {
+	post storage.PostData
+	err  error
+}
+
+func (s *stubStorage) Save(ctx context.Context, data storage.PostData) error {
+	return s.err
+}
+
+func (s *stubStorage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	return s.post, s.err
+}
+
+func (s *stubStorage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	return []storage.PostData{s.post}, s.err
+}
+
+func (s *stubStorage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	return storage.PostsByUser{}, s.err
+}
+
+func (s *stubStorage) Update(ctx context.Context, data storage.PostData) error {
+	return s.err
+}
+
+func newTestRouter(s storage.Storage) *mux.Router {
+	m := metrics.New()
+	return CreateRouterFromStorage(
+		instrumentedstorage.NewStorage("stub", s, m),
+		generator.NewObjectIdGenerator(),
+		health.NewChecker(time.Second),
+		m,
+		logging.New(ioutil.Discard, logging.LevelInfo),
+	)
+}
+
+func TestRouterPropagatesTraceparent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := tracing.NewTracerProvider(nil, sdktrace.WithSyncer(exporter))
+	defer provider.Shutdown(context.Background())
+
+	post := storage.PostData{Id: idGenerator.NewPostID(), Text: "text", AuthorId: "user"}
+	router := newTestRouter(&stubStorage{post: post})
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v1/posts/"+post.Id.Hex(), nil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 2)
+	storageSpan, serverSpan := spans[0], spans[1]
+
+	require.Equal(t, "/api/v1/posts/{postId:\\w+}", serverSpan.Name)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", serverSpan.Parent.SpanID().String())
+
+	require.Equal(t, "stub.GetPostById", storageSpan.Name)
+	require.Equal(t, serverSpan.SpanContext.TraceID(), storageSpan.SpanContext.TraceID())
+	require.Equal(t, serverSpan.SpanContext.SpanID(), storageSpan.Parent.SpanID())
+}
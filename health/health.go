@@ -0,0 +1,118 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusOk           Status = "ok"
+	StatusDegraded     Status = "degraded"
+	StatusUnavailable  Status = "unavailable"
+	StatusShuttingDown Status = "shutting_down"
+)
+
+// Dependency is an external system the service talks to. A failing critical
+// dependency makes the service unavailable, a failing non-critical one only
+// degrades it.
+type Dependency struct {
+	Name     string
+	Critical bool
+	Ping     func(ctx context.Context) error
+}
+
+type DependencyReport struct {
+	Status    Status  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status       Status                      `json:"status"`
+	Dependencies map[string]DependencyReport `json:"dependencies"`
+}
+
+// Ready reports whether the service should receive traffic.
+func (r Report) Ready() bool {
+	return r.Status == StatusOk || r.Status == StatusDegraded
+}
+
+type Checker struct {
+	dependencies []Dependency
+	timeout      time.Duration
+	shuttingDown int32
+}
+
+func NewChecker(timeout time.Duration, dependencies ...Dependency) *Checker {
+	return &Checker{
+		dependencies: dependencies,
+		timeout:      timeout,
+	}
+}
+
+// SetShuttingDown makes every following readiness check fail, so that load
+// balancers stop routing new requests while in-flight ones are drained.
+func (c *Checker) SetShuttingDown() {
+	atomic.StoreInt32(&c.shuttingDown, 1)
+}
+
+func (c *Checker) IsShuttingDown() bool {
+	return atomic.LoadInt32(&c.shuttingDown) == 1
+}
+
+func (c *Checker) Check(ctx context.Context) Report {
+	reports := make([]DependencyReport, len(c.dependencies))
+	var wg sync.WaitGroup
+	for i, dependency := range c.dependencies {
+		wg.Add(1)
+		go func(i int, dependency Dependency) {
+			defer wg.Done()
+			reports[i] = c.checkDependency(ctx, dependency)
+		}(i, dependency)
+	}
+	wg.Wait()
+
+	result := Report{
+		Status:       StatusOk,
+		Dependencies: make(map[string]DependencyReport, len(c.dependencies)),
+	}
+	for i, dependency := range c.dependencies {
+		report := reports[i]
+		result.Dependencies[dependency.Name] = report
+		if report.Status == StatusOk {
+			continue
+		}
+		if dependency.Critical {
+			result.Status = StatusUnavailable
+		} else if result.Status == StatusOk {
+			result.Status = StatusDegraded
+		}
+	}
+	if c.IsShuttingDown() {
+		result.Status = StatusShuttingDown
+	}
+	return result
+}
+
+func (c *Checker) checkDependency(ctx context.Context, dependency Dependency) DependencyReport {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := dependency.Ping(ctx)
+	report := DependencyReport{
+		Status:    StatusOk,
+		Critical:  dependency.Critical,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		report.Status = StatusUnavailable
+		report.Error = err.Error()
+	}
+	return report
+}
@@ -0,0 +1,73 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func okPing(ctx context.Context) error {
+	return nil
+}
+
+func failingPing(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func hangingPing(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCheckAllDependenciesUp(t *testing.T) {
+	checker := NewChecker(time.Second,
+		Dependency{Name: "mongo", Critical: true, Ping: okPing},
+		Dependency{Name: "redis", Ping: okPing},
+	)
+
+	report := checker.Check(context.Background())
+
+	require.Equal(t, StatusOk, report.Status)
+	require.True(t, report.Ready())
+	require.Equal(t, StatusOk, report.Dependencies["mongo"].Status)
+	require.Equal(t, StatusOk, report.Dependencies["redis"].Status)
+}
+
+func TestCheckCacheDownIsDegraded(t *testing.T) {
+	checker := NewChecker(time.Second,
+		Dependency{Name: "mongo", Critical: true, Ping: okPing},
+		Dependency{Name: "redis", Ping: failingPing},
+	)
+
+	report := checker.Check(context.Background())
+
+	require.Equal(t, StatusDegraded, report.Status)
+	require.True(t, report.Ready())
+	require.Equal(t, StatusUnavailable, report.Dependencies["redis"].Status)
+	require.Equal(t, "connection refused", report.Dependencies["redis"].Error)
+}
+
+func TestCheckDatabaseDownIsUnavailable(t *testing.T) {
+	checker := NewChecker(50*time.Millisecond,
+		Dependency{Name: "mongo", Critical: true, Ping: hangingPing},
+		Dependency{Name: "redis", Ping: okPing},
+	)
+
+	report := checker.Check(context.Background())
+
+	require.Equal(t, StatusUnavailable, report.Status)
+	require.False(t, report.Ready())
+	require.Equal(t, context.DeadlineExceeded.Error(), report.Dependencies["mongo"].Error)
+}
+
+func TestCheckShuttingDown(t *testing.T) {
+	checker := NewChecker(time.Second, Dependency{Name: "mongo", Critical: true, Ping: okPing})
+	checker.SetShuttingDown()
+
+	report := checker.Check(context.Background())
+
+	require.Equal(t, StatusShuttingDown, report.Status)
+	require.False(t, report.Ready())
+}
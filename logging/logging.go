@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger writes one JSON object per record. Fields are passed as alternating
+// keys and values, the same way for With and for the record methods.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  Level
+	fields map[string]interface{}
+}
+
+func New(out io.Writer, level Level) *Logger {
+	return &Logger{
+		out:    out,
+		mu:     &sync.Mutex{},
+		level:  level,
+		fields: map[string]interface{}{},
+	}
+}
+
+// defaultLogger holds a *Logger. It is read by every request without a logger
+// in its context, so replacing it must not race with them.
+var defaultLogger atomic.Value
+
+func init() {
+	defaultLogger.Store(New(os.Stderr, LevelInfo))
+}
+
+func Default() *Logger {
+	return defaultLogger.Load().(*Logger)
+}
+
+// SetDefault replaces the logger returned by FromContext for contexts without
+// a logger. It is meant to be called once during startup.
+func SetDefault(l *Logger) {
+	defaultLogger.Store(l)
+}
+
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+len(keysAndValues)/2)
+	for key, value := range l.fields {
+		fields[key] = value
+	}
+	addFields(fields, keysAndValues)
+	return &Logger{
+		out:    l.out,
+		mu:     l.mu,
+		level:  l.level,
+		fields: fields,
+	}
+}
+
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *Logger) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < l.level {
+		return
+	}
+	record := make(map[string]interface{}, len(l.fields)+len(keysAndValues)/2+3)
+	for key, value := range l.fields {
+		record[key] = value
+	}
+	addFields(record, keysAndValues)
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["msg"] = msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{
+			"time":  record["time"].(string),
+			"level": LevelError.String(),
+			"msg":   "failed to encode log record - " + err.Error(),
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(append(line, '\n'))
+}
+
+func addFields(fields map[string]interface{}, keysAndValues []interface{}) {
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		if i+1 == len(keysAndValues) {
+			fields[key] = nil
+			break
+		}
+		value := keysAndValues[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields[key] = value
+	}
+}
+
+type loggerKey struct{}
+
+func WithContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
+}
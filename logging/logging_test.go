@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLoggerWritesJsonWithFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf, LevelDebug).With("requestId", "abc")
+
+	logger.Error("failed", "error", errors.New("boom"), "attempt", 2)
+
+	records := decodeLines(t, buf)
+	require.Len(t, records, 1)
+	require.Equal(t, "error", records[0]["level"])
+	require.Equal(t, "failed", records[0]["msg"])
+	require.Equal(t, "abc", records[0]["requestId"])
+	require.Equal(t, "boom", records[0]["error"])
+	require.Equal(t, 2.0, records[0]["attempt"])
+	require.NotEmpty(t, records[0]["time"])
+}
+
+func TestLoggerFiltersByLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf, LevelWarn)
+
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+
+	records := decodeLines(t, buf)
+	require.Len(t, records, 1)
+	require.Equal(t, "warn", records[0]["msg"])
+}
+
+func TestWithDoesNotModifyParent(t *testing.T) {
+	buf := &bytes.Buffer{}
+	parent := New(buf, LevelInfo)
+	parent.With("child", true)
+
+	parent.Info("parent")
+
+	records := decodeLines(t, buf)
+	require.NotContains(t, records[0], "child")
+}
+
+func TestFromContext(t *testing.T) {
+	logger := New(&bytes.Buffer{}, LevelInfo)
+
+	require.Same(t, Default(), FromContext(context.Background()))
+	require.Same(t, logger, FromContext(WithContext(context.Background(), logger)))
+}
+
+func TestSetDefaultWhileLogging(t *testing.T) {
+	previous := Default()
+	t.Cleanup(func() { SetDefault(previous) })
+	logger := New(&bytes.Buffer{}, LevelInfo)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			FromContext(context.Background()).Debug("request")
+		}
+	}()
+	SetDefault(logger)
+	wg.Wait()
+
+	require.Same(t, logger, FromContext(context.Background()))
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	require.NoError(t, err)
+	require.Equal(t, LevelWarn, level)
+
+	_, err = ParseLevel("verbose")
+	require.Error(t, err)
+}
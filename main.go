@@ -1,36 +1,355 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	gomemcache "github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-redis/redis/extra/redisotel/v8"
 	"github.com/go-redis/redis/v8"
-	"log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"twitter/cache"
+	"twitter/cache/memcache"
+	"twitter/cache/memorycache"
+	"twitter/cache/rediscache"
+	"twitter/generator"
 	handler2 "twitter/handler"
+	"twitter/health"
+	"twitter/logging"
+	"twitter/metrics"
+	"twitter/storage"
+	"twitter/storage/instrumentedstorage"
 	"twitter/storage/mongostorage"
 	"twitter/storage/rediscachedstorage"
+	"twitter/tracing"
 )
 
-func NewServer() *http.Server {
+const (
+	readinessTimeout   = 2 * time.Second
+	shutdownDrainDelay = 5 * time.Second
+	shutdownTimeout    = 20 * time.Second
+	// writeBehindClaimIdle is how long an update received by a flusher may
+	// stay unacknowledged before other flushers take it over.
+	writeBehindClaimIdle = 30 * time.Second
+	// The database may still be starting along with the service.
+	startupMigrationAttempts = 5
+	startupMigrationDelay    = 2 * time.Second
+)
+
+type Server struct {
+	*http.Server
+	health         *health.Checker
+	tracerProvider *sdktrace.TracerProvider
+	stopBackground context.CancelFunc
+}
+
+func NewServer() *Server {
+
+	logLevel := logging.LevelInfo
+	if levelName := os.Getenv("LOG_LEVEL"); levelName != "" {
+		var err error
+		logLevel, err = logging.ParseLevel(levelName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	logger := logging.New(os.Stdout, logLevel)
+	logging.SetDefault(logger)
+
+	tracerProvider, err := tracing.Setup(context.Background(), os.Getenv("TRACING_EXPORTER"))
+	if err != nil {
+		panic(err)
+	}
+	m := metrics.New()
+	persistent := newPersistentStorage(logging.WithContext(context.Background(), logger), m)
+	cacheBackend, writeBehindQueue, cacheDependencies := newCacheBackend()
+	cacheConfig := rediscachedstorage.DefaultConfig()
+	cacheConfig.Local.MaxBytes = envInt64("LOCAL_CACHE_MAX_BYTES", 0)
+	if formatName := os.Getenv("CACHE_FORMAT"); formatName != "" {
+		cacheConfig.Codec.Format, err = rediscachedstorage.ParseFormat(formatName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	if compressionName := os.Getenv("CACHE_COMPRESSION"); compressionName != "" {
+		cacheConfig.Codec.Compression, err = rediscachedstorage.ParseCompression(compressionName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	cacheConfig.WarmUp.Authors = int(envInt64("CACHE_WARMUP_AUTHORS", 0))
+	redisCachedStorage := rediscachedstorage.NewStorage(persistent.storage, cacheBackend, m, cacheConfig)
+	writeBehind := false
+	switch writeMode := os.Getenv("CACHE_WRITE_MODE"); writeMode {
+	case "", "write_through":
+	case "write_behind":
+		if writeBehindQueue == nil {
+			panic(errors.New("write_behind cache write mode needs the redis cache backend"))
+		}
+		// flushing an older update would drop the cached newer one through
+		// the change stream, so reads would fall back to the older version
+		if envBool("MONGO_CHANGE_STREAM", false) {
+			panic(errors.New("write_behind cache write mode cannot be used with MONGO_CHANGE_STREAM"))
+		}
+		redisCachedStorage.EnableWriteBehind(writeBehindQueue)
+		writeBehind = true
+	default:
+		panic(fmt.Errorf("unknown cache write mode %q", writeMode))
+	}
+	cachedStorage := instrumentedstorage.NewStorage("redis_cached", redisCachedStorage, m)
+	dependencies := append(persistent.dependencies, cacheDependencies...)
+	checker := health.NewChecker(readinessTimeout, dependencies...)
+	router := handler2.CreateRouterFromStorage(cachedStorage, newIdGenerator(), checker, m, logger)
+
+	backgroundCtx, stopBackground := context.WithCancel(logging.WithContext(context.Background(), logger))
+	go redisCachedStorage.ListenForInvalidations(backgroundCtx)
+	go redisCachedStorage.WarmUp(backgroundCtx)
+	if writeBehind {
+		go redisCachedStorage.RunWriteBehind(backgroundCtx, consumerName())
+	}
+	persistent.run(backgroundCtx, redisCachedStorage)
+
+	return &Server{
+		Server: &http.Server{
+			Handler:      router,
+			Addr:         "0.0.0.0:8080",
+			WriteTimeout: 15 * time.Second,
+			ReadTimeout:  15 * time.Second,
+		},
+		health:         checker,
+		tracerProvider: tracerProvider,
+		stopBackground: stopBackground,
+	}
+}
+
+func mongoOptions() mongostorage.Options {
+	options := mongostorage.DefaultOptions(os.Getenv("MONGO_URL"))
+	options.ConnectTimeout = envDuration("MONGO_CONNECT_TIMEOUT", options.ConnectTimeout)
+	options.ServerSelectionTimeout = envDuration("MONGO_SERVER_SELECTION_TIMEOUT", options.ServerSelectionTimeout)
+	options.MaxPoolSize = uint64(envInt64("MONGO_MAX_POOL_SIZE", 0))
+	options.MinPoolSize = uint64(envInt64("MONGO_MIN_POOL_SIZE", 0))
+	if name := os.Getenv("MONGO_TIMELINE_READ_PREFERENCE"); name != "" {
+		var err error
+		options.TimelineReadPreference, err = mongostorage.ParseReadPreference(name)
+		if err != nil {
+			panic(fmt.Errorf("invalid value of MONGO_TIMELINE_READ_PREFERENCE - %w", err))
+		}
+	}
+	if name := os.Getenv("MONGO_SAVE_WRITE_CONCERN"); name != "" {
+		var err error
+		options.SaveWriteConcern, err = mongostorage.ParseWriteConcern(name)
+		if err != nil {
+			panic(fmt.Errorf("invalid value of MONGO_SAVE_WRITE_CONCERN - %w", err))
+		}
+	}
+	options.Outbox = envBool("MONGO_OUTBOX", false)
+	return options
+}
+
+// migrateOnStart applies pending migrations with up, retrying while the
+// database is not reachable yet.
+func migrateOnStart(ctx context.Context, up func(ctx context.Context) error) error {
+	var err error
+	for attempt := 1; attempt <= startupMigrationAttempts; attempt++ {
+		err = up(ctx)
+		if err == nil {
+			return nil
+		}
+		logging.FromContext(ctx).Warn("failed to migrate database", "attempt", attempt, "error", err)
+		if attempt < startupMigrationAttempts {
+			time.Sleep(startupMigrationDelay)
+		}
+	}
+	return err
+}
+
+// newCacheBackend creates the cache backend selected by CACHE_BACKEND along
+// with health checks of the servers it talks to. The write-behind queue is
+// nil for backends unable to keep it durably.
+func newCacheBackend() (cache.Backend, cache.Queue, []health.Dependency) {
+	switch backendName := os.Getenv("CACHE_BACKEND"); backendName {
+	case "", "redis":
+		redisClient := newRedisClient()
+		queue := rediscache.NewQueue(redisClient, "pd:writebehind", "flushers", writeBehindClaimIdle)
+		return rediscache.NewBackend(redisClient), queue, []health.Dependency{
+			{Name: "redis", Critical: false, Ping: func(ctx context.Context) error {
+				return redisClient.Ping(ctx).Err()
+			}},
+		}
+	case "memcached":
+		memcacheClient := gomemcache.New(strings.Split(os.Getenv("MEMCACHED_URL"), ",")...)
+		memcacheClient.Timeout = 500 * time.Millisecond
+		return memcache.NewBackend(memcacheClient), nil, []health.Dependency{
+			{Name: "memcached", Critical: false, Ping: func(ctx context.Context) error {
+				return memcacheClient.Ping()
+			}},
+		}
+	case "memory":
+		return memorycache.NewBackend(), nil, nil
+	default:
+		panic(fmt.Errorf("unknown cache backend %q", backendName))
+	}
+}
+
+// newIdGenerator creates the generator of post ids selected by ID_GENERATOR.
+func newIdGenerator() storage.IdGenerator {
+	switch generatorName := os.Getenv("ID_GENERATOR"); generatorName {
+	case "", "ulid":
+		return generator.NewUlidGenerator()
+	case "snowflake":
+		rawNode := os.Getenv("ID_NODE")
+		if rawNode == "" {
+			panic(errors.New("snowflake id generator needs ID_NODE"))
+		}
+		node, err := strconv.ParseUint(rawNode, 10, 16)
+		if err != nil {
+			panic(fmt.Errorf("invalid value of ID_NODE - %w", err))
+		}
+		return generator.NewSnowflakeGenerator(uint16(node))
+	case "ksuid":
+		return generator.NewKsuidGenerator()
+	case "objectid":
+		return generator.NewObjectIdGenerator()
+	default:
+		panic(fmt.Errorf("unknown id generator %q", generatorName))
+	}
+}
+
+// consumerName identifies the instance among write-behind flushers.
+func consumerName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return hostname + "-" + strconv.Itoa(os.Getpid())
+}
 
-	mongoUrl := os.Getenv("MONGO_URL")
-	mongoStorage := mongostorage.DatabaseStorage(mongoUrl)
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: os.Getenv("REDIS_URL"),
+// newRedisClient creates a client of the redis deployment given by REDIS_*
+// variables.
+func newRedisClient() redis.UniversalClient {
+	redisMode := rediscache.ModeStandalone
+	if modeName := os.Getenv("REDIS_MODE"); modeName != "" {
+		var err error
+		redisMode, err = rediscache.ParseMode(modeName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	redisClient, err := rediscache.NewClient(rediscache.ClientOptions{
+		Mode:             redisMode,
+		Addrs:            strings.Split(os.Getenv("REDIS_URL"), ","),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		Username:         os.Getenv("REDIS_USERNAME"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		DB:               int(envInt64("REDIS_DB", 0)),
+		TLS:              envBool("REDIS_TLS", false),
+		PoolSize:         int(envInt64("REDIS_POOL_SIZE", 0)),
+		MinIdleConns:     int(envInt64("REDIS_MIN_IDLE_CONNS", 0)),
+		DialTimeout:      time.Second,
+		ReadTimeout:      500 * time.Millisecond,
+		WriteTimeout:     500 * time.Millisecond,
 	})
-	cachedStorage := rediscachedstorage.NewStorage(mongoStorage, redisClient)
-	router := handler2.CreateRouterFromStorage(cachedStorage)
+	if err != nil {
+		panic(err)
+	}
+	redisClient.AddHook(redisotel.NewTracingHook())
+	return redisClient
+}
+
+func envBool(name string, fallback bool) bool {
+	rawValue := os.Getenv(name)
+	if rawValue == "" {
+		return fallback
+	}
+	value, err := strconv.ParseBool(rawValue)
+	if err != nil {
+		panic(fmt.Errorf("invalid value of %s - %w", name, err))
+	}
+	return value
+}
+
+func envString(name string, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
 
-	return &http.Server{
-		Handler:      router,
-		Addr:         "0.0.0.0:8080",
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+func envDuration(name string, fallback time.Duration) time.Duration {
+	rawValue := os.Getenv(name)
+	if rawValue == "" {
+		return fallback
 	}
+	value, err := time.ParseDuration(rawValue)
+	if err != nil {
+		panic(fmt.Errorf("invalid value of %s - %w", name, err))
+	}
+	return value
+}
+
+func envInt64(name string, fallback int64) int64 {
+	rawValue := os.Getenv(name)
+	if rawValue == "" {
+		return fallback
+	}
+	value, err := strconv.ParseInt(rawValue, 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("invalid value of %s - %w", name, err))
+	}
+	return value
+}
+
+// Shutdown reports the server as not ready, gives load balancers time to
+// notice it and only then stops accepting connections and drains requests.
+// Spans of the drained requests are flushed at the end.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.health.SetShuttingDown()
+	select {
+	case <-time.After(shutdownDrainDelay):
+	case <-ctx.Done():
+	}
+	err := s.Server.Shutdown(ctx)
+	s.stopBackground()
+	if tracingErr := s.tracerProvider.Shutdown(ctx); err == nil {
+		err = tracingErr
+	}
+	return err
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
 	srv := NewServer()
-	log.Printf("Start serving on %s", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	logger := logging.Default()
+	go func() {
+		logger.Info("start serving", "addr", srv.Addr)
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed to shut down gracefully", "error", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "blog"
+
+type CacheResult string
+
+const (
+	CacheHit   CacheResult = "hit"
+	CacheMiss  CacheResult = "miss"
+	CacheStale CacheResult = "stale"
+	CacheError CacheResult = "error"
+	// CacheNegativeHit is a lookup answered by a cached absence of the value.
+	CacheNegativeHit CacheResult = "negative_hit"
+)
+
+type WriteBehindResult string
+
+const (
+	WriteBehindFlushed WriteBehindResult = "flushed"
+	WriteBehindRetried WriteBehindResult = "retried"
+	// WriteBehindSkipped is a write superseded by a later write of the same
+	// post before it was flushed.
+	WriteBehindSkipped      WriteBehindResult = "skipped"
+	WriteBehindDeadLettered WriteBehindResult = "dead_lettered"
+)
+
+// Metrics owns its own registry instead of using the global one, so tests can
+// create independent instances and read values without scraping over network.
+// Observe methods are safe to call on a nil *Metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests            *prometheus.CounterVec
+	httpDuration            *prometheus.HistogramVec
+	storageDuration         *prometheus.HistogramVec
+	storageErrors           *prometheus.CounterVec
+	cacheRequests           *prometheus.CounterVec
+	cacheCircuit            *prometheus.GaugeVec
+	cacheCircuitTransitions *prometheus.CounterVec
+	cacheWriteBehind        *prometheus.CounterVec
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of handled HTTP requests by route template, method and status.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of handled HTTP requests by route template, method and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of storage operations by backend and method.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"backend", "method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_errors_total",
+			Help:      "Number of failed storage operations by backend and method.",
+		}, []string{"backend", "method"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "requests_total",
+			Help:      "Number of cache lookups by key family and result (hit, miss, stale, negative_hit, error).",
+		}, []string{"family", "result"}),
+		cacheCircuit: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "circuit_breaker_state",
+			Help:      "Whether the cache circuit breaker is in the given state (closed, half_open, open).",
+		}, []string{"state"}),
+		cacheCircuitTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "circuit_breaker_transitions_total",
+			Help:      "Number of cache circuit breaker transitions by target state.",
+		}, []string{"state"}),
+		cacheWriteBehind: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "cache",
+			Name:      "write_behind_total",
+			Help:      "Number of processed write-behind entries by result (flushed, retried, skipped, dead_lettered).",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.storageDuration,
+		m.storageErrors,
+		m.cacheRequests,
+		m.cacheCircuit,
+		m.cacheCircuitTransitions,
+		m.cacheWriteBehind,
+	)
+	m.cacheCircuit.WithLabelValues("closed").Set(1)
+	return m
+}
+
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ObserveHttpRequest(route, method string, status int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	statusLabel := strconv.Itoa(status)
+	m.httpRequests.WithLabelValues(route, method, statusLabel).Inc()
+	m.httpDuration.WithLabelValues(route, method, statusLabel).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveStorageOperation(backend, method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.storageDuration.WithLabelValues(backend, method).Observe(duration.Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(backend, method).Inc()
+	}
+}
+
+func (m *Metrics) ObserveCacheLookup(family string, result CacheResult) {
+	if m == nil {
+		return
+	}
+	m.cacheRequests.WithLabelValues(family, string(result)).Inc()
+}
+
+func (m *Metrics) ObserveCacheCircuitTransition(from, to string) {
+	if m == nil {
+		return
+	}
+	m.cacheCircuit.WithLabelValues(from).Set(0)
+	m.cacheCircuit.WithLabelValues(to).Set(1)
+	m.cacheCircuitTransitions.WithLabelValues(to).Inc()
+}
+
+func (m *Metrics) ObserveCacheWriteBehind(result WriteBehindResult) {
+	if m == nil {
+		return
+	}
+	m.cacheWriteBehind.WithLabelValues(string(result)).Inc()
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestObserveStorageOperation(t *testing.T) {
+	m := New()
+
+	m.ObserveStorageOperation("mongo", "Save", time.Millisecond, nil)
+	m.ObserveStorageOperation("mongo", "Save", time.Millisecond, errors.New("boom"))
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.storageErrors.WithLabelValues("mongo", "Save")))
+	require.Equal(t, 1, testutil.CollectAndCount(m.storageDuration))
+}
+
+func TestObserveCacheLookup(t *testing.T) {
+	m := New()
+
+	m.ObserveCacheLookup("post", CacheHit)
+	m.ObserveCacheLookup("post", CacheHit)
+	m.ObserveCacheLookup("post", CacheMiss)
+
+	require.Equal(t, 2.0, testutil.ToFloat64(m.cacheRequests.WithLabelValues("post", "hit")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.cacheRequests.WithLabelValues("post", "miss")))
+}
+
+func TestNilMetricsIsNoop(t *testing.T) {
+	var m *Metrics
+
+	require.NotPanics(t, func() {
+		m.ObserveHttpRequest("/", http.MethodGet, http.StatusOK, time.Millisecond)
+		m.ObserveStorageOperation("mongo", "Save", time.Millisecond, nil)
+		m.ObserveCacheLookup("post", CacheMiss)
+	})
+}
+
+func TestHandlerExposesTextFormat(t *testing.T) {
+	m := New()
+	m.ObserveHttpRequest("/api/v1/posts/{postId:\\w+}", http.MethodGet, http.StatusNotFound, time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, err := ioutil.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, recorder.Code)
+	require.Contains(t, string(body), `blog_http_requests_total{method="GET",route="/api/v1/posts/{postId:\\w+}",status="404"} 1`)
+	require.Contains(t, string(body), "blog_http_request_duration_seconds_bucket")
+}
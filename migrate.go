@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"twitter/logging"
+	"twitter/storage/migration"
+	"twitter/storage/mongostorage"
+	"twitter/storage/postgresstorage"
+)
+
+const migrateUsage = `usage: app migrate [flags] [up|down|status]
+
+  up      apply pending migrations (default)
+  down    revert applied migrations above -to, the last one by default
+  status  list migrations and whether they are applied
+
+flags:
+`
+
+// schemaMigrator runs migrations of the storage selected by STORAGE.
+type schemaMigrator interface {
+	Up(ctx context.Context, target int, dryRun bool) ([]migration.Header, error)
+	Down(ctx context.Context, target int, dryRun bool) ([]migration.Header, error)
+	Status(ctx context.Context) ([]migration.Status, error)
+}
+
+// runMigrate runs the migrate subcommand and returns the exit code.
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+	dryRun := flags.Bool("dry-run", false, "only print the migrations which would run")
+	to := flags.Int("to", -1, "target version, the latest for up and the previous for down by default")
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+	command := "up"
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return 2
+	} else if flags.NArg() == 1 {
+		command = flags.Arg(0)
+	}
+	if command != "up" && command != "down" && command != "status" {
+		flags.Usage()
+		return 2
+	}
+
+	logger := logging.New(os.Stderr, logging.LevelInfo)
+	ctx, stop := signal.NotifyContext(logging.WithContext(context.Background(), logger), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	migrator, closeStorage, err := newSchemaMigrator(ctx)
+	if err != nil {
+		logger.Error("failed to connect to database", "error", err)
+		return 1
+	}
+	defer closeStorage()
+
+	var migrations []migration.Header
+	switch command {
+	case "up":
+		target := *to
+		if target < 0 {
+			target = 0
+		}
+		migrations, err = migrator.Up(ctx, target, *dryRun)
+	case "down":
+		target := *to
+		if target < 0 {
+			target, err = previousVersion(ctx, migrator)
+			if err != nil {
+				break
+			}
+		}
+		migrations, err = migrator.Down(ctx, target, *dryRun)
+	case "status":
+		err = printMigrationStatus(ctx, os.Stdout, migrator)
+	}
+	if *dryRun {
+		for _, migration := range migrations {
+			fmt.Printf("would %s %d: %s\n", command, migration.Version, migration.Description)
+		}
+	}
+	if err != nil {
+		logger.Error("migration failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// previousVersion returns the version of the applied migration preceding the
+// last applied one, zero if there is none.
+func previousVersion(ctx context.Context, migrator schemaMigrator) (int, error) {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var applied []int
+	for _, status := range statuses {
+		if status.Applied {
+			applied = append(applied, status.Version)
+		}
+	}
+	if len(applied) < 2 {
+		return 0, nil
+	}
+	return applied[len(applied)-2], nil
+}
+
+func printMigrationStatus(ctx context.Context, out io.Writer, migrator schemaMigrator) error {
+	statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED AT\tDESCRIPTION")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.Applied {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, appliedAt, status.Description)
+	}
+	return w.Flush()
+}
+
+// newSchemaMigrator connects to the storage, the returned function closes the
+// connection.
+func newSchemaMigrator(ctx context.Context) (schemaMigrator, func(), error) {
+	switch kind := envString("STORAGE", "mongo"); kind {
+	case "mongo":
+		mongoStorage, err := mongostorage.DatabaseStorage(ctx, mongoOptions())
+		if err != nil {
+			return nil, nil, err
+		}
+		return mongoStorage.Migrator(), func() { _ = mongoStorage.Close(context.Background()) }, nil
+	case "postgres":
+		postgresStorage, err := postgresstorage.OpenStorage(postgresOptions())
+		if err != nil {
+			return nil, nil, err
+		}
+		return postgresStorage.Migrator(), func() { _ = postgresStorage.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("storage %q has no migrations", kind)
+	}
+}
+
+var (
+	_ schemaMigrator = (*mongostorage.Migrator)(nil)
+	_ schemaMigrator = (*postgresstorage.Migrator)(nil)
+)
@@ -0,0 +1,257 @@
+// Package boltstorage stores posts in an embedded bbolt database file, for
+// deployments too small to run MongoDB.
+package boltstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"time"
+	"twitter/storage"
+)
+
+var (
+	postsBucket = []byte("posts")
+	// timelinesBucket holds a bucket per author whose keys are inverted ids
+	// of their posts, so iterating it forward walks posts newest first, as
+	// the (authorId, _id desc) index of mongostorage does.
+	timelinesBucket = []byte("timelines")
+)
+
+// openTimeout bounds waiting for the lock on the file held by another
+// process.
+const openTimeout = time.Second
+
+type Storage struct {
+	db *bbolt.DB
+}
+
+type transactionKey struct{}
+
+func OpenStorage(path string) (*Storage, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: openTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %v: %v - %w", path, err, storage.CommonStorageError)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{postsBucket, timelinesBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %v - %w", err, storage.CommonStorageError)
+	}
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// WithinTransaction runs fn in a read-write transaction. bbolt has a single
+// writer at a time, so transactions never conflict and are not retried.
+func (s *Storage) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(transactionKey{}).(*bbolt.Tx); ok {
+		return fn(ctx)
+	}
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(context.WithValue(ctx, transactionKey{}, tx))
+	})
+}
+
+func (s *Storage) view(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := ctx.Value(transactionKey{}).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+	return s.db.View(fn)
+}
+
+func (s *Storage) update(ctx context.Context, fn func(tx *bbolt.Tx) error) error {
+	if tx, ok := ctx.Value(transactionKey{}).(*bbolt.Tx); ok {
+		return fn(tx)
+	}
+	return s.db.Update(fn)
+}
+
+func (s *Storage) Save(ctx context.Context, data storage.PostData) error {
+	rawPost, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode post - %w", storage.CommonStorageError)
+	}
+	return s.update(ctx, func(tx *bbolt.Tx) error {
+		posts := tx.Bucket(postsBucket)
+		if posts.Get(data.Id[:]) != nil {
+			return fmt.Errorf("post %v already exists - %w", data.Id.Hex(), storage.ErrorCollision)
+		}
+		err := posts.Put(data.Id[:], rawPost)
+		if err != nil {
+			return fmt.Errorf("failed to insert post: %v - %w", err, storage.CommonStorageError)
+		}
+		timeline, err := tx.Bucket(timelinesBucket).CreateBucketIfNotExists([]byte(data.AuthorId))
+		if err == nil {
+			err = timeline.Put(timelineKey(data.Id), nil)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to index post: %v - %w", err, storage.CommonStorageError)
+		}
+		return nil
+	})
+}
+
+func (s *Storage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	postId, err := storage.ParsePostID(id)
+	if err != nil {
+		return storage.PostData{}, err
+	}
+	var result storage.PostData
+	err = s.view(ctx, func(tx *bbolt.Tx) error {
+		post, ok, err := getPost(tx, postId)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("no posts with id %v - %w", id, storage.ErrorNotFound)
+		}
+		result = post
+		return nil
+	})
+	return result, err
+}
+
+func (s *Storage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	posts := make([]storage.PostData, 0, len(ids))
+	err := s.view(ctx, func(tx *bbolt.Tx) error {
+		seen := map[storage.PostID]bool{}
+		for _, id := range ids {
+			postId, err := storage.ParsePostID(id)
+			if err != nil || seen[postId] {
+				continue
+			}
+			seen[postId] = true
+			post, ok, err := getPost(tx, postId)
+			if err != nil {
+				return err
+			}
+			if ok {
+				posts = append(posts, post)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// GetPostsByUserId returns posts of the user newest first. The next page id
+// is the id of the last returned post, the following page starts after it.
+func (s *Storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	var after []byte
+	if pageId != "" {
+		lastId, err := storage.ParsePostID(pageId)
+		if err != nil {
+			return storage.PostsByUser{}, fmt.Errorf("invalid page id %v - %w", pageId, storage.ErrorInvalidPage)
+		}
+		after = timelineKey(lastId)
+	}
+	var posts []storage.PostData
+	err := s.view(ctx, func(tx *bbolt.Tx) error {
+		timeline := tx.Bucket(timelinesBucket).Bucket([]byte(userId))
+		if timeline == nil {
+			return nil
+		}
+		cursor := timeline.Cursor()
+		key, _ := cursor.First()
+		if after != nil {
+			key, _ = cursor.Seek(after)
+			if bytes.Equal(key, after) {
+				key, _ = cursor.Next()
+			}
+		}
+		for ; key != nil && len(posts) < pageSize; key, _ = cursor.Next() {
+			post, ok, err := getPost(tx, keyPostId(key))
+			if err != nil {
+				return err
+			}
+			if ok {
+				posts = append(posts, post)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return storage.PostsByUser{}, err
+	}
+	if len(posts) == 0 {
+		return storage.PostsByUser{Posts: posts, NextPageId: storage.NilPostID}, nil
+	}
+	return storage.PostsByUser{Posts: posts, NextPageId: posts[len(posts)-1].Id}, nil
+}
+
+// Update changes the text and the modification time of the post, as
+// mongostorage does.
+func (s *Storage) Update(ctx context.Context, data storage.PostData) error {
+	return s.update(ctx, func(tx *bbolt.Tx) error {
+		post, ok, err := getPost(tx, data.Id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("no posts with id %v - %w", data.Id.Hex(), storage.ErrorNotFound)
+		}
+		post.Text = data.Text
+		post.LastModifiedAt = data.LastModifiedAt
+		rawPost, err := json.Marshal(post)
+		if err != nil {
+			return fmt.Errorf("failed to encode post - %w", storage.CommonStorageError)
+		}
+		err = tx.Bucket(postsBucket).Put(post.Id[:], rawPost)
+		if err != nil {
+			return fmt.Errorf("failed to update post: %v - %w", err, storage.CommonStorageError)
+		}
+		return nil
+	})
+}
+
+func getPost(tx *bbolt.Tx, id storage.PostID) (storage.PostData, bool, error) {
+	rawPost := tx.Bucket(postsBucket).Get(id[:])
+	if rawPost == nil {
+		return storage.PostData{}, false, nil
+	}
+	var post storage.PostData
+	err := json.Unmarshal(rawPost, &post)
+	if err != nil {
+		return storage.PostData{}, false, fmt.Errorf("failed to decode post %v - %w", id.Hex(), storage.CommonStorageError)
+	}
+	return post, true, nil
+}
+
+// timelineKey inverts the bytes of id, ordering greater ids first.
+func timelineKey(id storage.PostID) []byte {
+	key := make([]byte, len(id))
+	for i := range id {
+		key[i] = ^id[i]
+	}
+	return key
+}
+
+func keyPostId(key []byte) storage.PostID {
+	var id storage.PostID
+	for i := range id {
+		id[i] = ^key[i]
+	}
+	return id
+}
+
+var (
+	_ storage.Storage    = (*Storage)(nil)
+	_ storage.Transactor = (*Storage)(nil)
+)
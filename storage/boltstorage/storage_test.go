@@ -0,0 +1,46 @@
+package boltstorage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"twitter/generator"
+	"twitter/storage"
+	"twitter/storage/storagetest"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+func openTestStorage(t *testing.T, path string) *Storage {
+	s, err := OpenStorage(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) storage.Storage {
+		return openTestStorage(t, filepath.Join(t.TempDir(), "posts.db"))
+	})
+}
+
+func TestPostsSurviveReopening(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "posts.db")
+	s := openTestStorage(t, path)
+	post := storage.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}
+	require.NoError(t, s.Save(ctx, post))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, path)
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{post}, page.Posts)
+}
+
+func TestTimelineKeysOrderNewestFirst(t *testing.T) {
+	older, newer := idGenerator.NewPostID(), idGenerator.NewPostID()
+	require.Less(t, string(timelineKey(newer)), string(timelineKey(older)))
+	require.Equal(t, older, keyPostId(timelineKey(older)))
+}
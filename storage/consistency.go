@@ -0,0 +1,18 @@
+package storage
+
+import "context"
+
+type primaryReadsKey struct{}
+
+// WithPrimaryReads asks storages reading from replicas to read from the
+// primary instead, so the reads see the latest writes.
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// PrimaryReadsRequired reports whether reads with ctx must see the latest
+// writes.
+func PrimaryReadsRequired(ctx context.Context) bool {
+	required, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return required
+}
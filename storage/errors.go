@@ -0,0 +1,25 @@
+package storage
+
+// DatabaseError is a failed database operation. It is a CommonStorageError
+// and unwraps to the driver error, so drivers still recognize their errors,
+// e.g. transient ones on which they retry transactions.
+type DatabaseError struct {
+	Msg   string
+	Cause error
+}
+
+func NewDatabaseError(msg string, cause error) error {
+	return &DatabaseError{Msg: msg, Cause: cause}
+}
+
+func (e *DatabaseError) Error() string {
+	return e.Msg + " - " + CommonStorageError.Error() + ": " + e.Cause.Error()
+}
+
+func (e *DatabaseError) Unwrap() error {
+	return e.Cause
+}
+
+func (e *DatabaseError) Is(target error) bool {
+	return target == CommonStorageError
+}
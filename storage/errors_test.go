@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDatabaseErrorIsStorageErrorAndUnwrapsToCause(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := NewDatabaseError("failed to find post", cause)
+
+	require.ErrorIs(t, err, CommonStorageError)
+	require.ErrorIs(t, err, cause)
+	require.NotErrorIs(t, err, ErrorNotFound)
+	require.Equal(t, "failed to find post - storage: connection reset", err.Error())
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventPostCreated EventType = "PostCreated"
+	EventPostUpdated EventType = "PostUpdated"
+)
+
+// Event is a change of a post published to downstream systems.
+type Event struct {
+	// Id is unique, consumers use it to drop events delivered twice.
+	Id         string    `json:"id"`
+	Type       EventType `json:"type"`
+	Post       PostData  `json:"post"`
+	OccurredAt time.Time `json:"occurredAt"`
+}
+
+type EventPublisher interface {
+	// Publish publishes events in the given order. Events may be published
+	// again after a failure.
+	Publish(ctx context.Context, events []Event) error
+}
+
+// PostChange is a change of a stored post made by any writer.
+type PostChange struct {
+	PostId string
+	// AuthorId is empty when it is unknown, as for deleted posts.
+	AuthorId string
+	Deleted  bool
+}
+
+type ChangeHandler interface {
+	// HandlePostChanges is called with changes in the order they were made.
+	// Failed changes are handled again.
+	HandlePostChanges(ctx context.Context, changes []PostChange) error
+}
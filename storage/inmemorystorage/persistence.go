@@ -0,0 +1,532 @@
+package inmemorystorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"twitter/logging"
+	"twitter/storage"
+)
+
+// FsyncPolicy is when appended records are flushed to the disk. Records not
+// flushed yet are lost if the machine, not only the process, crashes.
+type FsyncPolicy string
+
+const (
+	FsyncAlways      FsyncPolicy = "always"
+	FsyncEverySecond FsyncPolicy = "everysec"
+	FsyncNever       FsyncPolicy = "no"
+)
+
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch policy := FsyncPolicy(strings.ToLower(name)); policy {
+	case FsyncAlways, FsyncEverySecond, FsyncNever:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %q", name)
+	}
+}
+
+type PersistenceOptions struct {
+	Dir   string
+	Fsync FsyncPolicy
+	// SnapshotInterval is how often the log is compacted into a snapshot,
+	// zero disables snapshots.
+	SnapshotInterval time.Duration
+}
+
+func DefaultPersistenceOptions(dir string) PersistenceOptions {
+	return PersistenceOptions{
+		Dir:              dir,
+		Fsync:            FsyncEverySecond,
+		SnapshotInterval: 5 * time.Minute,
+	}
+}
+
+const (
+	snapshotFileName = "posts.snapshot"
+	logFilePattern   = "posts.%d.log"
+	// recordHeaderSize is the length and the CRC-32 of the payload.
+	recordHeaderSize = 8
+)
+
+type recordOp string
+
+const (
+	opSave   recordOp = "save"
+	opUpdate recordOp = "update"
+	// opGeneration starts a snapshot, which replaces logs of older
+	// generations.
+	opGeneration recordOp = "generation"
+	// opBatch holds the records of a transaction, so a crash while it is
+	// appended loses the whole transaction instead of a part of it.
+	opBatch recordOp = "batch"
+)
+
+type record struct {
+	Op         recordOp         `json:"op"`
+	Post       storage.PostData `json:"post"`
+	Generation int64            `json:"generation,omitempty"`
+	Records    []record         `json:"records,omitempty"`
+}
+
+var errCorruptedRecord = errors.New("corrupted record")
+
+// persistence keeps the posts of a storage in an append-only log. A snapshot
+// of generation N holds every post written before the log of generation N
+// was started, so the state is the last snapshot followed by the logs of its
+// generation and later ones. Page ids are not persisted.
+type persistence struct {
+	options PersistenceOptions
+	// snapshotMu serializes snapshots, mu guards the fields below.
+	snapshotMu sync.Mutex
+	mu         sync.Mutex
+	log        *os.File
+	generation int64
+	// size is the length of the log up to the last complete record.
+	size int64
+	// records is the number of records logged since the last snapshot.
+	records int
+	dirty   bool
+}
+
+// OpenStorage creates a storage persisted in options.Dir, recovered from the
+// files left there. A log cut in the middle of its last record, as left by a
+// crash, is truncated to the last complete record.
+func OpenStorage(options PersistenceOptions) (*InmemoryDataSource, error) {
+	err := os.MkdirAll(options.Dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage directory - %w", err)
+	}
+	ids := NewStorage()
+	p := &persistence{options: options}
+	_ = os.Remove(p.snapshotPath() + ".tmp")
+
+	p.generation, err = p.loadSnapshot(ids)
+	if err != nil {
+		return nil, err
+	}
+	generations, err := p.logGenerations()
+	if err != nil {
+		return nil, err
+	}
+	for i, generation := range generations {
+		if generation < p.generation {
+			_ = os.Remove(p.logPath(generation))
+			continue
+		}
+		last := i == len(generations)-1
+		size, err := p.replay(ids, generation, last)
+		if err != nil {
+			return nil, err
+		}
+		p.generation, p.size = generation, size
+	}
+
+	p.log, err = os.OpenFile(p.logPath(p.generation), os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage log - %w", err)
+	}
+	// drops the cut record, if any
+	err = p.log.Truncate(p.size)
+	if err == nil {
+		_, err = p.log.Seek(p.size, 0)
+	}
+	if err != nil {
+		_ = p.log.Close()
+		return nil, fmt.Errorf("failed to recover storage log - %w", err)
+	}
+	ids.persistence = p
+	return ids, nil
+}
+
+// persist logs rec before the change it describes is applied. Within a
+// transaction it is logged on commit.
+func (ids *InmemoryDataSource) persist(ctx context.Context, rec record) error {
+	if tx := ids.transaction(ctx); tx != nil {
+		tx.records = append(tx.records, rec)
+		return nil
+	}
+	if ids.persistence == nil {
+		return nil
+	}
+	return ids.persistence.write(rec)
+}
+
+// write appends rec, a failed write is cut off the log so later records are
+// not appended after a partial one.
+func (p *persistence) write(rec record) error {
+	var buf bytes.Buffer
+	err := encodeRecord(&buf, rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode record - %w", storage.CommonStorageError)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.log == nil {
+		return fmt.Errorf("storage is closed - %w", storage.CommonStorageError)
+	}
+	_, err = p.log.Write(buf.Bytes())
+	if err == nil && p.options.Fsync == FsyncAlways {
+		err = p.log.Sync()
+	}
+	if err != nil {
+		_ = p.log.Truncate(p.size)
+		_, _ = p.log.Seek(p.size, 0)
+		return fmt.Errorf("failed to write storage log: %v - %w", err, storage.CommonStorageError)
+	}
+	p.size += int64(buf.Len())
+	p.records++
+	p.dirty = true
+	return nil
+}
+
+func (p *persistence) sync() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.log == nil || !p.dirty {
+		return nil
+	}
+	p.dirty = false
+	return p.log.Sync()
+}
+
+func (p *persistence) pendingRecords() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.records
+}
+
+// rotate closes the log and starts the one of the next generation.
+func (p *persistence) rotate() (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.log == nil {
+		return 0, fmt.Errorf("storage is closed - %w", storage.CommonStorageError)
+	}
+	next, err := os.OpenFile(p.logPath(p.generation+1), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	err = p.log.Sync()
+	if err == nil {
+		err = p.log.Close()
+	}
+	if err != nil {
+		_ = next.Close()
+		return 0, err
+	}
+	p.log = next
+	p.generation++
+	p.size, p.records, p.dirty = 0, 0, false
+	return p.generation, nil
+}
+
+// Snapshot writes every post to a snapshot and drops the logs it replaces.
+// Writes are only blocked while the posts are copied.
+func (ids *InmemoryDataSource) Snapshot(ctx context.Context) error {
+	p := ids.persistence
+	if p == nil {
+		return nil
+	}
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	unlock := ids.lock(ctx)
+	posts := make([]storage.PostData, 0, len(ids.IdToPost))
+	for _, userPosts := range ids.UserIdToPosts {
+		posts = append(posts, userPosts...)
+	}
+	generation, err := p.rotate()
+	unlock()
+	if err != nil {
+		return fmt.Errorf("failed to start storage log: %v - %w", err, storage.CommonStorageError)
+	}
+
+	err = p.writeSnapshot(generation, posts)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v - %w", err, storage.CommonStorageError)
+	}
+	generations, err := p.logGenerations()
+	if err != nil {
+		return err
+	}
+	for _, old := range generations {
+		if old < generation {
+			_ = os.Remove(p.logPath(old))
+		}
+	}
+	return nil
+}
+
+// writeSnapshot replaces the snapshot atomically, a crash leaves either the
+// previous one or the new one.
+func (p *persistence) writeSnapshot(generation int64, posts []storage.PostData) error {
+	var buf bytes.Buffer
+	err := encodeRecord(&buf, record{Op: opGeneration, Generation: generation})
+	for i := 0; err == nil && i < len(posts); i++ {
+		err = encodeRecord(&buf, record{Op: opSave, Post: posts[i]})
+	}
+	if err != nil {
+		return err
+	}
+	tmpPath := p.snapshotPath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, p.snapshotPath())
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(p.options.Dir)
+}
+
+// RunPersistence flushes the log according to the fsync policy and takes
+// snapshots until ctx is done, then closes the log.
+func (ids *InmemoryDataSource) RunPersistence(ctx context.Context) {
+	p := ids.persistence
+	if p == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastSnapshot := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			err := ids.Close()
+			if err != nil {
+				logger.Error("failed to close storage log", "error", err)
+			}
+			return
+		case <-ticker.C:
+		}
+		if p.options.Fsync == FsyncEverySecond {
+			err := p.sync()
+			if err != nil {
+				logger.Warn("failed to sync storage log", "error", err)
+			}
+		}
+		if p.options.SnapshotInterval > 0 && time.Since(lastSnapshot) >= p.options.SnapshotInterval && p.pendingRecords() > 0 {
+			err := ids.Snapshot(ctx)
+			if err != nil {
+				logger.Warn("failed to snapshot storage", "error", err)
+				continue
+			}
+			lastSnapshot = time.Now()
+		}
+	}
+}
+
+// Close flushes and closes the log, later writes fail.
+func (ids *InmemoryDataSource) Close() error {
+	p := ids.persistence
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.log == nil {
+		return nil
+	}
+	err := p.log.Sync()
+	if closeErr := p.log.Close(); err == nil {
+		err = closeErr
+	}
+	p.log = nil
+	return err
+}
+
+func (p *persistence) loadSnapshot(ids *InmemoryDataSource) (int64, error) {
+	data, err := ioutil.ReadFile(p.snapshotPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read snapshot - %w", err)
+	}
+	var generation int64
+	_, err = decodeRecords(data, func(rec record) error {
+		if rec.Op == opGeneration {
+			generation = rec.Generation
+			return nil
+		}
+		return ids.apply(rec)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to load snapshot - %w", err)
+	}
+	return generation, nil
+}
+
+// replay applies the log of generation and returns the length of its
+// complete records. Only the last log may end with a cut record.
+func (p *persistence) replay(ids *InmemoryDataSource, generation int64, last bool) (int64, error) {
+	path := p.logPath(generation)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read storage log - %w", err)
+	}
+	size, err := decodeRecords(data, ids.apply)
+	if err == errCorruptedRecord && last {
+		logging.Default().Warn("dropping cut record at the end of storage log", "path", path, "offset", size, "length", len(data))
+		return size, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay %v at offset %v - %w", path, size, err)
+	}
+	return size, nil
+}
+
+func (ids *InmemoryDataSource) apply(rec record) error {
+	switch rec.Op {
+	case opBatch:
+		// checked first, so a batch is applied all or nothing
+		for _, batched := range rec.Records {
+			if batched.Op != opSave && batched.Op != opUpdate {
+				return fmt.Errorf("unknown record %q in batch", batched.Op)
+			}
+		}
+		for _, batched := range rec.Records {
+			_ = ids.apply(batched)
+		}
+	case opSave:
+		if _, ok := ids.IdToPost[rec.Post.Id.Hex()]; ok {
+			ids.replace(rec.Post)
+		} else {
+			ids.insert(rec.Post)
+		}
+	case opUpdate:
+		ids.replace(rec.Post)
+	default:
+		return fmt.Errorf("unknown record %q", rec.Op)
+	}
+	return nil
+}
+
+func (p *persistence) logGenerations() ([]int64, error) {
+	entries, err := ioutil.ReadDir(p.options.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage directory - %w", err)
+	}
+	var generations []int64
+	for _, entry := range entries {
+		var generation int64
+		_, err := fmt.Sscanf(entry.Name(), logFilePattern, &generation)
+		if err == nil && entry.Name() == filepath.Base(p.logPath(generation)) {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool { return generations[i] < generations[j] })
+	return generations, nil
+}
+
+func (p *persistence) snapshotPath() string {
+	return filepath.Join(p.options.Dir, snapshotFileName)
+}
+
+func (p *persistence) logPath(generation int64) string {
+	return filepath.Join(p.options.Dir, fmt.Sprintf(logFilePattern, generation))
+}
+
+func encodeRecord(buf *bytes.Buffer, rec record) error {
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	buf.Write(header[:])
+	buf.Write(payload)
+	return nil
+}
+
+// decodeRecords passes records in data to apply and returns the length of
+// the records read. A record is corrupted if it is cut, its checksum does not
+// match or it cannot be decoded, which only a record cut by a crash does when
+// it is the last one, or if the file ends with zeros instead of it.
+func decodeRecords(data []byte, apply func(rec record) error) (int64, error) {
+	offset := 0
+	for offset < len(data) {
+		if len(data)-offset < recordHeaderSize {
+			return int64(offset), errCorruptedRecord
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		checksum := binary.BigEndian.Uint32(data[offset+4 : offset+recordHeaderSize])
+		end := offset + recordHeaderSize + length
+		if end > len(data) || end < offset {
+			return int64(offset), errCorruptedRecord
+		}
+		if length == 0 {
+			// records are never empty, but a crash may leave the end of the
+			// file filled with zeros
+			if allZeros(data[offset:]) {
+				return int64(offset), errCorruptedRecord
+			}
+			return int64(offset), errors.New("empty record before the end")
+		}
+		payload := data[offset+recordHeaderSize : end]
+		if crc32.ChecksumIEEE(payload) != checksum {
+			if end == len(data) {
+				return int64(offset), errCorruptedRecord
+			}
+			return int64(offset), errors.New("checksum mismatch before the last record")
+		}
+		var rec record
+		err := json.Unmarshal(payload, &rec)
+		if err != nil {
+			if end == len(data) {
+				return int64(offset), errCorruptedRecord
+			}
+			return int64(offset), err
+		}
+		err = apply(rec)
+		if err != nil {
+			return int64(offset), err
+		}
+		offset = end
+	}
+	return int64(offset), nil
+}
+
+func allZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
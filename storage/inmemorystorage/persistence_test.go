@@ -0,0 +1,218 @@
+package inmemorystorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"twitter/storage"
+)
+
+func openTestStorage(t *testing.T, dir string) *InmemoryDataSource {
+	options := DefaultPersistenceOptions(dir)
+	options.Fsync = FsyncAlways
+	s, err := OpenStorage(options)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func timeline(t *testing.T, s *InmemoryDataSource, userId string) []storage.PostData {
+	page, err := s.GetPostsByUserId(ctx, userId, 100, "")
+	require.NoError(t, err)
+	return page.Posts
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestPostsSurviveReopening(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first, second, other := newPost("user1", "first"), newPost("user1", "second"), newPost("user2", "other")
+	for _, post := range []storage.PostData{first, second, other} {
+		require.NoError(t, s.Save(ctx, post))
+	}
+	first.Text = "edited"
+	require.NoError(t, s.Update(ctx, first))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{second, first}, timeline(t, s, "user1"))
+	result, err := s.GetPostById(ctx, other.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, other, result)
+}
+
+func TestCutLastRecordIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first, second := newPost("user1", "first"), newPost("user1", "second")
+	require.NoError(t, s.Save(ctx, first))
+	require.NoError(t, s.Save(ctx, second))
+	require.NoError(t, s.Close())
+	path := filepath.Join(dir, "posts.0.log")
+	require.NoError(t, os.Truncate(path, fileSize(t, path)-3))
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{first}, timeline(t, s, "user1"))
+	third := newPost("user1", "third")
+	require.NoError(t, s.Save(ctx, third))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{third, first}, timeline(t, s, "user1"))
+}
+
+func TestZerosAtTheEndOfLogAreDropped(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, first))
+	require.NoError(t, s.Close())
+	path := filepath.Join(dir, "posts.0.log")
+	size := fileSize(t, path)
+	// a power loss may extend the file with zeros
+	require.NoError(t, os.Truncate(path, size+4096))
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{first}, timeline(t, s, "user1"))
+	require.Equal(t, size, fileSize(t, path))
+	second := newPost("user1", "second")
+	require.NoError(t, s.Save(ctx, second))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{second, first}, timeline(t, s, "user1"))
+}
+
+func TestUndecodableLastRecordIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, first))
+	require.NoError(t, s.Close())
+	path := filepath.Join(dir, "posts.0.log")
+	var buf bytes.Buffer
+	payload := []byte(`{"op":`)
+	var header [recordHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	buf.Write(header[:])
+	buf.Write(payload)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{first}, timeline(t, s, "user1"))
+}
+
+func TestCorruptedRecordBeforeTheLastOneFailsOpening(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+	require.NoError(t, s.Save(ctx, newPost("user1", "second")))
+	require.NoError(t, s.Close())
+	path := filepath.Join(dir, "posts.0.log")
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	data[recordHeaderSize+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(path, data, 0o644))
+
+	_, err = OpenStorage(DefaultPersistenceOptions(dir))
+	require.Error(t, err)
+}
+
+func TestSnapshotReplacesLog(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first, second := newPost("user1", "first"), newPost("user1", "second")
+	require.NoError(t, s.Save(ctx, first))
+	first.Text = "edited"
+	require.NoError(t, s.Update(ctx, first))
+	require.NoError(t, s.Snapshot(ctx))
+	require.NoError(t, s.Save(ctx, second))
+	require.NoError(t, s.Close())
+
+	_, err := os.Stat(filepath.Join(dir, "posts.0.log"))
+	require.True(t, os.IsNotExist(err))
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{second, first}, timeline(t, s, "user1"))
+}
+
+func TestRolledBackTransactionIsNotLogged(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	committed, rolledBack := newPost("user1", "committed"), newPost("user1", "rolled back")
+	require.NoError(t, s.WithinTransaction(ctx, func(ctx context.Context) error {
+		return s.Save(ctx, committed)
+	}))
+	err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+		require.NoError(t, s.Save(ctx, rolledBack))
+		return errors.New("failed")
+	})
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{committed}, timeline(t, s, "user1"))
+}
+
+func TestCutTransactionIsDroppedWhole(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first, second, third := newPost("user1", "first"), newPost("user1", "second"), newPost("user1", "third")
+	require.NoError(t, s.Save(ctx, first))
+	require.NoError(t, s.WithinTransaction(ctx, func(ctx context.Context) error {
+		require.NoError(t, s.Save(ctx, second))
+		return s.Save(ctx, third)
+	}))
+	require.NoError(t, s.Close())
+	path := filepath.Join(dir, "posts.0.log")
+	require.NoError(t, os.Truncate(path, fileSize(t, path)-3))
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{first}, timeline(t, s, "user1"))
+}
+
+func TestCommittedTransactionSurvivesReopening(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStorage(t, dir)
+	first, second := newPost("user1", "first"), newPost("user1", "second")
+	require.NoError(t, s.WithinTransaction(ctx, func(ctx context.Context) error {
+		require.NoError(t, s.Save(ctx, first))
+		require.NoError(t, s.Save(ctx, second))
+		second.Text = "edited"
+		return s.Update(ctx, second)
+	}))
+	require.NoError(t, s.Close())
+
+	s = openTestStorage(t, dir)
+	require.Equal(t, []storage.PostData{second, first}, timeline(t, s, "user1"))
+}
+
+func TestWritesFailAfterClose(t *testing.T) {
+	s := openTestStorage(t, t.TempDir())
+	require.NoError(t, s.Close())
+	require.ErrorIs(t, s.Save(ctx, newPost("user1", "late")), storage.CommonStorageError)
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	policy, err := ParseFsyncPolicy("EverySec")
+	require.NoError(t, err)
+	require.Equal(t, FsyncEverySecond, policy)
+	_, err = ParseFsyncPolicy("sometimes")
+	require.Error(t, err)
+}
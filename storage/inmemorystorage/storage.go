@@ -1,33 +1,42 @@
 package inmemorystorage
 
 import (
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
 	"sync"
-	"twitter/generator"
 	"twitter/storage"
 )
 
+func NewStorage() *InmemoryDataSource {
+	return &InmemoryDataSource{
+		IdToPost:      map[string]storage.PostData{},
+		UserIdToPosts: map[string][]storage.PostData{},
+	}
+}
+
 type InmemoryDataSource struct {
-	StorageMu        sync.RWMutex
-	IdToPost         map[string]storage.PostData
-	UserIdToPosts    map[string][]storage.PostData
-	PageIdToOffset   map[string]int
-	PageIdToPageSize map[string]int
+	StorageMu sync.RWMutex
+	IdToPost  map[string]storage.PostData
+	// UserIdToPosts holds posts of every user sorted by id.
+	UserIdToPosts map[string][]storage.PostData
+	// persistence is nil unless the storage was opened with OpenStorage.
+	persistence *persistence
 }
 
 func (ids *InmemoryDataSource) Save(ctx context.Context, data storage.PostData) error {
+	defer ids.lock(ctx)()
 	for attempt := 0; attempt < 5; attempt++ {
-		_, ok := ids.IdToPost[data.Id.String()]
+		_, ok := ids.IdToPost[data.Id.Hex()]
 		if ok {
 			continue
 		} else {
-			ids.IdToPost[data.Id.String()] = data
-			val, _ := ids.UserIdToPosts[data.AuthorId]
-			val = append(val, data)
-			ids.UserIdToPosts[data.AuthorId] = val
+			err := ids.persist(ctx, record{Op: opSave, Post: data})
+			if err != nil {
+				return err
+			}
+			ids.insert(data)
 			return nil
 		}
 	}
@@ -35,7 +44,12 @@ func (ids *InmemoryDataSource) Save(ctx context.Context, data storage.PostData)
 }
 
 func (ids *InmemoryDataSource) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
-	val, ok := ids.IdToPost[id]
+	postId, err := storage.ParsePostID(id)
+	if err != nil {
+		return storage.PostData{}, err
+	}
+	defer ids.rLock(ctx)()
+	val, ok := ids.IdToPost[postId.Hex()]
 	if ok {
 		return val, nil
 	} else {
@@ -43,46 +57,87 @@ func (ids *InmemoryDataSource) GetPostById(ctx context.Context, id string) (stor
 	}
 }
 
+func (ids *InmemoryDataSource) GetPostsByIds(ctx context.Context, postIds []string) ([]storage.PostData, error) {
+	defer ids.rLock(ctx)()
+	posts := make([]storage.PostData, 0, len(postIds))
+	seen := map[string]bool{}
+	for _, id := range postIds {
+		postId, err := storage.ParsePostID(id)
+		if err != nil {
+			continue
+		}
+		// keys are lowercase, ids may come in any case
+		key := postId.Hex()
+		val, ok := ids.IdToPost[key]
+		if ok && !seen[key] {
+			seen[key] = true
+			posts = append(posts, val)
+		}
+	}
+	return posts, nil
+}
+
+// GetPostsByUserId returns posts of the user newest first, as mongostorage
+// does. The next page id is the id of the last returned post, the following
+// page starts after it.
 func (ids *InmemoryDataSource) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
-	val, ok := ids.UserIdToPosts[userId]
-	if pageId == "" {
-		if ok {
-			if len(val) <= pageSize {
-				return storage.PostsByUser{Posts: val}, nil
-			} else {
-				newPageId := generator.GetRandomKey()
-				ids.PageIdToPageSize[newPageId] = pageSize
-				ids.PageIdToOffset[newPageId] = pageSize
-				objectId, err := primitive.ObjectIDFromHex(newPageId)
-				if err != nil {
-					return storage.PostsByUser{}, fmt.Errorf("invalid id - %w", storage.CommonStorageError)
-				}
-				return storage.PostsByUser{Posts: val[:pageSize], NextPageId: objectId}, nil
-			}
-		} else {
-			return storage.PostsByUser{Posts: []storage.PostData{}}, nil
+	defer ids.rLock(ctx)()
+	posts := ids.UserIdToPosts[userId]
+	end := len(posts)
+	if pageId != "" {
+		lastId, err := storage.ParsePostID(pageId)
+		if err != nil {
+			return storage.PostsByUser{}, fmt.Errorf("invalid page id %v - %w", pageId, storage.ErrorInvalidPage)
 		}
-	} else {
-		if ok {
-			oldSize, ok2 := ids.PageIdToPageSize[pageId]
-			if ok2 {
-				if oldSize != pageSize {
-					return storage.PostsByUser{Posts: []storage.PostData{}}, errors.New("provided pageid is not equal to current pageid")
-				}
-				val = val[ids.PageIdToOffset[pageId]:]
-				if len(val) <= pageSize {
-					return storage.PostsByUser{Posts: val}, nil
-				} else {
-					newPageId := generator.GetRandomKey()
-					ids.PageIdToPageSize[newPageId] = pageSize
-					ids.PageIdToOffset[newPageId] = ids.PageIdToOffset[pageId] + pageSize
-					return storage.PostsByUser{Posts: val[:pageSize]}, nil
-				}
-			} else {
-				return storage.PostsByUser{Posts: []storage.PostData{}}, errors.New("page was not found")
-			}
-		} else {
-			return storage.PostsByUser{Posts: []storage.PostData{}}, errors.New("this user has no posts yet")
+		end = sort.Search(len(posts), func(i int) bool {
+			return bytes.Compare(posts[i].Id[:], lastId[:]) >= 0
+		})
+	}
+	page := make([]storage.PostData, 0, pageSize)
+	for i := end - 1; i >= 0 && len(page) < pageSize; i-- {
+		page = append(page, posts[i])
+	}
+	if len(page) == 0 {
+		return storage.PostsByUser{Posts: page, NextPageId: storage.NilPostID}, nil
+	}
+	return storage.PostsByUser{Posts: page, NextPageId: page[len(page)-1].Id}, nil
+}
+
+func (ids *InmemoryDataSource) Update(ctx context.Context, data storage.PostData) error {
+	defer ids.lock(ctx)()
+	_, ok := ids.IdToPost[data.Id.Hex()]
+	if !ok {
+		return fmt.Errorf("no posts with id %v - %w", data.Id.Hex(), storage.ErrorNotFound)
+	}
+	err := ids.persist(ctx, record{Op: opUpdate, Post: data})
+	if err != nil {
+		return err
+	}
+	ids.replace(data)
+	return nil
+}
+
+// insert keeps posts of every user sorted by id.
+func (ids *InmemoryDataSource) insert(data storage.PostData) {
+	ids.IdToPost[data.Id.Hex()] = data
+	posts := ids.UserIdToPosts[data.AuthorId]
+	i := sort.Search(len(posts), func(i int) bool {
+		return bytes.Compare(posts[i].Id[:], data.Id[:]) > 0
+	})
+	posts = append(posts, storage.PostData{})
+	copy(posts[i+1:], posts[i:])
+	posts[i] = data
+	ids.UserIdToPosts[data.AuthorId] = posts
+}
+
+func (ids *InmemoryDataSource) replace(data storage.PostData) {
+	ids.IdToPost[data.Id.Hex()] = data
+	posts := ids.UserIdToPosts[data.AuthorId]
+	for i := range posts {
+		if posts[i].Id == data.Id {
+			posts[i] = data
 		}
 	}
 }
+
+var _ storage.Storage = (*InmemoryDataSource)(nil)
@@ -0,0 +1,19 @@
+package inmemorystorage
+
+import (
+	"testing"
+	"twitter/storage"
+	"twitter/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) storage.Storage {
+		return NewStorage()
+	})
+}
+
+func TestPersistentStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) storage.Storage {
+		return openTestStorage(t, t.TempDir())
+	})
+}
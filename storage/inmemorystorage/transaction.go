@@ -0,0 +1,114 @@
+package inmemorystorage
+
+import (
+	"context"
+	"twitter/storage"
+)
+
+type transactionKey struct{}
+
+// transaction is the state of a running transaction. While it is active its
+// storage is locked by it, so calls with its context must not lock again.
+type transaction struct {
+	storage *InmemoryDataSource
+	active  bool
+	// records are logged on commit in a single batch, so rolled back
+	// changes never are and committed ones are recovered whole.
+	records []record
+}
+
+// WithinTransaction runs fn holding the storage lock, so transactions are
+// serialized with each other and with single operations. Changes are rolled
+// back if fn fails or panics.
+func (ids *InmemoryDataSource) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if ids.inTransaction(ctx) {
+		return fn(ctx)
+	}
+	ids.StorageMu.Lock()
+	defer ids.StorageMu.Unlock()
+	tx := &transaction{storage: ids, active: true}
+	defer func() { tx.active = false }()
+	snapshot := ids.snapshot()
+	committed := false
+	defer func() {
+		if !committed {
+			ids.restore(snapshot)
+		}
+	}()
+
+	err := fn(context.WithValue(ctx, transactionKey{}, tx))
+	if err != nil {
+		return err
+	}
+	if ids.persistence != nil && len(tx.records) > 0 {
+		rec := tx.records[0]
+		if len(tx.records) > 1 {
+			rec = record{Op: opBatch, Records: tx.records}
+		}
+		err = ids.persistence.write(rec)
+		if err != nil {
+			return err
+		}
+	}
+	committed = true
+	return nil
+}
+
+func (ids *InmemoryDataSource) inTransaction(ctx context.Context) bool {
+	return ids.transaction(ctx) != nil
+}
+
+func (ids *InmemoryDataSource) transaction(ctx context.Context) *transaction {
+	tx, ok := ctx.Value(transactionKey{}).(*transaction)
+	if ok && tx.storage == ids && tx.active {
+		return tx
+	}
+	return nil
+}
+
+// lock takes the storage lock unless ctx belongs to a running transaction,
+// which already holds it. It returns the function releasing the lock.
+func (ids *InmemoryDataSource) lock(ctx context.Context) func() {
+	if ids.inTransaction(ctx) {
+		return func() {}
+	}
+	ids.StorageMu.Lock()
+	return ids.StorageMu.Unlock
+}
+
+func (ids *InmemoryDataSource) rLock(ctx context.Context) func() {
+	if ids.inTransaction(ctx) {
+		return func() {}
+	}
+	ids.StorageMu.RLock()
+	return ids.StorageMu.RUnlock
+}
+
+type snapshot struct {
+	idToPost      map[string]storage.PostData
+	userIdToPosts map[string][]storage.PostData
+}
+
+// snapshot must be called with StorageMu held. Slices of posts are copied as
+// well, updates change them in place.
+func (ids *InmemoryDataSource) snapshot() snapshot {
+	s := snapshot{
+		idToPost:      make(map[string]storage.PostData, len(ids.IdToPost)),
+		userIdToPosts: make(map[string][]storage.PostData, len(ids.UserIdToPosts)),
+	}
+	for id, post := range ids.IdToPost {
+		s.idToPost[id] = post
+	}
+	for userId, posts := range ids.UserIdToPosts {
+		s.userIdToPosts[userId] = append([]storage.PostData(nil), posts...)
+	}
+	return s
+}
+
+// restore must be called with StorageMu held.
+func (ids *InmemoryDataSource) restore(s snapshot) {
+	ids.IdToPost = s.idToPost
+	ids.UserIdToPosts = s.userIdToPosts
+}
+
+var _ storage.Transactor = (*InmemoryDataSource)(nil)
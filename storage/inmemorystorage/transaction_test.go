@@ -0,0 +1,123 @@
+package inmemorystorage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"twitter/generator"
+	"twitter/storage"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+var ctx = context.Background()
+
+func newPost(authorId, text string) storage.PostData {
+	return storage.PostData{Id: idGenerator.NewPostID(), AuthorId: authorId, Text: text}
+}
+
+func TestTransactionCommits(t *testing.T) {
+	s := NewStorage()
+	first, second := newPost("user1", "first"), newPost("user1", "second")
+
+	err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+		require.NoError(t, s.Save(ctx, first))
+		require.NoError(t, s.Save(ctx, second))
+		first.Text = "edited"
+		require.NoError(t, s.Update(ctx, first))
+		result, err := s.GetPostById(ctx, first.Id.Hex())
+		require.NoError(t, err)
+		require.Equal(t, "edited", result.Text)
+		return nil
+	})
+	require.NoError(t, err)
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{second, first}, page.Posts)
+}
+
+func TestTransactionRollsBackOnError(t *testing.T) {
+	s := NewStorage()
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	failure := errors.New("failed")
+
+	err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+		edited := post
+		edited.Text = "edited"
+		require.NoError(t, s.Update(ctx, edited))
+		require.NoError(t, s.Save(ctx, newPost("user1", "second")))
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{post}, page.Posts)
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+}
+
+func TestTransactionRollsBackOnPanic(t *testing.T) {
+	s := NewStorage()
+	require.Panics(t, func() {
+		_ = s.WithinTransaction(ctx, func(ctx context.Context) error {
+			require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+			panic("failed")
+		})
+	})
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Empty(t, page.Posts)
+}
+
+func TestNestedTransactionJoinsOuter(t *testing.T) {
+	s := NewStorage()
+	failure := errors.New("failed")
+
+	err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+		err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+			return s.Save(ctx, newPost("user1", "inner"))
+		})
+		require.NoError(t, err)
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Empty(t, page.Posts)
+}
+
+func TestTransactionsAreSerialized(t *testing.T) {
+	s := NewStorage()
+	post := newPost("user1", "0")
+	require.NoError(t, s.Save(ctx, post))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// a read-modify-write loses updates unless it is isolated
+			err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+				current, err := s.GetPostById(ctx, post.Id.Hex())
+				if err != nil {
+					return err
+				}
+				current.Text += "+"
+				return s.Update(ctx, current)
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Len(t, result.Text, 21)
+}
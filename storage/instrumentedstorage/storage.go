@@ -0,0 +1,96 @@
+package instrumentedstorage
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+	"twitter/metrics"
+	"twitter/storage"
+)
+
+const instrumentationName = "twitter/storage/instrumentedstorage"
+
+func NewStorage(backend string, wrapped storage.Storage, m *metrics.Metrics) *Storage {
+	return &Storage{
+		backend: backend,
+		wrapped: wrapped,
+		metrics: m,
+	}
+}
+
+// Storage records latency and errors of every call to the wrapped storage
+// under the given backend name and wraps each call into a tracing span.
+type Storage struct {
+	backend string
+	wrapped storage.Storage
+	metrics *metrics.Metrics
+}
+
+func (s *Storage) Save(ctx context.Context, data storage.PostData) error {
+	ctx, finish := s.start(ctx, "Save")
+	err := s.wrapped.Save(ctx, data)
+	finish(err)
+	return err
+}
+
+func (s *Storage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	ctx, finish := s.start(ctx, "GetPostById", attribute.String("post.id", id))
+	result, err := s.wrapped.GetPostById(ctx, id)
+	finish(err)
+	return result, err
+}
+
+func (s *Storage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	ctx, finish := s.start(ctx, "GetPostsByIds", attribute.Int("posts.requested", len(ids)))
+	result, err := s.wrapped.GetPostsByIds(ctx, ids)
+	finish(err)
+	return result, err
+}
+
+func (s *Storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	ctx, finish := s.start(ctx, "GetPostsByUserId",
+		attribute.String("user.id", userId),
+		attribute.Int("page.size", pageSize),
+		attribute.String("page.id", pageId),
+	)
+	result, err := s.wrapped.GetPostsByUserId(ctx, userId, pageSize, pageId)
+	finish(err)
+	return result, err
+}
+
+func (s *Storage) Update(ctx context.Context, data storage.PostData) error {
+	ctx, finish := s.start(ctx, "Update")
+	err := s.wrapped.Update(ctx, data)
+	finish(err)
+	return err
+}
+
+func (s *Storage) start(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, func(error)) {
+	attributes = append(attributes, attribute.String("storage.backend", s.backend))
+	ctx, span := otel.Tracer(instrumentationName).Start(ctx, s.backend+"."+method, trace.WithAttributes(attributes...))
+	start := time.Now()
+	return ctx, func(err error) {
+		err = failure(err)
+		s.metrics.ObserveStorageOperation(s.backend, method, time.Since(start), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// failure hides not-found errors, which are a regular outcome of a lookup
+// rather than a malfunction of the backend.
+func failure(err error) error {
+	if errors.Is(err, storage.ErrorNotFound) {
+		return nil
+	}
+	return err
+}
+
+var _ storage.Storage = (*Storage)(nil)
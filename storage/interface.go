@@ -4,31 +4,47 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
 	CommonStorageError = errors.New("storage")
 	ErrorCollision     = fmt.Errorf("%w.collision", CommonStorageError)
 	ErrorNotFound      = fmt.Errorf("%w.not_found", CommonStorageError)
+	ErrorInvalidId     = fmt.Errorf("%w.invalid_id", CommonStorageError)
+	ErrorInvalidPage   = fmt.Errorf("%w.invalid_page", CommonStorageError)
 )
 
 type PostData struct {
-	Id             primitive.ObjectID `json:"_id" bson:"_id"`
-	Text           string             `json:"text" bson:"text"`
-	AuthorId       string             `json:"authorId" bson:"authorId"`
-	CreatedAt      string             `json:"createdAt" bson:"createdAt"`
-	LastModifiedAt string             `json:"lastModifiedAt" bson:"lastModifiedAt"`
+	Id             PostID `json:"_id" bson:"_id"`
+	Text           string `json:"text" bson:"text"`
+	AuthorId       string `json:"authorId" bson:"authorId"`
+	CreatedAt      string `json:"createdAt" bson:"createdAt"`
+	LastModifiedAt string `json:"lastModifiedAt" bson:"lastModifiedAt"`
 }
 
 type PostsByUser struct {
-	Posts      []PostData         `json:"posts" bson:"posts"`
-	NextPageId primitive.ObjectID `json:"nextPage" bson:"nextPage"`
+	Posts      []PostData `json:"posts" bson:"posts"`
+	NextPageId PostID     `json:"nextPage" bson:"nextPage"`
 }
 
 type Storage interface {
 	Save(ctx context.Context, data PostData) error
 	GetPostById(ctx context.Context, id string) (PostData, error)
+	// GetPostsByIds returns existing posts with the given ids in the order of
+	// ids. Missing and invalid ids are skipped, repeated ones are returned once.
+	GetPostsByIds(ctx context.Context, ids []string) ([]PostData, error)
 	GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (PostsByUser, error)
+	// Update returns ErrorNotFound if there is no post with the id of data.
 	Update(ctx context.Context, data PostData) error
 }
+
+// Transactor is implemented by storages able to run several operations
+// atomically, so that logic spanning them is written once for all storages.
+type Transactor interface {
+	// WithinTransaction runs fn in a transaction. Operations of the storage
+	// called with the context passed to fn are committed together if fn
+	// returns nil and discarded otherwise. fn may be called again when the
+	// transaction is retried, so it must have no other side effects. Calls
+	// within a transaction join it.
+	WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
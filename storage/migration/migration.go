@@ -0,0 +1,126 @@
+// Package migration plans schema migrations of storages. Storages describe
+// their migrations with headers, while recording applied migrations and
+// running their steps is up to them.
+package migration
+
+import (
+	"fmt"
+	"time"
+)
+
+// Header describes a migration independently of how its storage runs it.
+type Header struct {
+	Version     int
+	Description string
+	// HasUp and HasDown tell whether the migration has the step.
+	HasUp   bool
+	HasDown bool
+}
+
+type Status struct {
+	Header
+	Applied bool
+	// AppliedAt is zero for pending migrations.
+	AppliedAt time.Time
+}
+
+// Planner chooses migrations to run. headers are sorted by version, applied
+// holds application times of applied migrations by version. It returns
+// indexes of headers in the order to run them.
+type Planner func(headers []Header, applied map[int]time.Time) ([]int, error)
+
+// Up plans applying pending migrations up to target version in the order of
+// versions, zero target means the latest version. A migration missed by an
+// older release is applied late.
+func Up(target int) Planner {
+	return func(headers []Header, applied map[int]time.Time) ([]int, error) {
+		var planned []int
+		for i, header := range headers {
+			if target > 0 && header.Version > target {
+				break
+			}
+			if _, ok := applied[header.Version]; !ok {
+				planned = append(planned, i)
+			}
+		}
+		return planned, nil
+	}
+}
+
+// Down plans reverting applied migrations with versions above target, the
+// newest first. It fails if one of them cannot be reverted or is unknown.
+func Down(target int) Planner {
+	return func(headers []Header, applied map[int]time.Time) ([]int, error) {
+		known := make(map[int]bool, len(headers))
+		for _, header := range headers {
+			known[header.Version] = true
+		}
+		for version := range applied {
+			if version > target && !known[version] {
+				return nil, fmt.Errorf("applied migration %d is unknown to this version of the service", version)
+			}
+		}
+		var planned []int
+		for i := len(headers) - 1; i >= 0; i-- {
+			header := headers[i]
+			if header.Version <= target {
+				break
+			}
+			if _, ok := applied[header.Version]; !ok {
+				continue
+			}
+			if !header.HasDown {
+				return nil, fmt.Errorf("migration %d cannot be reverted", header.Version)
+			}
+			planned = append(planned, i)
+		}
+		return planned, nil
+	}
+}
+
+// Validate checks headers sorted by version.
+func Validate(headers []Header) error {
+	for i, header := range headers {
+		if header.Version <= 0 {
+			return fmt.Errorf("migration %q has non-positive version %d", header.Description, header.Version)
+		}
+		if i > 0 && headers[i-1].Version == header.Version {
+			return fmt.Errorf("duplicate migration version %d", header.Version)
+		}
+		if !header.HasUp {
+			return fmt.Errorf("migration %d has no up step", header.Version)
+		}
+	}
+	return nil
+}
+
+// Run plans migrations and runs them one by one with run, which gets the
+// index of the migration, unless dryRun is set. It returns headers of the
+// migrations it ran, or would run, and stops at the first failed one.
+func Run(headers []Header, applied map[int]time.Time, plan Planner, dryRun bool, run func(index int) error) ([]Header, error) {
+	planned, err := plan(headers, applied)
+	if err != nil {
+		return nil, err
+	}
+	ran := make([]Header, 0, len(planned))
+	for _, index := range planned {
+		if !dryRun {
+			err = run(index)
+			if err != nil {
+				return ran, err
+			}
+		}
+		ran = append(ran, headers[index])
+	}
+	return ran, nil
+}
+
+// Statuses returns statuses of migrations with the given headers.
+func Statuses(headers []Header, applied map[int]time.Time) []Status {
+	statuses := make([]Status, 0, len(headers))
+	for _, header := range headers {
+		appliedAt, ok := applied[header.Version]
+		statuses = append(statuses, Status{Header: header, Applied: ok, AppliedAt: appliedAt})
+	}
+	return statuses
+}
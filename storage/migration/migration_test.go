@@ -0,0 +1,95 @@
+package migration
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func headers(versions ...int) []Header {
+	result := make([]Header, 0, len(versions))
+	for _, version := range versions {
+		result = append(result, Header{Version: version, HasUp: true, HasDown: true})
+	}
+	return result
+}
+
+func appliedAt(versions ...int) map[int]time.Time {
+	applied := make(map[int]time.Time, len(versions))
+	for _, version := range versions {
+		applied[version] = time.Unix(int64(version), 0)
+	}
+	return applied
+}
+
+func versions(t *testing.T, headers []Header, plan Planner, applied map[int]time.Time) []int {
+	planned, err := plan(headers, applied)
+	require.NoError(t, err)
+	result := make([]int, 0, len(planned))
+	for _, index := range planned {
+		result = append(result, headers[index].Version)
+	}
+	return result
+}
+
+func TestUp(t *testing.T) {
+	all := headers(1, 2, 3)
+	require.Equal(t, []int{2, 3}, versions(t, all, Up(0), appliedAt(1)))
+	require.Equal(t, []int{1, 2}, versions(t, all, Up(2), appliedAt()))
+	// a migration missed by an older release is applied late
+	require.Equal(t, []int{2}, versions(t, all, Up(0), appliedAt(1, 3)))
+	require.Empty(t, versions(t, all, Up(0), appliedAt(1, 2, 3)))
+}
+
+func TestDown(t *testing.T) {
+	all := headers(1, 2, 3)
+	require.Equal(t, []int{3, 2}, versions(t, all, Down(1), appliedAt(1, 2, 3)))
+	require.Equal(t, []int{3, 1}, versions(t, all, Down(0), appliedAt(1, 3)))
+
+	all[1].HasDown = false
+	_, err := Down(0)(all, appliedAt(1, 2))
+	require.Error(t, err)
+	_, err = Down(1)(all, appliedAt(1, 2))
+	require.Error(t, err)
+	_, err = Down(0)(all, appliedAt(1, 4))
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Validate(headers(1, 2, 3)))
+	require.Error(t, Validate(headers(0)))
+	require.Error(t, Validate(headers(1, 1)))
+	require.Error(t, Validate([]Header{{Version: 1}}))
+}
+
+func TestRunStopsAtFailedMigration(t *testing.T) {
+	all := headers(1, 2, 3)
+	failure := errors.New("failed")
+	var ran []int
+	run := func(index int) error {
+		if all[index].Version == 2 {
+			return failure
+		}
+		ran = append(ran, all[index].Version)
+		return nil
+	}
+
+	done, err := Run(all, appliedAt(), Up(0), false, run)
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, headers(1), done)
+	require.Equal(t, []int{1}, ran)
+
+	done, err = Run(all, appliedAt(), Up(0), true, run)
+	require.NoError(t, err)
+	require.Equal(t, all, done)
+	require.Equal(t, []int{1}, ran)
+}
+
+func TestStatuses(t *testing.T) {
+	statuses := Statuses(headers(1, 2), appliedAt(1))
+	require.Equal(t, []Status{
+		{Header: headers(1)[0], Applied: true, AppliedAt: time.Unix(1, 0)},
+		{Header: headers(2)[0]},
+	}, statuses)
+}
@@ -0,0 +1,68 @@
+package mongostorage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// lease is a lock kept as a document of a collection. It expires after ttl,
+// so a crashed holder blocks others for ttl at most.
+type lease struct {
+	collection *mongo.Collection
+	id         string
+	owner      string
+	ttl        time.Duration
+	now        func() time.Time
+}
+
+func newLease(collection *mongo.Collection, id string, ttl time.Duration) *lease {
+	return &lease{
+		collection: collection,
+		id:         id,
+		owner:      newLeaseOwner(),
+		ttl:        ttl,
+		now:        time.Now,
+	}
+}
+
+// acquire takes the lease if it is free or expired and extends it if it is
+// already held by the owner. It reports false if another owner holds it: the
+// filter does not match then, and the upsert fails with a duplicate key
+// error.
+func (l *lease) acquire(ctx context.Context) (bool, error) {
+	now := l.now().UTC()
+	_, err := l.collection.UpdateOne(ctx,
+		bson.M{"_id": l.id, "$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$lt": now}},
+			bson.M{"owner": l.owner},
+		}},
+		bson.M{"$set": bson.M{"owner": l.owner, "expiresAt": now.Add(l.ttl)}},
+		options.Update().SetUpsert(true),
+	)
+	if err == nil {
+		return true, nil
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (l *lease) release(ctx context.Context) error {
+	_, err := l.collection.DeleteOne(ctx, bson.M{"_id": l.id, "owner": l.owner})
+	return err
+}
+
+func newLeaseOwner() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return time.Now().String()
+	}
+	return hex.EncodeToString(buf)
+}
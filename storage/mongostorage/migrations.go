@@ -0,0 +1,61 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// postsByAuthorIndexName is the name the index got when it was created
+// without one, before migrations existed.
+const postsByAuthorIndexName = "authorId_1__id_-1"
+
+const indexMaxTime = 10 * time.Second
+
+// migrations is the schema history of the database. Released migrations must
+// not be changed, changes go into new ones.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "index posts by author and id for timelines",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(collectionName).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{
+					{Key: "authorId", Value: 1},
+					{Key: "_id", Value: -1},
+				},
+				Options: options.Index().SetName(postsByAuthorIndexName),
+			}, options.CreateIndexes().SetMaxTime(indexMaxTime))
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(collectionName).Indexes().DropOne(ctx, postsByAuthorIndexName, options.DropIndexes().SetMaxTime(indexMaxTime))
+			return err
+		},
+	},
+	{
+		Version:     2,
+		Description: "create outbox of post events",
+		// collections cannot be created implicitly in transactions before
+		// MongoDB 4.4
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			err := db.CreateCollection(ctx, outboxCollectionName)
+			var commandError mongo.CommandError
+			if errors.As(err, &commandError) && commandError.Name == "NamespaceExists" {
+				return nil
+			}
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return db.Collection(outboxCollectionName).Drop(ctx)
+		},
+	},
+}
+
+// Migrations returns the migrations of the posts database.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
@@ -0,0 +1,205 @@
+package mongostorage
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
+	"time"
+	"twitter/logging"
+	"twitter/storage/migration"
+)
+
+const (
+	migrationsCollectionName    = "migrations"
+	migrationLockCollectionName = "migration_lock"
+	migrationLockId             = "migrations"
+)
+
+// Migration is a versioned change of the database schema. Up must be safe to
+// run again after it failed halfway, Down reverts it and is nil for
+// migrations which cannot be reverted.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrator applies migrations to a database and records applied ones in it.
+// Instances sharing the database take a lock in it, so only one of them
+// migrates at a time.
+type Migrator struct {
+	db         *mongo.Database
+	migrations []Migration
+	owner      string
+	// lockTTL bounds how long a crashed instance blocks migrations, it must
+	// be longer than any migration takes.
+	lockTTL          time.Duration
+	lockPollInterval time.Duration
+	now              func() time.Time
+}
+
+func NewMigrator(db *mongo.Database, migrations []Migration) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return &Migrator{
+		db:               db,
+		migrations:       sorted,
+		owner:            newLeaseOwner(),
+		lockTTL:          10 * time.Minute,
+		lockPollInterval: time.Second,
+		now:              time.Now,
+	}
+}
+
+// Up applies pending migrations up to target version in the order of
+// versions, zero target means the latest version. It returns the migrations
+// it applied, or would apply if dryRun is set.
+func (m *Migrator) Up(ctx context.Context, target int, dryRun bool) ([]migration.Header, error) {
+	return m.migrate(ctx, dryRun, migration.Up(target), m.apply)
+}
+
+// Down reverts applied migrations with versions above target, the newest
+// first. It returns the migrations it reverted, or would revert if dryRun is
+// set.
+func (m *Migrator) Down(ctx context.Context, target int, dryRun bool) ([]migration.Header, error) {
+	return m.migrate(ctx, dryRun, migration.Down(target), m.revert)
+}
+
+// Status returns all known migrations in the order of versions.
+func (m *Migrator) Status(ctx context.Context) ([]migration.Status, error) {
+	headers := m.headers()
+	err := migration.Validate(headers)
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return migration.Statuses(headers, applied), nil
+}
+
+func (m *Migrator) migrate(ctx context.Context, dryRun bool, plan migration.Planner, run func(ctx context.Context, migration Migration) error) ([]migration.Header, error) {
+	headers := m.headers()
+	err := migration.Validate(headers)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun {
+		release, err := m.lock(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	// read after taking the lock, another instance may have just migrated
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return migration.Run(headers, applied, plan, dryRun, func(index int) error {
+		return run(ctx, m.migrations[index])
+	})
+}
+
+func (m *Migrator) headers() []migration.Header {
+	headers := make([]migration.Header, len(m.migrations))
+	for i, known := range m.migrations {
+		headers[i] = migration.Header{
+			Version:     known.Version,
+			Description: known.Description,
+			HasUp:       known.Up != nil,
+			HasDown:     known.Down != nil,
+		}
+	}
+	return headers
+}
+
+func (m *Migrator) apply(ctx context.Context, migration Migration) error {
+	err := migration.Up(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("failed to apply migration %d - %w", migration.Version, err)
+	}
+	_, err = m.db.Collection(migrationsCollectionName).InsertOne(ctx, appliedMigration{
+		Version:     migration.Version,
+		Description: migration.Description,
+		AppliedAt:   m.now().UTC(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d - %w", migration.Version, err)
+	}
+	logging.FromContext(ctx).Info("applied migration", "version", migration.Version, "description", migration.Description)
+	return nil
+}
+
+func (m *Migrator) revert(ctx context.Context, migration Migration) error {
+	err := migration.Down(ctx, m.db)
+	if err != nil {
+		return fmt.Errorf("failed to revert migration %d - %w", migration.Version, err)
+	}
+	_, err = m.db.Collection(migrationsCollectionName).DeleteOne(ctx, bson.M{"_id": migration.Version})
+	if err != nil {
+		return fmt.Errorf("failed to record revert of migration %d - %w", migration.Version, err)
+	}
+	logging.FromContext(ctx).Info("reverted migration", "version", migration.Version, "description", migration.Description)
+	return nil
+}
+
+// applied returns application times of applied migrations by version.
+func (m *Migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	cursor, err := m.db.Collection(migrationsCollectionName).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+	}
+	var records []appliedMigration
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+	}
+	applied := make(map[int]time.Time, len(records))
+	for _, record := range records {
+		applied[record.Version] = record.AppliedAt
+	}
+	return applied, nil
+}
+
+// lock waits until the migration lock is free and takes it.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	lock := newLease(m.db.Collection(migrationLockCollectionName), migrationLockId, m.lockTTL)
+	lock.owner = m.owner
+	lock.now = m.now
+	for {
+		acquired, err := lock.acquire(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to take migration lock - %w", err)
+		}
+		if acquired {
+			return func() {
+				// the lock must be released even if ctx is already done
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				err := lock.release(releaseCtx)
+				if err != nil {
+					logging.FromContext(ctx).Warn("failed to release migration lock", "error", err)
+				}
+			}, nil
+		}
+		logging.FromContext(ctx).Info("waiting for migration lock")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(m.lockPollInterval):
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"twitter/storage/migration"
+)
+
+func noop(ctx context.Context, db *mongo.Database) error {
+	return nil
+}
+
+func versions(headers []migration.Header) []int {
+	result := make([]int, 0, len(headers))
+	for _, header := range headers {
+		result = append(result, header.Version)
+	}
+	return result
+}
+
+func TestMigrationsAreValid(t *testing.T) {
+	require.NoError(t, migration.Validate(NewMigrator(nil, Migrations()).headers()))
+	require.Error(t, migration.Validate(NewMigrator(nil, []Migration{{Version: 1}}).headers()))
+}
+
+// newTestDatabase needs a MongoDB server, its address is taken from
+// MONGO_URL.
+func newTestDatabase(t *testing.T) *mongo.Database {
+	mongoUrl := os.Getenv("MONGO_URL")
+	if mongoUrl == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoUrl))
+	require.NoError(t, err)
+	db := client.Database("migrator_test_" + newLeaseOwner()[:8])
+	t.Cleanup(func() {
+		_ = db.Drop(ctx)
+		_ = client.Disconnect(ctx)
+	})
+	return db
+}
+
+func TestMigratorAppliesAndRevertsIndexes(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	migrator := NewMigrator(db, Migrations())
+
+	planned, err := migrator.Up(ctx, 0, true)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(planned))
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	require.False(t, statuses[0].Applied)
+
+	applied, err := migrator.Up(ctx, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(applied))
+	applied, err = migrator.Up(ctx, 0, false)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+	statuses, err = migrator.Status(ctx)
+	require.NoError(t, err)
+	require.True(t, statuses[0].Applied)
+	require.Contains(t, indexNames(t, db), postsByAuthorIndexName)
+
+	reverted, err := migrator.Down(ctx, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(reverted))
+	require.NotContains(t, indexNames(t, db), postsByAuthorIndexName)
+}
+
+func TestMigratorStopsAtFailedMigration(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	failure := errors.New("failed")
+	migrator := NewMigrator(db, []Migration{
+		{Version: 1, Up: noop},
+		{Version: 2, Up: func(ctx context.Context, db *mongo.Database) error { return failure }},
+		{Version: 3, Up: noop},
+	})
+
+	applied, err := migrator.Up(ctx, 0, false)
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, []int{1}, versions(applied))
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, false}, []bool{statuses[0].Applied, statuses[1].Applied, statuses[2].Applied})
+}
+
+func TestOnlyOneMigratorMigratesAtATime(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	var mu sync.Mutex
+	running, maxRunning, runs := 0, 0, 0
+	slow := func(ctx context.Context, db *mongo.Database) error {
+		mu.Lock()
+		running++
+		runs++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		migrator := NewMigrator(db, []Migration{{Version: 1, Up: slow}})
+		migrator.lockPollInterval = 10 * time.Millisecond
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := migrator.Up(ctx, 0, false)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 1, maxRunning)
+	require.Equal(t, 1, runs)
+}
+
+func TestExpiredMigrationLockIsTaken(t *testing.T) {
+	db := newTestDatabase(t)
+	ctx := context.Background()
+	_, err := db.Collection(migrationLockCollectionName).InsertOne(ctx, bson.M{
+		"_id":       migrationLockId,
+		"owner":     "crashed",
+		"expiresAt": time.Now().Add(-time.Minute),
+	})
+	require.NoError(t, err)
+
+	applied, err := NewMigrator(db, []Migration{{Version: 1, Up: noop}}).Up(ctx, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, versions(applied))
+}
+
+func indexNames(t *testing.T, db *mongo.Database) []string {
+	cursor, err := db.Collection(collectionName).Indexes().List(context.Background())
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cursor.All(context.Background(), &indexes))
+	names := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		names = append(names, index["name"].(string))
+	}
+	return names
+}
@@ -0,0 +1,83 @@
+package mongostorage
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"strconv"
+	"time"
+)
+
+// Options configures the connection to MongoDB. Zero values keep settings
+// given in the URL or the driver defaults.
+type Options struct {
+	URL                    string
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+	MaxConnIdleTime        time.Duration
+	// TimelineReadPreference is used by timeline queries, which tolerate
+	// replication lag, unless the context asks for primary reads. Other
+	// reads go to the primary to see their writes.
+	TimelineReadPreference *readpref.ReadPref
+	// SaveWriteConcern is used when posts are created.
+	SaveWriteConcern *writeconcern.WriteConcern
+	// Outbox makes writes record events in the outbox within the same
+	// transaction, which needs a replica set. The Relay publishes them.
+	Outbox bool
+}
+
+func DefaultOptions(url string) Options {
+	return Options{
+		URL:                    url,
+		ConnectTimeout:         5 * time.Second,
+		ServerSelectionTimeout: 5 * time.Second,
+		TimelineReadPreference: readpref.SecondaryPreferred(),
+		SaveWriteConcern:       writeconcern.New(writeconcern.WMajority()),
+	}
+}
+
+func (o Options) client() *options.ClientOptions {
+	clientOptions := options.Client().ApplyURI(o.URL)
+	if o.ConnectTimeout > 0 {
+		clientOptions.SetConnectTimeout(o.ConnectTimeout)
+	}
+	if o.ServerSelectionTimeout > 0 {
+		clientOptions.SetServerSelectionTimeout(o.ServerSelectionTimeout)
+	}
+	if o.MaxPoolSize > 0 {
+		clientOptions.SetMaxPoolSize(o.MaxPoolSize)
+	}
+	if o.MinPoolSize > 0 {
+		clientOptions.SetMinPoolSize(o.MinPoolSize)
+	}
+	if o.MaxConnIdleTime > 0 {
+		clientOptions.SetMaxConnIdleTime(o.MaxConnIdleTime)
+	}
+	return clientOptions
+}
+
+// ParseReadPreference parses a read preference mode name like
+// "secondaryPreferred".
+func ParseReadPreference(name string) (*readpref.ReadPref, error) {
+	mode, err := readpref.ModeFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	return readpref.New(mode)
+}
+
+// ParseWriteConcern parses "majority" or the number of nodes which must
+// acknowledge writes.
+func ParseWriteConcern(name string) (*writeconcern.WriteConcern, error) {
+	if name == "majority" {
+		return writeconcern.New(writeconcern.WMajority()), nil
+	}
+	w, err := strconv.Atoi(name)
+	if err != nil || w < 0 {
+		return nil, fmt.Errorf("unknown write concern %q", name)
+	}
+	return writeconcern.New(writeconcern.W(w)), nil
+}
@@ -0,0 +1,64 @@
+package mongostorage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"testing"
+	"time"
+)
+
+func TestOptionsOverrideOnlySetValues(t *testing.T) {
+	options := Options{URL: "mongodb://localhost:27017/?maxPoolSize=7&connectTimeoutMS=1500", MinPoolSize: 2}
+	clientOptions := options.client()
+	require.Equal(t, uint64(7), *clientOptions.MaxPoolSize)
+	require.Equal(t, uint64(2), *clientOptions.MinPoolSize)
+	require.Equal(t, 1500*time.Millisecond, *clientOptions.ConnectTimeout)
+	require.Nil(t, clientOptions.ServerSelectionTimeout)
+
+	options.ConnectTimeout = time.Second
+	require.Equal(t, time.Second, *options.client().ConnectTimeout)
+}
+
+func TestDefaultOptions(t *testing.T) {
+	options := DefaultOptions("mongodb://localhost:27017")
+	require.Equal(t, readpref.SecondaryPreferredMode, options.TimelineReadPreference.Mode())
+	require.Equal(t, writeconcern.New(writeconcern.WMajority()), options.SaveWriteConcern)
+}
+
+func TestDatabaseStorageDoesNotNeedServer(t *testing.T) {
+	options := DefaultOptions("mongodb://127.0.0.1:1")
+	options.TimelineReadPreference = nil
+	s, err := DatabaseStorage(context.Background(), options)
+	require.NoError(t, err)
+	require.NoError(t, s.Close(context.Background()))
+}
+
+func TestDatabaseStorageReturnsErrorForInvalidUrl(t *testing.T) {
+	_, err := DatabaseStorage(context.Background(), DefaultOptions("not a url"))
+	require.Error(t, err)
+}
+
+func TestParseReadPreference(t *testing.T) {
+	preference, err := ParseReadPreference("nearest")
+	require.NoError(t, err)
+	require.Equal(t, readpref.NearestMode, preference.Mode())
+	_, err = ParseReadPreference("fastest")
+	require.Error(t, err)
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	for name, want := range map[string]*writeconcern.WriteConcern{
+		"majority": writeconcern.New(writeconcern.WMajority()),
+		"1":        writeconcern.New(writeconcern.W(1)),
+	} {
+		concern, err := ParseWriteConcern(name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, concern, name)
+	}
+	for _, name := range []string{"", "all", "-1"} {
+		_, err := ParseWriteConcern(name)
+		require.Error(t, err, name)
+	}
+}
@@ -0,0 +1,156 @@
+package mongostorage
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+	"twitter/logging"
+	storage2 "twitter/storage"
+)
+
+const (
+	relayLeaseCollectionName = "outbox_relay"
+	relayLeaseId             = "relay"
+)
+
+// outboxEntry is an event waiting in the outbox. Entries are relayed in the
+// order of ids, which follows the order of writes only roughly: ids are
+// assigned before the transaction commits, and clocks of instances differ.
+type outboxEntry struct {
+	Id         primitive.ObjectID `bson:"_id"`
+	Type       storage2.EventType `bson:"type"`
+	Post       storage2.PostData  `bson:"post"`
+	OccurredAt primitive.DateTime `bson:"occurredAt"`
+}
+
+// recordEvent must be called within the transaction of the write.
+func (s *storage) recordEvent(ctx context.Context, eventType storage2.EventType, data storage2.PostData) error {
+	_, err := s.outbox.InsertOne(ctx, outboxEntry{
+		Id:         primitive.NewObjectID(),
+		Type:       eventType,
+		Post:       data,
+		OccurredAt: primitive.NewDateTimeFromTime(time.Now()),
+	})
+	if err != nil {
+		return storage2.NewDatabaseError("failed to record event", err)
+	}
+	return nil
+}
+
+type RelayOptions struct {
+	// BatchSize is the maximal number of events published at once.
+	BatchSize int
+	// PollInterval is how long the relay waits when the outbox is empty.
+	PollInterval time.Duration
+	// LeaseTTL bounds how long a crashed relay keeps others from relaying.
+	LeaseTTL time.Duration
+}
+
+func DefaultRelayOptions() RelayOptions {
+	return RelayOptions{
+		BatchSize:    100,
+		PollInterval: 500 * time.Millisecond,
+		LeaseTTL:     30 * time.Second,
+	}
+}
+
+// Relay publishes events from the outbox and removes published ones. Events
+// are published at least once: a relay failing after publishing a batch
+// publishes it again. Every instance may run a relay, one of them relays at a
+// time and the others stand by.
+type Relay struct {
+	storage   *storage
+	publisher storage2.EventPublisher
+	options   RelayOptions
+	lease     *lease
+}
+
+func (s *storage) NewRelay(publisher storage2.EventPublisher, options RelayOptions) *Relay {
+	return &Relay{
+		storage:   s,
+		publisher: publisher,
+		options:   options,
+		lease:     newLease(s.client.Database(dbName).Collection(relayLeaseCollectionName), relayLeaseId, options.LeaseTTL),
+	}
+}
+
+// Run relays events until ctx is done. It does nothing if the storage does
+// not record events.
+func (r *Relay) Run(ctx context.Context) {
+	if r.storage.outbox == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := r.lease.release(releaseCtx)
+		if err != nil {
+			logger.Warn("failed to release outbox relay lease", "error", err)
+		}
+	}()
+	for {
+		relayed, err := r.relay(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to relay events", "error", err)
+		}
+		if relayed == r.options.BatchSize {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.options.PollInterval):
+		}
+	}
+}
+
+// relay publishes one batch of events if the relay holds the lease and
+// returns the number of published events.
+func (r *Relay) relay(ctx context.Context) (int, error) {
+	// the lease is extended with every batch
+	acquired, err := r.lease.acquire(ctx)
+	if err != nil || !acquired {
+		return 0, err
+	}
+	cursor, err := r.storage.outbox.Find(ctx, bson.M{}, options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(r.options.BatchSize)))
+	if err != nil {
+		return 0, storage2.NewDatabaseError("failed to read outbox", err)
+	}
+	var entries []outboxEntry
+	err = cursor.All(ctx, &entries)
+	if err != nil {
+		return 0, storage2.NewDatabaseError("failed to read outbox", err)
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	events := make([]storage2.Event, 0, len(entries))
+	ids := make([]primitive.ObjectID, 0, len(entries))
+	for _, entry := range entries {
+		events = append(events, storage2.Event{
+			Id:         entry.Id.Hex(),
+			Type:       entry.Type,
+			Post:       entry.Post,
+			OccurredAt: entry.OccurredAt.Time().UTC(),
+		})
+		ids = append(ids, entry.Id)
+	}
+	err = r.publisher.Publish(ctx, events)
+	if err != nil {
+		return 0, err
+	}
+	_, err = r.storage.outbox.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return 0, storage2.NewDatabaseError("failed to remove published events", err)
+	}
+	return len(events), nil
+}
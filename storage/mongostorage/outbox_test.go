@@ -0,0 +1,114 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"sync"
+	"testing"
+	"time"
+	"twitter/generator"
+	storage2 "twitter/storage"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+type recordingPublisher struct {
+	mu     sync.Mutex
+	err    error
+	events []storage2.Event
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, events []storage2.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.events = append(p.events, events...)
+	return nil
+}
+
+func newOutboxStorage(t *testing.T) *storage {
+	s := newTestStorage(t)
+	s.outbox = s.posts.Database().Collection(outboxCollectionName)
+	return s
+}
+
+func countOutbox(t *testing.T, s *storage) int64 {
+	count, err := s.outbox.CountDocuments(context.Background(), bson.M{})
+	require.NoError(t, err)
+	return count
+}
+
+func TestWritesRecordEventsRelayedInOrder(t *testing.T) {
+	s := newOutboxStorage(t)
+	ctx := context.Background()
+	post := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}
+	require.NoError(t, s.Save(ctx, post))
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	require.Equal(t, int64(2), countOutbox(t, s))
+
+	publisher := &recordingPublisher{}
+	relayed, err := s.NewRelay(publisher, DefaultRelayOptions()).relay(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, relayed)
+	require.Len(t, publisher.events, 2)
+	require.Equal(t, storage2.EventPostCreated, publisher.events[0].Type)
+	require.Equal(t, "first", publisher.events[0].Post.Text)
+	require.Equal(t, storage2.EventPostUpdated, publisher.events[1].Type)
+	require.Equal(t, "edited", publisher.events[1].Post.Text)
+	require.Zero(t, countOutbox(t, s))
+}
+
+func TestFailedWritesRecordNoEvents(t *testing.T) {
+	s := newOutboxStorage(t)
+	ctx := context.Background()
+	post := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}
+	require.NoError(t, s.Save(ctx, post))
+
+	require.ErrorIs(t, s.Save(ctx, post), storage2.ErrorCollision)
+	missing := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "missing"}
+	require.ErrorIs(t, s.Update(ctx, missing), storage2.ErrorNotFound)
+	require.Equal(t, int64(1), countOutbox(t, s))
+}
+
+func TestEventsStayInOutboxUntilPublished(t *testing.T) {
+	s := newOutboxStorage(t)
+	ctx := context.Background()
+	require.NoError(t, s.Save(ctx, storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}))
+	publisher := &recordingPublisher{err: errors.New("unavailable")}
+	relay := s.NewRelay(publisher, DefaultRelayOptions())
+
+	_, err := relay.relay(ctx)
+	require.Error(t, err)
+	require.Equal(t, int64(1), countOutbox(t, s))
+
+	publisher.err = nil
+	relayed, err := relay.relay(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, relayed)
+}
+
+func TestOnlyOneRelayRelays(t *testing.T) {
+	s := newOutboxStorage(t)
+	ctx := context.Background()
+	require.NoError(t, s.Save(ctx, storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}))
+	active := s.NewRelay(&recordingPublisher{}, DefaultRelayOptions())
+	standby := s.NewRelay(&recordingPublisher{}, DefaultRelayOptions())
+
+	_, err := active.relay(ctx)
+	require.NoError(t, err)
+	require.NoError(t, s.Save(ctx, storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "second"}))
+	relayed, err := standby.relay(ctx)
+	require.NoError(t, err)
+	require.Zero(t, relayed)
+
+	// the lease of a crashed relay expires
+	standby.lease.now = func() time.Time { return time.Now().Add(DefaultRelayOptions().LeaseTTL) }
+	relayed, err = standby.relay(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, relayed)
+}
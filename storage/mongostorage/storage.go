@@ -7,62 +7,95 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	_ "go.mongodb.org/mongo-driver/mongo/description"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	_ "go.mongodb.org/mongo-driver/mongo/readconcern"
-	_ "go.mongodb.org/mongo-driver/mongo/readpref"
-	_ "go.mongodb.org/mongo-driver/mongo/writeconcern"
-	"go.mongodb.org/mongo-driver/x/bsonx"
-	"time"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/contrib/instrumentation/go.mongodb.org/mongo-driver/mongo/otelmongo"
 	storage2 "twitter/storage"
 )
 
 const dbName = "blog_app_db"
 const collectionName = "posts"
+const outboxCollectionName = "outbox"
 
 type storage struct {
-	posts *mongo.Collection
+	client *mongo.Client
+	posts  *mongo.Collection
+	// timelines and saves are posts with the read preference and the write
+	// concern of their queries.
+	timelines *mongo.Collection
+	saves     *mongo.Collection
+	// outbox is nil unless writes record events.
+	outbox *mongo.Collection
 }
 
-func DatabaseStorage(mongoUrl string) *storage {
-	ctx := context.Background()
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoUrl))
+// DatabaseStorage creates a client of the database. The server is not
+// contacted yet, so invalid options are the only failure. The schema is not
+// touched, it is brought up to date by the Migrator.
+func DatabaseStorage(ctx context.Context, opts Options) (*storage, error) {
+	client, err := mongo.Connect(ctx, opts.client().SetMonitor(otelmongo.NewMonitor()))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to create mongo client - %w", err)
 	}
 
-	collection := client.Database(dbName).Collection(collectionName)
-	ensureIndexes(ctx, collection)
-
-	return &storage{
-		posts: collection,
+	posts := client.Database(dbName).Collection(collectionName)
+	timelines, err := posts.Clone(options.Collection().SetReadPreference(opts.TimelineReadPreference))
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeline read preference - %w", err)
 	}
-}
-
-func ensureIndexes(ctx context.Context, collection *mongo.Collection) {
-	indexModels := []mongo.IndexModel{
-		{
-			Keys: bsonx.Doc{
-				{Key: "authorId", Value: bsonx.Int32(1)},
-				{Key: "_id", Value: bsonx.Int32(-1)},
-			},
-		},
-	}
-	opts := options.CreateIndexes().SetMaxTime(10 * time.Second)
-	_, err := collection.Indexes().CreateMany(ctx, indexModels, opts)
+	saves, err := posts.Clone(options.Collection().SetWriteConcern(opts.SaveWriteConcern))
 	if err != nil {
-		panic(fmt.Errorf("failed to ensure indexes - %w", err))
+		return nil, fmt.Errorf("invalid save write concern - %w", err)
+	}
+	s := &storage{
+		client:    client,
+		posts:     posts,
+		timelines: timelines,
+		saves:     saves,
 	}
+	if opts.Outbox {
+		s.outbox = client.Database(dbName).Collection(outboxCollectionName)
+	}
+	return s, nil
+}
+
+func (s *storage) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
+
+// Migrator migrates the database of the storage.
+func (s *storage) Migrator() *Migrator {
+	return NewMigrator(s.client.Database(dbName), migrations)
+}
+
+func (s *storage) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
 }
 
 func (s *storage) Save(ctx context.Context, data storage2.PostData) error {
+	if s.outbox == nil {
+		return s.insertPost(ctx, data)
+	}
+	return s.WithinTransaction(ctx, func(ctx context.Context) error {
+		err := s.insertPost(ctx, data)
+		if err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, storage2.EventPostCreated, data)
+	})
+}
+
+func (s *storage) insertPost(ctx context.Context, data storage2.PostData) error {
 	for attempt := 0; attempt < 5; attempt++ {
-		_, err := s.posts.InsertOne(ctx, data)
+		_, err := s.saves.InsertOne(ctx, data)
 		if err != nil {
 			if mongo.IsDuplicateKeyError(err) {
+				if mongo.SessionFromContext(ctx) != nil {
+					// the error aborted the transaction, it cannot be retried
+					break
+				}
 				continue
 			}
-			return fmt.Errorf("something went wrong - %w", storage2.CommonStorageError)
+			return storage2.NewDatabaseError("failed to insert post", err)
 		}
 
 		return nil
@@ -74,7 +107,7 @@ func (s *storage) GetPostById(ctx context.Context, id string) (storage2.PostData
 	var result storage2.PostData
 	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return storage2.PostData{}, fmt.Errorf("invalid id - %w", storage2.CommonStorageError)
+		return storage2.PostData{}, fmt.Errorf("invalid id %v - %w", id, storage2.ErrorInvalidId)
 	}
 	err = s.posts.FindOne(ctx, bson.M{"_id": objectId}).Decode(&result)
 
@@ -82,37 +115,79 @@ func (s *storage) GetPostById(ctx context.Context, id string) (storage2.PostData
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return storage2.PostData{}, fmt.Errorf("no posts with id %v - %w", id, storage2.ErrorNotFound)
 		}
-		return storage2.PostData{}, fmt.Errorf("something went wrong - %w", storage2.CommonStorageError)
+		return storage2.PostData{}, storage2.NewDatabaseError("failed to find post", err)
 	}
 	return result, nil
 }
 
+func (s *storage) GetPostsByIds(ctx context.Context, ids []string) ([]storage2.PostData, error) {
+	objectIds := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objectId, err := primitive.ObjectIDFromHex(id)
+		if err == nil {
+			objectIds = append(objectIds, objectId)
+		}
+	}
+	if len(objectIds) == 0 {
+		return []storage2.PostData{}, nil
+	}
+
+	cursor, err := s.posts.Find(ctx, bson.M{"_id": bson.M{"$in": objectIds}})
+	if err != nil {
+		return nil, storage2.NewDatabaseError("failed to find posts", err)
+	}
+	var found []storage2.PostData
+	err = cursor.All(ctx, &found)
+	if err != nil {
+		return nil, storage2.NewDatabaseError("failed to read posts", err)
+	}
+
+	postsById := make(map[primitive.ObjectID]storage2.PostData, len(found))
+	for _, post := range found {
+		postsById[primitive.ObjectID(post.Id)] = post
+	}
+	posts := make([]storage2.PostData, 0, len(found))
+	for _, objectId := range objectIds {
+		post, ok := postsById[objectId]
+		if ok {
+			posts = append(posts, post)
+			delete(postsById, objectId)
+		}
+	}
+	return posts, nil
+}
+
 func (s *storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage2.PostsByUser, error) {
 	var posts []storage2.PostData
 	var post storage2.PostData
 	opts := options.Find()
 	opts.SetSort(bson.D{
-		{"authorId", 1},
-		{"_id", -1},
+		{Key: "authorId", Value: 1},
+		{Key: "_id", Value: -1},
 	})
 	opts.SetLimit(int64(pageSize))
+	timelines := s.timelines
+	if storage2.PrimaryReadsRequired(ctx) {
+		timelines = s.posts
+	}
 	var cursor *mongo.Cursor
 	var err error
 	if pageId == "" {
-		cursor, err = s.posts.Find(ctx, bson.M{"authorId": userId}, opts)
+		cursor, err = timelines.Find(ctx, bson.M{"authorId": userId}, opts)
 	} else {
-		objectId, err := primitive.ObjectIDFromHex(pageId)
+		var objectId primitive.ObjectID
+		objectId, err = primitive.ObjectIDFromHex(pageId)
 		if err != nil {
-			return storage2.PostsByUser{}, fmt.Errorf("invalid id - %w", storage2.CommonStorageError)
+			return storage2.PostsByUser{}, fmt.Errorf("invalid page id %v - %w", pageId, storage2.ErrorInvalidPage)
 		}
-		cursor, err = s.posts.Find(ctx, bson.M{"authorId": userId, "_id": bson.M{"$lt": objectId}}, opts)
+		cursor, err = timelines.Find(ctx, bson.M{"authorId": userId, "_id": bson.M{"$lt": objectId}}, opts)
 	}
 
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
 			return storage2.PostsByUser{}, fmt.Errorf("no posts with userId %v and pageId %v - %w", userId, pageId, storage2.ErrorNotFound)
 		}
-		return storage2.PostsByUser{}, fmt.Errorf("something went wrong - %w", storage2.CommonStorageError)
+		return storage2.PostsByUser{}, storage2.NewDatabaseError("failed to find posts of user", err)
 	}
 	hasPost := false
 	for cursor.Next(ctx) {
@@ -126,20 +201,38 @@ func (s *storage) GetPostsByUserId(ctx context.Context, userId string, pageSize
 		posts = append(posts, post)
 	}
 	if !hasPost {
-		return storage2.PostsByUser{Posts: posts, NextPageId: primitive.NilObjectID}, nil
+		return storage2.PostsByUser{Posts: posts, NextPageId: storage2.NilPostID}, nil
 	} else {
 		return storage2.PostsByUser{Posts: posts, NextPageId: post.Id}, nil
 	}
 }
 
+// Update fails with ErrorNotFound when no post has the id, so no event is
+// recorded for a missing post.
 func (s *storage) Update(ctx context.Context, data storage2.PostData) error {
+	if s.outbox == nil {
+		return s.updatePost(ctx, data)
+	}
+	return s.WithinTransaction(ctx, func(ctx context.Context) error {
+		err := s.updatePost(ctx, data)
+		if err != nil {
+			return err
+		}
+		return s.recordEvent(ctx, storage2.EventPostUpdated, data)
+	})
+}
+
+func (s *storage) updatePost(ctx context.Context, data storage2.PostData) error {
 	update := bson.D{
-		{"$set", bson.M{"text": data.Text}},
-		{"$set", bson.M{"lastModifiedAt": data.LastModifiedAt}},
+		{Key: "$set", Value: bson.M{"text": data.Text}},
+		{Key: "$set", Value: bson.M{"lastModifiedAt": data.LastModifiedAt}},
 	}
-	_, err := s.posts.UpdateByID(ctx, data.Id, update)
+	result, err := s.posts.UpdateByID(ctx, data.Id, update)
 	if err != nil {
-		return fmt.Errorf("something went wrong - %w, %v", storage2.CommonStorageError, err)
+		return storage2.NewDatabaseError("failed to update post", err)
+	}
+	if result.MatchedCount == 0 {
+		return fmt.Errorf("no posts with id %v - %w", data.Id.Hex(), storage2.ErrorNotFound)
 	}
 	return nil
 }
@@ -0,0 +1,13 @@
+package mongostorage
+
+import (
+	"testing"
+	storage2 "twitter/storage"
+	"twitter/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) storage2.Storage {
+		return newTestStorage(t)
+	})
+}
@@ -0,0 +1,40 @@
+package mongostorage
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	storage2 "twitter/storage"
+)
+
+// WithinTransaction runs fn in a session transaction, which needs a replica
+// set or a sharded cluster. The driver retries the whole transaction on
+// transient errors and the commit on unknown commit results.
+func (s *storage) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if session := mongo.SessionFromContext(ctx); session != nil {
+		return fn(ctx)
+	}
+	session, err := s.client.StartSession()
+	if err != nil {
+		return storage2.NewDatabaseError("failed to start session", err)
+	}
+	defer session.EndSession(ctx)
+
+	var fnErr error
+	_, err = session.WithTransaction(ctx, func(sessionCtx mongo.SessionContext) (interface{}, error) {
+		fnErr = fn(sessionCtx)
+		return nil, fnErr
+	}, options.Transaction().
+		SetReadConcern(readconcern.Snapshot()).
+		SetWriteConcern(writeconcern.New(writeconcern.WMajority())).
+		SetReadPreference(readpref.Primary()))
+	if err != nil && fnErr == nil {
+		return storage2.NewDatabaseError("failed to commit transaction", err)
+	}
+	return err
+}
+
+var _ storage2.Transactor = (*storage)(nil)
@@ -0,0 +1,55 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"testing"
+	storage2 "twitter/storage"
+)
+
+func TestStorageErrorKeepsDriverError(t *testing.T) {
+	cause := mongo.CommandError{Code: 112, Labels: []string{"TransientTransactionError"}}
+	err := fmt.Errorf("saving - %w", storage2.NewDatabaseError("failed to insert post", cause))
+
+	require.ErrorIs(t, err, storage2.CommonStorageError)
+	require.False(t, errors.Is(err, storage2.ErrorNotFound))
+	var commandError mongo.CommandError
+	require.True(t, errors.As(err, &commandError))
+	require.True(t, commandError.HasErrorLabel("TransientTransactionError"))
+}
+
+// newTestStorage needs a MongoDB replica set, its address is taken from
+// MONGO_URL.
+func newTestStorage(t *testing.T) *storage {
+	db := newTestDatabase(t)
+	posts := db.Collection(collectionName)
+	s := &storage{client: db.Client(), posts: posts, timelines: posts, saves: posts}
+	_, err := NewMigrator(db, Migrations()).Up(context.Background(), 0, false)
+	require.NoError(t, err)
+	return s
+}
+
+func TestTransactionCommitsAndRollsBack(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	committed := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "committed"}
+	discarded := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "discarded"}
+	failure := errors.New("failed")
+
+	require.NoError(t, s.WithinTransaction(ctx, func(ctx context.Context) error {
+		return s.Save(ctx, committed)
+	}))
+	err := s.WithinTransaction(ctx, func(ctx context.Context) error {
+		require.NoError(t, s.Save(ctx, discarded))
+		return failure
+	})
+	require.ErrorIs(t, err, failure)
+
+	_, err = s.GetPostById(ctx, committed.Id.Hex())
+	require.NoError(t, err)
+	_, err = s.GetPostById(ctx, discarded.Id.Hex())
+	require.ErrorIs(t, err, storage2.ErrorNotFound)
+}
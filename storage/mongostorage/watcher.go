@@ -0,0 +1,236 @@
+package mongostorage
+
+import (
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+	"twitter/logging"
+	storage2 "twitter/storage"
+)
+
+const (
+	resumeTokensCollectionName  = "change_stream_tokens"
+	watcherLeaseCollectionName  = "change_stream_watchers"
+	errorCodeChangeStreamLost   = 286
+	errorCodeInvalidResumeToken = 260
+)
+
+type WatcherOptions struct {
+	// Name identifies the resume token, watchers with the same name share
+	// it and one of them watches at a time.
+	Name string
+	// BatchSize is the maximal number of changes handled at once.
+	BatchSize int
+	// MaxAwaitTime is how long the server waits for changes before
+	// answering, the lease is extended after every answer.
+	MaxAwaitTime time.Duration
+	// RetryDelay is how long the watcher waits after a failure.
+	RetryDelay time.Duration
+	// LeaseTTL bounds how long a crashed watcher keeps others from
+	// watching, it must be much longer than MaxAwaitTime.
+	LeaseTTL time.Duration
+}
+
+func DefaultWatcherOptions(name string) WatcherOptions {
+	return WatcherOptions{
+		Name:         name,
+		BatchSize:    100,
+		MaxAwaitTime: time.Second,
+		RetryDelay:   time.Second,
+		LeaseTTL:     30 * time.Second,
+	}
+}
+
+// Watcher passes changes of posts from the change stream of the collection
+// to a handler, which needs a replica set. The resume token of the last
+// handled change is kept in the database, so a restarted watcher continues
+// where the previous one stopped, on this or another instance, as long as
+// the oplog still has the changes.
+type Watcher struct {
+	storage *storage
+	handler storage2.ChangeHandler
+	options WatcherOptions
+	tokens  *mongo.Collection
+	lease   *lease
+}
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		Id primitive.ObjectID `bson:"_id"`
+	} `bson:"documentKey"`
+	// FullDocument is missing for deletes and for updates of posts deleted
+	// meanwhile.
+	FullDocument *struct {
+		AuthorId string `bson:"authorId"`
+	} `bson:"fullDocument"`
+}
+
+type resumeToken struct {
+	Name    string    `bson:"_id"`
+	Token   bson.Raw  `bson:"token"`
+	SavedAt time.Time `bson:"savedAt"`
+}
+
+func (s *storage) NewWatcher(handler storage2.ChangeHandler, options WatcherOptions) *Watcher {
+	db := s.posts.Database()
+	return &Watcher{
+		storage: s,
+		handler: handler,
+		options: options,
+		tokens:  db.Collection(resumeTokensCollectionName),
+		lease:   newLease(db.Collection(watcherLeaseCollectionName), options.Name, options.LeaseTTL),
+	}
+}
+
+// Run watches changes until ctx is done.
+func (w *Watcher) Run(ctx context.Context) {
+	logger := logging.FromContext(ctx).With("watcher", w.options.Name)
+	defer func() {
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := w.lease.release(releaseCtx)
+		if err != nil {
+			logger.Warn("failed to release change stream lease", "error", err)
+		}
+	}()
+	for {
+		acquired, err := w.lease.acquire(ctx)
+		if err == nil && acquired {
+			err = w.watch(ctx)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("change stream failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.options.RetryDelay):
+		}
+	}
+}
+
+// watch handles changes while the watcher holds the lease. A token is saved
+// only after its changes are handled, so a failure makes them handled again.
+func (w *Watcher) watch(ctx context.Context) error {
+	token, err := w.loadToken(ctx)
+	if err != nil {
+		return err
+	}
+	streamOptions := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetMaxAwaitTime(w.options.MaxAwaitTime).
+		SetBatchSize(int32(w.options.BatchSize))
+	if token != nil {
+		streamOptions.SetResumeAfter(token)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}}}}},
+	}
+	stream, err := w.storage.posts.Watch(ctx, pipeline, streamOptions)
+	if isLostResumeToken(err) {
+		// changes between the token and now are lost, the caches catch up
+		// as entries expire
+		logging.FromContext(ctx).Error("change stream cannot resume, changes were missed", "watcher", w.options.Name, "error", err)
+		return w.dropToken(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for {
+		var changes []storage2.PostChange
+		for len(changes) < w.options.BatchSize && stream.TryNext(ctx) {
+			var event changeEvent
+			err = stream.Decode(&event)
+			if err != nil {
+				return err
+			}
+			changes = append(changes, postChange(event))
+		}
+		if err = stream.Err(); err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			err = w.handler.HandlePostChanges(ctx, changes)
+			if err != nil {
+				return err
+			}
+		}
+		// the token moves on without changes as well, saving it keeps it
+		// within the oplog window
+		if next := stream.ResumeToken(); next != nil && !bytesEqual(next, token) {
+			err = w.saveToken(ctx, next)
+			if err != nil {
+				return err
+			}
+			token = next
+		}
+		acquired, err := w.lease.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return errors.New("change stream lease was taken over")
+		}
+	}
+}
+
+func postChange(event changeEvent) storage2.PostChange {
+	change := storage2.PostChange{
+		PostId:  event.DocumentKey.Id.Hex(),
+		Deleted: event.OperationType == "delete",
+	}
+	if event.FullDocument != nil {
+		change.AuthorId = event.FullDocument.AuthorId
+	}
+	return change
+}
+
+func (w *Watcher) loadToken(ctx context.Context) (bson.Raw, error) {
+	var saved resumeToken
+	err := w.tokens.FindOne(ctx, bson.M{"_id": w.options.Name}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, storage2.NewDatabaseError("failed to load resume token", err)
+	}
+	return saved.Token, nil
+}
+
+func (w *Watcher) saveToken(ctx context.Context, token bson.Raw) error {
+	_, err := w.tokens.ReplaceOne(ctx, bson.M{"_id": w.options.Name},
+		resumeToken{Name: w.options.Name, Token: token, SavedAt: time.Now().UTC()},
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return storage2.NewDatabaseError("failed to save resume token", err)
+	}
+	return nil
+}
+
+func (w *Watcher) dropToken(ctx context.Context) error {
+	_, err := w.tokens.DeleteOne(ctx, bson.M{"_id": w.options.Name})
+	if err != nil {
+		return storage2.NewDatabaseError("failed to drop resume token", err)
+	}
+	return nil
+}
+
+func isLostResumeToken(err error) bool {
+	var commandError mongo.CommandError
+	return errors.As(err, &commandError) &&
+		(commandError.Code == errorCodeChangeStreamLost || commandError.Code == errorCodeInvalidResumeToken)
+}
+
+func bytesEqual(a, b bson.Raw) bool {
+	return string(a) == string(b)
+}
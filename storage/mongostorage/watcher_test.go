@@ -0,0 +1,99 @@
+package mongostorage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+	"testing"
+	"time"
+	storage2 "twitter/storage"
+)
+
+type recordingHandler struct {
+	mu      sync.Mutex
+	changes []storage2.PostChange
+}
+
+func (h *recordingHandler) HandlePostChanges(ctx context.Context, changes []storage2.PostChange) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.changes = append(h.changes, changes...)
+	return nil
+}
+
+func (h *recordingHandler) postIds() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]string, 0, len(h.changes))
+	for _, change := range h.changes {
+		ids = append(ids, change.PostId)
+	}
+	return ids
+}
+
+func TestPostChangeFromEvents(t *testing.T) {
+	id := primitive.NewObjectID()
+	var updated changeEvent
+	raw, err := bson.Marshal(bson.M{
+		"operationType": "update",
+		"documentKey":   bson.M{"_id": id},
+		"fullDocument":  bson.M{"_id": id, "authorId": "user1", "text": "edited"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, bson.Unmarshal(raw, &updated))
+	require.Equal(t, storage2.PostChange{PostId: id.Hex(), AuthorId: "user1"}, postChange(updated))
+
+	var deleted changeEvent
+	raw, err = bson.Marshal(bson.M{"operationType": "delete", "documentKey": bson.M{"_id": id}})
+	require.NoError(t, err)
+	require.NoError(t, bson.Unmarshal(raw, &deleted))
+	require.Equal(t, storage2.PostChange{PostId: id.Hex(), Deleted: true}, postChange(deleted))
+}
+
+func TestWatcherResumesAfterRestart(t *testing.T) {
+	s := newTestStorage(t)
+	ctx := context.Background()
+	handler := &recordingHandler{}
+	options := DefaultWatcherOptions("test")
+	options.MaxAwaitTime = 100 * time.Millisecond
+	options.RetryDelay = 100 * time.Millisecond
+
+	run := func() context.CancelFunc {
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			s.NewWatcher(handler, options).Run(runCtx)
+			close(done)
+		}()
+		return func() {
+			cancel()
+			<-done
+		}
+	}
+	// the first run starts from now, the token it saves is where the
+	// second run resumes
+	stop := run()
+	time.Sleep(500 * time.Millisecond)
+	first := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "first"}
+	require.NoError(t, s.Save(ctx, first))
+	require.Eventually(t, func() bool { return len(handler.postIds()) == 1 }, 5*time.Second, 50*time.Millisecond)
+	stop()
+
+	second := storage2.PostData{Id: idGenerator.NewPostID(), AuthorId: "user1", Text: "second"}
+	_, err := s.posts.InsertOne(ctx, second)
+	require.NoError(t, err)
+	_, err = s.posts.DeleteOne(ctx, bson.M{"_id": first.Id})
+	require.NoError(t, err)
+
+	stop = run()
+	defer stop()
+	require.Eventually(t, func() bool { return len(handler.postIds()) == 3 }, 5*time.Second, 50*time.Millisecond)
+	require.Equal(t, []string{first.Id.Hex(), second.Id.Hex(), first.Id.Hex()}, handler.postIds())
+	require.Equal(t, []storage2.PostChange{
+		{PostId: first.Id.Hex(), AuthorId: "user1"},
+		{PostId: second.Id.Hex(), AuthorId: "user1"},
+		{PostId: first.Id.Hex(), Deleted: true},
+	}, handler.changes)
+}
@@ -0,0 +1,26 @@
+package postgresstorage
+
+// migrations run in the order of versions. A released migration is never
+// edited, a mistake in it is fixed by the next one.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create posts table indexed by author and id",
+		// keyset pagination compares ids, which must sort as their bytes do
+		// whatever the collation of the database
+		Up: `CREATE TABLE posts (
+			id CHAR(24) COLLATE "C" PRIMARY KEY CHECK (id ~ '^[0-9a-f]{24}$'),
+			author_id TEXT NOT NULL,
+			text TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			last_modified_at TEXT NOT NULL
+		);
+		CREATE INDEX posts_author_id_id_idx ON posts (author_id, id DESC);`,
+		Down: `DROP TABLE posts;`,
+	},
+}
+
+// Migrations returns the migrations of the storage.
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
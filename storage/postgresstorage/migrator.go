@@ -0,0 +1,213 @@
+package postgresstorage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+	"twitter/logging"
+	"twitter/storage/migration"
+)
+
+// migrationLockKey identifies the advisory lock taken while migrating.
+const migrationLockKey = 7243102815
+
+// Migration is a versioned change of the database schema. Up and Down are
+// SQL statements run in a transaction along with recording the migration,
+// so a failed migration leaves nothing behind. Down is empty for migrations
+// which cannot be reverted.
+type Migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// Migrator applies migrations to a database and records applied ones in the
+// schema_migrations table. Instances sharing the database take an advisory
+// lock, so only one of them migrates at a time.
+type Migrator struct {
+	db         *sql.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, migrations []Migration) *Migrator {
+	sorted := append([]Migration(nil), migrations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+	return &Migrator{db: db, migrations: sorted}
+}
+
+// Up applies pending migrations up to target version, see migration.Up. Every
+// migration runs in its own transaction. It returns the migrations it
+// applied, or would apply if dryRun is set.
+func (m *Migrator) Up(ctx context.Context, target int, dryRun bool) ([]migration.Header, error) {
+	return m.migrate(ctx, dryRun, migration.Up(target), func(ctx context.Context, conn *sql.Conn, step Migration) error {
+		return m.run(ctx, conn, step.Up, "applied migration", step,
+			`INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)`,
+			step.Version, step.Description, time.Now().UTC())
+	})
+}
+
+// Down reverts applied migrations above target version, see migration.Down.
+// It returns the migrations it reverted, or would revert if dryRun is set.
+func (m *Migrator) Down(ctx context.Context, target int, dryRun bool) ([]migration.Header, error) {
+	return m.migrate(ctx, dryRun, migration.Down(target), func(ctx context.Context, conn *sql.Conn, step Migration) error {
+		return m.run(ctx, conn, step.Down, "reverted migration", step,
+			`DELETE FROM schema_migrations WHERE version = $1`, step.Version)
+	})
+}
+
+// Status lists migrations known to this release along with whether the
+// database has them.
+func (m *Migrator) Status(ctx context.Context) ([]migration.Status, error) {
+	headers := m.headers()
+	err := migration.Validate(headers)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database - %w", err)
+	}
+	defer conn.Close()
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return migration.Statuses(headers, applied), nil
+}
+
+func (m *Migrator) migrate(ctx context.Context, dryRun bool, plan migration.Planner, run func(ctx context.Context, conn *sql.Conn, step Migration) error) ([]migration.Header, error) {
+	headers := m.headers()
+	err := migration.Validate(headers)
+	if err != nil {
+		return nil, err
+	}
+	// the advisory lock belongs to a session, so everything runs on one
+	// connection
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database - %w", err)
+	}
+	defer conn.Close()
+	if !dryRun {
+		release, err := m.lock(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		err = m.createTable(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the table is read under the lock to see migrations of other instances
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	return migration.Run(headers, applied, plan, dryRun, func(index int) error {
+		return run(ctx, conn, m.migrations[index])
+	})
+}
+
+func (m *Migrator) headers() []migration.Header {
+	headers := make([]migration.Header, len(m.migrations))
+	for i, step := range m.migrations {
+		headers[i] = migration.Header{
+			Version:     step.Version,
+			Description: step.Description,
+			HasUp:       step.Up != "",
+			HasDown:     step.Down != "",
+		}
+	}
+	return headers
+}
+
+// run executes statements of step and records the result with
+// recordQuery in one transaction.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, statements string, done string, step Migration, recordQuery string, recordArgs ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin migration %d - %w", step.Version, err)
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, statements)
+	if err != nil {
+		return fmt.Errorf("failed to run migration %d - %w", step.Version, err)
+	}
+	_, err = tx.ExecContext(ctx, recordQuery, recordArgs...)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d - %w", step.Version, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit migration %d - %w", step.Version, err)
+	}
+	logging.FromContext(ctx).Info(done, "version", step.Version, "description", step.Description)
+	return nil
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create migrations table - %w", err)
+	}
+	return nil
+}
+
+// applied returns application times of applied migrations by version.
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	var exists bool
+	err := conn.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+	}
+	if !exists {
+		return map[int]time.Time{}, nil
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err = rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations - %w", err)
+	}
+	return applied, nil
+}
+
+// lock waits until the migration lock is free and takes it. The server
+// releases it if the connection breaks.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) (func(), error) {
+	_, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to take migration lock - %w", err)
+	}
+	return func() {
+		// ctx may be cancelled by now, the unlock gets its own deadline
+		releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := conn.ExecContext(releaseCtx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to release migration lock", "error", err)
+		}
+	}, nil
+}
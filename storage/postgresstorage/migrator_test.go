@@ -0,0 +1,81 @@
+package postgresstorage
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+	"twitter/storage/migration"
+)
+
+func TestMigrationsAreValid(t *testing.T) {
+	require.NoError(t, migration.Validate(NewMigrator(nil, Migrations()).headers()))
+	require.Error(t, migration.Validate(NewMigrator(nil, []Migration{{Version: 1}}).headers()))
+}
+
+func TestIrreversibleMigrationIsNotPlannedDown(t *testing.T) {
+	headers := NewMigrator(nil, []Migration{{Version: 1, Up: "SELECT 1", Down: "SELECT 1"}, {Version: 2, Up: "SELECT 1"}}).headers()
+	_, err := migration.Down(1)(headers, map[int]time.Time{1: {}, 2: {}})
+	require.Error(t, err)
+}
+
+// newTestOptions needs a PostgreSQL server, its address is taken from
+// POSTGRES_URL. Every test gets its own schema.
+func newTestOptions(t *testing.T) Options {
+	postgresUrl := os.Getenv("POSTGRES_URL")
+	if postgresUrl == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	require.NoError(t, err)
+	schema := "storage_test_" + hex.EncodeToString(suffix)
+
+	admin, err := sql.Open("postgres", postgresUrl)
+	require.NoError(t, err)
+	_, err = admin.Exec(`CREATE SCHEMA ` + schema)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_, _ = admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+		_ = admin.Close()
+	})
+
+	parsed, err := url.Parse(postgresUrl)
+	require.NoError(t, err)
+	query := parsed.Query()
+	query.Set("search_path", schema)
+	parsed.RawQuery = query.Encode()
+	return DefaultOptions(parsed.String())
+}
+
+func TestMigratorAppliesAndReverts(t *testing.T) {
+	s, err := OpenStorage(newTestOptions(t))
+	require.NoError(t, err)
+	defer s.Close()
+	ctx := context.Background()
+	migrator := s.Migrator()
+
+	planned, err := migrator.Up(ctx, 0, true)
+	require.NoError(t, err)
+	require.Len(t, planned, len(migrations))
+	applied, err := migrator.Up(ctx, 0, false)
+	require.NoError(t, err)
+	require.Equal(t, planned, applied)
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		require.True(t, status.Applied)
+	}
+
+	reverted, err := migrator.Down(ctx, 0, false)
+	require.NoError(t, err)
+	require.Len(t, reverted, len(migrations))
+	var exists bool
+	require.NoError(t, s.db.QueryRow(`SELECT to_regclass('posts') IS NOT NULL`).Scan(&exists))
+	require.False(t, exists)
+}
@@ -0,0 +1,260 @@
+// Package postgresstorage stores posts in PostgreSQL. Ids keep the 24-hex
+// format of MongoDB object ids, so the backends are interchangeable.
+package postgresstorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"time"
+	"twitter/storage"
+)
+
+// uniqueViolation is the SQLSTATE of a duplicate key.
+const uniqueViolation = "23505"
+
+type Options struct {
+	URL             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func DefaultOptions(url string) Options {
+	return Options{
+		URL:             url,
+		MaxOpenConns:    20,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * time.Minute,
+	}
+}
+
+type Storage struct {
+	db *sql.DB
+}
+
+// querier is implemented by both the pool and transactions.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type transactionKey struct{}
+
+// OpenStorage does not connect to the server, connections are opened when
+// needed.
+func OpenStorage(options Options) (*Storage, error) {
+	db, err := sql.Open("postgres", options.URL)
+	if err != nil {
+		return nil, storage.NewDatabaseError("failed to open database", err)
+	}
+	db.SetMaxOpenConns(options.MaxOpenConns)
+	db.SetMaxIdleConns(options.MaxIdleConns)
+	db.SetConnMaxLifetime(options.ConnMaxLifetime)
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Migrator migrates the schema of the database of the storage.
+func (s *Storage) Migrator() *Migrator {
+	return NewMigrator(s.db, migrations)
+}
+
+// WithinTransaction runs fn in a read committed transaction. Calls within a
+// transaction join it.
+func (s *Storage) WithinTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(transactionKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.NewDatabaseError("failed to begin transaction", err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = tx.Rollback()
+		}
+	}()
+	err = fn(context.WithValue(ctx, transactionKey{}, tx))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return storage.NewDatabaseError("failed to commit transaction", err)
+	}
+	committed = true
+	return nil
+}
+
+func (s *Storage) querier(ctx context.Context) querier {
+	if tx, ok := ctx.Value(transactionKey{}).(*sql.Tx); ok {
+		return tx
+	}
+	return s.db
+}
+
+func (s *Storage) Save(ctx context.Context, data storage.PostData) error {
+	_, err := s.querier(ctx).ExecContext(ctx,
+		`INSERT INTO posts (id, author_id, text, created_at, last_modified_at) VALUES ($1, $2, $3, $4, $5)`,
+		data.Id.Hex(), data.AuthorId, data.Text, data.CreatedAt, data.LastModifiedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return fmt.Errorf("post %v already exists - %w", data.Id.Hex(), storage.ErrorCollision)
+	}
+	if err != nil {
+		return storage.NewDatabaseError("failed to insert post", err)
+	}
+	return nil
+}
+
+func (s *Storage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	postId, err := storage.ParsePostID(id)
+	if err != nil {
+		return storage.PostData{}, err
+	}
+	row := s.querier(ctx).QueryRowContext(ctx,
+		`SELECT id, author_id, text, created_at, last_modified_at FROM posts WHERE id = $1`, postId.Hex())
+	post, err := scanPost(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.PostData{}, fmt.Errorf("no posts with id %v - %w", id, storage.ErrorNotFound)
+	}
+	if err != nil {
+		return storage.PostData{}, storage.NewDatabaseError("failed to find post", err)
+	}
+	return post, nil
+}
+
+func (s *Storage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	hexIds := make([]string, 0, len(ids))
+	for _, id := range ids {
+		postId, err := storage.ParsePostID(id)
+		if err == nil {
+			hexIds = append(hexIds, postId.Hex())
+		}
+	}
+	if len(hexIds) == 0 {
+		return []storage.PostData{}, nil
+	}
+	found, err := s.queryPosts(ctx,
+		`SELECT id, author_id, text, created_at, last_modified_at FROM posts WHERE id = ANY($1)`, pq.Array(hexIds))
+	if err != nil {
+		return nil, err
+	}
+
+	postsById := make(map[string]storage.PostData, len(found))
+	for _, post := range found {
+		postsById[post.Id.Hex()] = post
+	}
+	posts := make([]storage.PostData, 0, len(found))
+	for _, id := range hexIds {
+		post, ok := postsById[id]
+		if ok {
+			posts = append(posts, post)
+			delete(postsById, id)
+		}
+	}
+	return posts, nil
+}
+
+// GetPostsByUserId returns posts of the user newest first. The next page id
+// is the id of the last returned post, the following page starts after it.
+// Fixed length lowercase hex ids sort as the object ids they encode.
+func (s *Storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	var posts []storage.PostData
+	var err error
+	if pageId == "" {
+		posts, err = s.queryPosts(ctx,
+			`SELECT id, author_id, text, created_at, last_modified_at FROM posts
+			WHERE author_id = $1 ORDER BY id DESC LIMIT $2`, userId, pageSize)
+	} else {
+		lastId, parseErr := storage.ParsePostID(pageId)
+		if parseErr != nil {
+			return storage.PostsByUser{}, fmt.Errorf("invalid page id %v - %w", pageId, storage.ErrorInvalidPage)
+		}
+		posts, err = s.queryPosts(ctx,
+			`SELECT id, author_id, text, created_at, last_modified_at FROM posts
+			WHERE author_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3`, userId, lastId.Hex(), pageSize)
+	}
+	if err != nil {
+		return storage.PostsByUser{}, err
+	}
+	if len(posts) == 0 {
+		return storage.PostsByUser{Posts: posts, NextPageId: storage.NilPostID}, nil
+	}
+	return storage.PostsByUser{Posts: posts, NextPageId: posts[len(posts)-1].Id}, nil
+}
+
+// Update changes the text and the modification time of the post, as
+// mongostorage does.
+func (s *Storage) Update(ctx context.Context, data storage.PostData) error {
+	result, err := s.querier(ctx).ExecContext(ctx,
+		`UPDATE posts SET text = $2, last_modified_at = $3 WHERE id = $1`,
+		data.Id.Hex(), data.Text, data.LastModifiedAt)
+	if err != nil {
+		return storage.NewDatabaseError("failed to update post", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return storage.NewDatabaseError("failed to update post", err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("no posts with id %v - %w", data.Id.Hex(), storage.ErrorNotFound)
+	}
+	return nil
+}
+
+func (s *Storage) queryPosts(ctx context.Context, query string, args ...interface{}) ([]storage.PostData, error) {
+	rows, err := s.querier(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, storage.NewDatabaseError("failed to find posts", err)
+	}
+	defer rows.Close()
+	var posts []storage.PostData
+	for rows.Next() {
+		post, err := scanPost(rows)
+		if err != nil {
+			return nil, storage.NewDatabaseError("failed to read posts", err)
+		}
+		posts = append(posts, post)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, storage.NewDatabaseError("failed to read posts", err)
+	}
+	return posts, nil
+}
+
+// scanner is implemented by sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(row scanner) (storage.PostData, error) {
+	var post storage.PostData
+	var id string
+	err := row.Scan(&id, &post.AuthorId, &post.Text, &post.CreatedAt, &post.LastModifiedAt)
+	if err != nil {
+		return storage.PostData{}, err
+	}
+	post.Id, err = storage.ParsePostID(id)
+	if err != nil {
+		return storage.PostData{}, err
+	}
+	return post, nil
+}
+
+var (
+	_ storage.Storage    = (*Storage)(nil)
+	_ storage.Transactor = (*Storage)(nil)
+)
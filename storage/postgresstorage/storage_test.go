@@ -0,0 +1,36 @@
+package postgresstorage
+
+import (
+	"context"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"twitter/storage"
+	"twitter/storage/storagetest"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.RunStorageTests(t, func(t *testing.T) storage.Storage {
+		s, err := OpenStorage(newTestOptions(t))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = s.Close() })
+		_, err = s.Migrator().Up(context.Background(), 0, false)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestOpenStorageDoesNotNeedServer(t *testing.T) {
+	s, err := OpenStorage(DefaultOptions("postgres://localhost:1/posts"))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+}
+
+func TestStorageErrorKeepsDriverError(t *testing.T) {
+	cause := &pq.Error{Code: uniqueViolation}
+	err := storage.NewDatabaseError("failed to insert post", cause)
+	require.ErrorIs(t, err, storage.CommonStorageError)
+	var pqErr *pq.Error
+	require.ErrorAs(t, err, &pqErr)
+	require.Equal(t, cause, pqErr)
+}
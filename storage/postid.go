@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"encoding/hex"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// PostID identifies a post. It is 12 bytes written as 24 lowercase hex
+// digits, the format of MongoDB object ids, so ids are the same in every
+// backend and stay valid when posts move between them. In BSON it is stored
+// as an object id.
+type PostID [12]byte
+
+// NilPostID is the zero PostID, it identifies no post.
+var NilPostID PostID
+
+// IdGenerator mints ids of new posts.
+type IdGenerator interface {
+	NewPostID() PostID
+}
+
+// ParsePostID parses the 24 hex digits of an id.
+func ParsePostID(s string) (PostID, error) {
+	var id PostID
+	if len(s) != 2*len(id) {
+		return NilPostID, fmt.Errorf("invalid id %q - %w", s, ErrorInvalidId)
+	}
+	_, err := hex.Decode(id[:], []byte(s))
+	if err != nil {
+		return NilPostID, fmt.Errorf("invalid id %q - %w", s, ErrorInvalidId)
+	}
+	return id, nil
+}
+
+func (id PostID) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id PostID) String() string {
+	return id.Hex()
+}
+
+func (id PostID) IsZero() bool {
+	return id == NilPostID
+}
+
+func (id PostID) MarshalText() ([]byte, error) {
+	return []byte(id.Hex()), nil
+}
+
+func (id *PostID) UnmarshalText(text []byte) error {
+	parsed, err := ParsePostID(string(text))
+	if err != nil {
+		return err
+	}
+	*id = parsed
+	return nil
+}
+
+func (id PostID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bsontype.ObjectID, id[:], nil
+}
+
+// UnmarshalBSONValue also accepts ids stored as hex strings.
+func (id *PostID) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bsontype.ObjectID:
+		if len(data) != len(id) {
+			return fmt.Errorf("invalid object id of %d bytes - %w", len(data), ErrorInvalidId)
+		}
+		copy(id[:], data)
+		return nil
+	case bsontype.String:
+		// a string is its length, its bytes and a trailing zero
+		if len(data) < 5 {
+			return fmt.Errorf("invalid string id - %w", ErrorInvalidId)
+		}
+		return id.UnmarshalText(data[4 : len(data)-1])
+	default:
+		return fmt.Errorf("cannot decode %v into an id - %w", t, ErrorInvalidId)
+	}
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"testing"
+)
+
+func TestParsePostID(t *testing.T) {
+	id, err := ParsePostID("62b0a5e1f1d2c3b4a5968778")
+	require.NoError(t, err)
+	require.Equal(t, "62b0a5e1f1d2c3b4a5968778", id.Hex())
+	for _, invalid := range []string{"", "UNKNOWNURL", "62b0a5e1f1d2c3b4a596877", "62b0a5e1f1d2c3b4a596877z"} {
+		_, err = ParsePostID(invalid)
+		require.ErrorIs(t, err, ErrorInvalidId, invalid)
+	}
+}
+
+func TestPostIDJsonMatchesObjectID(t *testing.T) {
+	objectId := primitive.NewObjectID()
+	id := PostID(objectId)
+	rawId, err := json.Marshal(id)
+	require.NoError(t, err)
+	rawObjectId, err := json.Marshal(objectId)
+	require.NoError(t, err)
+	require.Equal(t, string(rawObjectId), string(rawId))
+
+	var decoded PostID
+	require.NoError(t, json.Unmarshal(rawId, &decoded))
+	require.Equal(t, id, decoded)
+	require.Error(t, json.Unmarshal([]byte(`"UNKNOWNURL"`), &decoded))
+}
+
+func TestPostIDIsStoredAsObjectID(t *testing.T) {
+	post := PostData{Id: PostID(primitive.NewObjectID()), AuthorId: "user1"}
+	raw, err := bson.Marshal(post)
+	require.NoError(t, err)
+	var stored struct {
+		Id primitive.ObjectID `bson:"_id"`
+	}
+	require.NoError(t, bson.Unmarshal(raw, &stored))
+	require.Equal(t, post.Id, PostID(stored.Id))
+
+	var decoded PostData
+	require.NoError(t, bson.Unmarshal(raw, &decoded))
+	require.Equal(t, post, decoded)
+
+	raw, err = bson.Marshal(bson.M{"_id": post.Id.Hex()})
+	require.NoError(t, err)
+	decoded = PostData{}
+	require.NoError(t, bson.Unmarshal(raw, &decoded))
+	require.Equal(t, post.Id, decoded.Id)
+}
@@ -0,0 +1,77 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"twitter/cache"
+	"twitter/cache/memorycache"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+)
+
+// backendWithoutPubSub hides the pub/sub of the wrapped backend.
+type backendWithoutPubSub struct {
+	cache.Backend
+}
+
+func TestCachingWithInMemoryBackend(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	backend := memorycache.NewBackendWithClock(clock.Now)
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage()}
+	s := NewStorage(persistent, backend, nil, DefaultConfig())
+	s.now = clock.Now
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	for i := 0; i < 3; i++ {
+		result, err := s.GetPostById(ctx, post.Id.Hex())
+		require.NoError(t, err)
+		require.Equal(t, "first", result.Text)
+	}
+	require.Equal(t, 0, persistent.Loads())
+
+	clock.Advance(s.config.Post.TTL + s.config.Post.StaleTTL)
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, 1, persistent.Loads())
+
+	missing := newPost("user1", "").Id.Hex()
+	for i := 0; i < 2; i++ {
+		_, err = s.GetPostById(ctx, missing)
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+	}
+	require.Equal(t, 2, persistent.Loads())
+}
+
+func TestLocalCacheWithoutPubSubReliesOnTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	backend := backendWithoutPubSub{memorycache.NewBackendWithClock(clock.Now)}
+	config := DefaultConfig()
+	config.Local = LocalCacheConfig{MaxBytes: 1 << 20, TTL: time.Second}
+	persistent := inmemorystorage.NewStorage()
+	reader := NewStorage(persistent, backend, nil, config)
+	writer := NewStorage(persistent, backend, nil, config)
+	reader.now, writer.now = clock.Now, clock.Now
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// returns at once as there is nothing to listen to
+	reader.ListenForInvalidations(listenCtx)
+
+	post := newPost("user1", "first")
+	require.NoError(t, writer.Save(ctx, post))
+	_, err := reader.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	post.Text = "edited"
+	require.NoError(t, writer.Update(ctx, post))
+
+	result, err := reader.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+
+	clock.Advance(config.Local.TTL)
+	result, err = reader.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "edited", result.Text)
+}
@@ -0,0 +1,72 @@
+package rediscachedstorage
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"twitter/storage"
+)
+
+func TestGetPostsByIdsBackfillsMissesInOneQuery(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	cached, first, second := newPost("user1", "cached"), newPost("user1", "first"), newPost("user2", "second")
+	for _, post := range []storage.PostData{cached, first, second} {
+		require.NoError(t, persistent.Storage.Save(ctx, post))
+	}
+	_, err := s.GetPostById(ctx, cached.Id.Hex())
+	require.NoError(t, err)
+	missing := newPost("user1", "").Id.Hex()
+
+	ids := []string{first.Id.Hex(), cached.Id.Hex(), missing, second.Id.Hex(), first.Id.Hex()}
+	posts, err := s.GetPostsByIds(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{first, cached, second}, posts)
+	require.Equal(t, [][]string{{first.Id.Hex(), missing, second.Id.Hex()}}, persistent.Batches())
+
+	posts, err = s.GetPostsByIds(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{first, cached, second}, posts)
+	require.Len(t, persistent.Batches(), 1)
+
+	_, err = s.GetPostById(ctx, missing)
+	require.ErrorIs(t, err, storage.ErrorNotFound)
+	require.Equal(t, 1, persistent.Loads())
+}
+
+func TestGetPostsByIdsReadsPersistenceWhenCacheIsDown(t *testing.T) {
+	s, server, _ := newFaultTolerantStorage(t, DefaultConfig())
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	server.Close()
+
+	posts, err := s.GetPostsByIds(ctx, []string{post.Id.Hex(), "UNKNOWNURL"})
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{post}, posts)
+}
+
+func TestIdsAreCachedInCanonicalForm(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	upper := strings.ToUpper(post.Id.Hex())
+	mixed := strings.ToUpper(post.Id.Hex()[:12]) + post.Id.Hex()[12:]
+
+	posts, err := s.GetPostsByIds(ctx, []string{upper, mixed, post.Id.Hex()})
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{post}, posts)
+	result, err := s.GetPostById(ctx, upper)
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	result, err = s.GetPostById(ctx, mixed)
+	require.NoError(t, err)
+	require.Equal(t, "edited", result.Text)
+	posts, err = s.GetPostsByIds(ctx, []string{upper})
+	require.NoError(t, err)
+	require.Equal(t, []storage.PostData{post}, posts)
+	require.Equal(t, 0, persistent.Loads())
+	require.Empty(t, persistent.Batches())
+}
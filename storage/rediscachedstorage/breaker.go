@@ -0,0 +1,127 @@
+package rediscachedstorage
+
+import (
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+var breakerStateNames = map[breakerState]string{
+	breakerClosed:   "closed",
+	breakerHalfOpen: "half_open",
+	breakerOpen:     "open",
+}
+
+func (s breakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// circuitBreaker stops calls to the cache backend for a cool-down period
+// after FailureThreshold consecutive failures. After the cool-down a single
+// probe call is let through: its success closes the circuit, its failure
+// opens it again.
+type circuitBreaker struct {
+	mu             sync.Mutex
+	state          breakerState
+	failures       int
+	probeInFlight  bool
+	openedAt       time.Time
+	threshold      int
+	cooldown       time.Duration
+	now            func() time.Time
+	onStateChanged func(from, to breakerState)
+}
+
+func newCircuitBreaker(config CircuitBreakerConfig, now func() time.Time, onStateChanged func(from, to breakerState)) *circuitBreaker {
+	return &circuitBreaker{
+		state:          breakerClosed,
+		threshold:      config.FailureThreshold,
+		cooldown:       config.Cooldown,
+		now:            now,
+		onStateChanged: onStateChanged,
+	}
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probeInFlight = true
+		return true
+	case breakerHalfOpen:
+		if b.probeInFlight {
+			return false
+		}
+		b.probeInFlight = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.probeInFlight = false
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *circuitBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.probeInFlight = false
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// abandoned records a call given up by its caller, which says nothing about
+// the backend. A probe abandoned this way lets the next call probe again.
+func (b *circuitBreaker) abandoned() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probeInFlight = false
+}
+
+func (b *circuitBreaker) currentState() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	from := b.state
+	b.state = state
+	if b.onStateChanged != nil {
+		b.onStateChanged(from, state)
+	}
+}
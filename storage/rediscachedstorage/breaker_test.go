@@ -0,0 +1,101 @@
+package rediscachedstorage
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func newTestBreaker(clock *fakeClock) (*circuitBreaker, *[]breakerState) {
+	var transitions []breakerState
+	b := newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 3, Cooldown: time.Minute}, clock.Now, func(from, to breakerState) {
+		transitions = append(transitions, to)
+	})
+	return b, &transitions
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b, transitions := newTestBreaker(&fakeClock{})
+
+	b.failure()
+	b.failure()
+	b.success()
+	b.failure()
+	b.failure()
+	require.Equal(t, breakerClosed, b.currentState())
+	require.True(t, b.allow())
+
+	b.failure()
+	require.Equal(t, breakerOpen, b.currentState())
+	require.False(t, b.allow())
+	require.Equal(t, []breakerState{breakerOpen}, *transitions)
+}
+
+func TestBreakerLetsSingleProbeAfterCooldown(t *testing.T) {
+	clock := &fakeClock{}
+	b, transitions := newTestBreaker(clock)
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+
+	clock.Advance(time.Minute)
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+	require.Equal(t, breakerHalfOpen, b.currentState())
+
+	b.success()
+	require.Equal(t, breakerClosed, b.currentState())
+	require.True(t, b.allow())
+	require.Equal(t, []breakerState{breakerOpen, breakerHalfOpen, breakerClosed}, *transitions)
+}
+
+func TestBreakerReopensWhenProbeFails(t *testing.T) {
+	clock := &fakeClock{}
+	b, _ := newTestBreaker(clock)
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+	clock.Advance(time.Minute)
+	require.True(t, b.allow())
+
+	b.failure()
+
+	require.Equal(t, breakerOpen, b.currentState())
+	require.False(t, b.allow())
+}
+
+func TestAbandonedProbeLeavesBreakerHalfOpen(t *testing.T) {
+	clock := &fakeClock{}
+	b, transitions := newTestBreaker(clock)
+	for i := 0; i < 3; i++ {
+		b.failure()
+	}
+	clock.Advance(time.Minute)
+	require.True(t, b.allow())
+
+	b.abandoned()
+
+	require.Equal(t, breakerHalfOpen, b.currentState())
+	require.True(t, b.allow())
+	require.False(t, b.allow())
+	require.Equal(t, []breakerState{breakerOpen, breakerHalfOpen}, *transitions)
+}
+
+func TestAbandonedCallsDoNotResetFailures(t *testing.T) {
+	b, _ := newTestBreaker(&fakeClock{})
+	b.failure()
+	b.failure()
+
+	b.abandoned()
+	b.failure()
+
+	require.Equal(t, breakerOpen, b.currentState())
+}
+
+func TestDisabledBreakerAlwaysAllows(t *testing.T) {
+	b := newCircuitBreaker(CircuitBreakerConfig{}, time.Now, nil)
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	require.True(t, b.allow())
+}
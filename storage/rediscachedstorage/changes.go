@@ -0,0 +1,39 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"twitter/storage"
+)
+
+// HandlePostChanges drops cached posts and timelines affected by changes made
+// to the persistent storage by any writer, including ones bypassing this
+// cache. Changes made through the cache are dropped a second time, which
+// only costs an extra load. An error is returned when the cache fails, so
+// the changes are handled again instead of leaving stale entries behind.
+func (s *Storage) HandlePostChanges(ctx context.Context, changes []storage.PostChange) error {
+	keys := make([]string, 0, len(changes))
+	var authors []string
+	for _, change := range changes {
+		keys = append(keys, s.fullPostByIdKey(change.PostId))
+		if change.AuthorId != "" {
+			authors = append(authors, change.AuthorId)
+		}
+	}
+	keys = uniqueIds(keys)
+	err := s.guard(func() error {
+		return s.backend.Delete(ctx, keys...)
+	})
+	if err != nil {
+		return err
+	}
+	// timelines of deleted posts are not known and expire with their TTL
+	for _, author := range uniqueIds(authors) {
+		err = s.invalidateTimeline(ctx, author)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, s.timelineVersionKey(author))
+	}
+	s.invalidateLocal(ctx, keys...)
+	return nil
+}
@@ -0,0 +1,43 @@
+package rediscachedstorage
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"twitter/storage"
+)
+
+func TestHandlePostChangesDropsEntriesWrittenAround(t *testing.T) {
+	s, _ := newTestStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	_, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+
+	post.Text = "edited elsewhere"
+	require.NoError(t, s.persistentStorage.Update(ctx, post))
+	other := newPost("user1", "saved elsewhere")
+	require.NoError(t, s.persistentStorage.Save(ctx, other))
+	cached, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", cached.Text)
+
+	require.NoError(t, s.HandlePostChanges(ctx, []storage.PostChange{
+		{PostId: post.Id.Hex(), AuthorId: "user1"},
+		{PostId: other.Id.Hex(), AuthorId: "user1"},
+	}))
+
+	cached, err = s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "edited elsewhere", cached.Text)
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Posts, 2)
+}
+
+func TestHandlePostChangesFailsWithCache(t *testing.T) {
+	s, server := newTestStorage(t)
+	server.Close()
+
+	err := s.HandlePostChanges(ctx, []storage.PostChange{{PostId: newPost("user1", "").Id.Hex(), Deleted: true}})
+	require.Error(t, err)
+}
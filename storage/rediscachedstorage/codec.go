@@ -0,0 +1,329 @@
+package rediscachedstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+	"strings"
+	"sync"
+	"twitter/storage"
+)
+
+// Format identifies how cached values are serialized.
+type Format byte
+
+const (
+	FormatJson    Format = 1
+	FormatMsgpack Format = 2
+	FormatBinary  Format = 3
+)
+
+// Compression identifies how serialized values are compressed.
+type Compression byte
+
+const (
+	CompressionNone   Compression = 0
+	CompressionSnappy Compression = 1
+	CompressionZstd   Compression = 2
+)
+
+var errUnsupportedValue = errors.New("value is not supported by the codec")
+
+// Codec serializes cached values.
+type Codec interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+}
+
+var codecs = map[Format]Codec{
+	FormatJson:    jsonCodec{},
+	FormatMsgpack: msgpackCodec{},
+	FormatBinary:  binaryCodec{},
+}
+
+var formatNames = map[string]Format{
+	"json":    FormatJson,
+	"msgpack": FormatMsgpack,
+	"binary":  FormatBinary,
+}
+
+var compressionNames = map[string]Compression{
+	"none":   CompressionNone,
+	"snappy": CompressionSnappy,
+	"zstd":   CompressionZstd,
+}
+
+func ParseFormat(name string) (Format, error) {
+	format, ok := formatNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown cache format %q", name)
+	}
+	return format, nil
+}
+
+func ParseCompression(name string) (Compression, error) {
+	compression, ok := compressionNames[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown cache compression %q", name)
+	}
+	return compression, nil
+}
+
+// valueCodec prefixes every value with a version byte holding the format in
+// the low and the compression in the high four bits. Values are decoded by
+// their own version byte, so instances configured with different codecs can
+// share a cache backend while a new codec is rolled out.
+type valueCodec struct {
+	format      Format
+	compression Compression
+	threshold   int
+}
+
+func newValueCodec(config CodecConfig) valueCodec {
+	format := config.Format
+	if _, ok := codecs[format]; !ok {
+		format = FormatJson
+	}
+	return valueCodec{
+		format:      format,
+		compression: config.Compression,
+		threshold:   config.CompressionThreshold,
+	}
+}
+
+func (c valueCodec) encode(value interface{}) ([]byte, error) {
+	data, err := codecs[c.format].Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	compression := CompressionNone
+	if c.compression != CompressionNone && len(data) >= c.threshold {
+		compression = c.compression
+		data = compress(compression, data)
+	}
+	version := byte(c.format) | byte(compression)<<4
+	return append([]byte{version}, data...), nil
+}
+
+func (c valueCodec) decode(raw []byte, value interface{}) error {
+	if !readable(raw) {
+		return errMalformedEntry
+	}
+	format, compression := Format(raw[0]&0x0f), Compression(raw[0]>>4)
+	data, err := decompress(compression, raw[1:])
+	if err != nil {
+		return err
+	}
+	return codecs[format].Unmarshal(data, value)
+}
+
+// readable reports whether the version byte of raw is known, values written
+// before versioning or by newer instances are not.
+func readable(raw []byte) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	_, knownFormat := codecs[Format(raw[0]&0x0f)]
+	compression := Compression(raw[0] >> 4)
+	return knownFormat && compression <= CompressionZstd
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+}
+
+func compress(compression Compression, data []byte) []byte {
+	switch compression {
+	case CompressionSnappy:
+		return snappy.Encode(nil, data)
+	case CompressionZstd:
+		initZstd()
+		return zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data
+	}
+}
+
+func decompress(compression Compression, data []byte) ([]byte, error) {
+	switch compression {
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	case CompressionZstd:
+		initZstd()
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return data, nil
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (jsonCodec) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// msgpackCodec reuses json field names, so both formats describe values the
+// same way.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	encoder.UseCompactInts(true)
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, value interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(value)
+}
+
+// binaryCodec is a hand written encoding of posts and timeline pages: raw
+// object ids and length prefixed strings.
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case storage.PostData:
+		return appendPost(nil, v), nil
+	case *storage.PostData:
+		return appendPost(nil, *v), nil
+	case storage.PostsByUser:
+		return appendPosts(nil, v), nil
+	case *storage.PostsByUser:
+		return appendPosts(nil, *v), nil
+	default:
+		return nil, fmt.Errorf("%T - %w", value, errUnsupportedValue)
+	}
+}
+
+func (binaryCodec) Unmarshal(data []byte, value interface{}) error {
+	r := &binaryReader{data: data}
+	switch v := value.(type) {
+	case *storage.PostData:
+		*v = r.post()
+	case *storage.PostsByUser:
+		*v = r.posts()
+	default:
+		return fmt.Errorf("%T - %w", value, errUnsupportedValue)
+	}
+	if r.err == nil && len(r.data) != 0 {
+		r.err = errMalformedEntry
+	}
+	return r.err
+}
+
+func appendPost(buf []byte, post storage.PostData) []byte {
+	buf = append(buf, post.Id[:]...)
+	for _, s := range []string{post.Text, post.AuthorId, post.CreatedAt, post.LastModifiedAt} {
+		buf = appendUvarint(buf, uint64(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func appendPosts(buf []byte, posts storage.PostsByUser) []byte {
+	buf = append(buf, posts.NextPageId[:]...)
+	buf = appendUvarint(buf, uint64(len(posts.Posts)))
+	for _, post := range posts.Posts {
+		buf = appendPost(buf, post)
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return append(buf, tmp[:n]...)
+}
+
+// binaryReader remembers the first error, so values are read without
+// checking every field.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) postId() storage.PostID {
+	var id storage.PostID
+	if r.err != nil || len(r.data) < len(id) {
+		r.err = errMalformedEntry
+		return id
+	}
+	copy(id[:], r.data)
+	r.data = r.data[len(id):]
+	return id
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = errMalformedEntry
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *binaryReader) string() string {
+	length := r.uvarint()
+	if r.err != nil || uint64(len(r.data)) < length {
+		r.err = errMalformedEntry
+		return ""
+	}
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
+
+func (r *binaryReader) post() storage.PostData {
+	return storage.PostData{
+		Id:             r.postId(),
+		Text:           r.string(),
+		AuthorId:       r.string(),
+		CreatedAt:      r.string(),
+		LastModifiedAt: r.string(),
+	}
+}
+
+func (r *binaryReader) posts() storage.PostsByUser {
+	result := storage.PostsByUser{NextPageId: r.postId()}
+	count := r.uvarint()
+	// every post takes at least 16 bytes, which bounds the allocation
+	if r.err != nil || count > uint64(len(r.data)/16) {
+		r.err = errMalformedEntry
+		return storage.PostsByUser{}
+	}
+	result.Posts = make([]storage.PostData, 0, count)
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		result.Posts = append(result.Posts, r.post())
+	}
+	return result
+}
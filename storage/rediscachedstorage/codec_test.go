@@ -0,0 +1,177 @@
+package rediscachedstorage
+
+import (
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+	"twitter/cache/rediscache"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+)
+
+var (
+	testFormats      = []Format{FormatJson, FormatMsgpack, FormatBinary}
+	testCompressions = []Compression{CompressionNone, CompressionSnappy, CompressionZstd}
+)
+
+func newTestPage(size int) storage.PostsByUser {
+	page := storage.PostsByUser{NextPageId: idGenerator.NewPostID()}
+	for i := 0; i < size; i++ {
+		post := newPost("user1", strings.Repeat("lorem ipsum ", i%8+1))
+		post.CreatedAt = time.Now().String()
+		post.LastModifiedAt = post.CreatedAt
+		page.Posts = append(page.Posts, post)
+	}
+	return page
+}
+
+func TestCodecsRoundTripValues(t *testing.T) {
+	post := newPost("user1", "привет")
+	post.CreatedAt = time.Now().String()
+	page := newTestPage(20)
+	for _, format := range testFormats {
+		for _, compression := range testCompressions {
+			c := newValueCodec(CodecConfig{Format: format, Compression: compression})
+
+			rawPost, err := c.encode(post)
+			require.NoError(t, err)
+			var decodedPost storage.PostData
+			require.NoError(t, c.decode(rawPost, &decodedPost))
+			require.Equal(t, post, decodedPost)
+
+			rawPage, err := c.encode(page)
+			require.NoError(t, err)
+			var decodedPage storage.PostsByUser
+			require.NoError(t, c.decode(rawPage, &decodedPage))
+			require.Equal(t, page, decodedPage)
+		}
+	}
+}
+
+func TestCodecCompressesOnlyLargeValues(t *testing.T) {
+	c := newValueCodec(CodecConfig{Format: FormatJson, Compression: CompressionZstd, CompressionThreshold: 1024})
+
+	small, err := c.encode(newPost("user1", "short"))
+	require.NoError(t, err)
+	require.Equal(t, byte(FormatJson), small[0])
+
+	large, err := c.encode(newTestPage(100))
+	require.NoError(t, err)
+	require.Equal(t, byte(FormatJson)|byte(CompressionZstd)<<4, large[0])
+}
+
+func TestCodecRejectsUnknownVersions(t *testing.T) {
+	c := newValueCodec(DefaultConfig().Codec)
+	var post storage.PostData
+	for _, raw := range [][]byte{nil, []byte(`{"text":"legacy"}`), {0x0f, 1}, {0x31, 1}} {
+		require.ErrorIs(t, c.decode(raw, &post), errMalformedEntry)
+	}
+}
+
+func TestBinaryCodecRejectsTruncatedValues(t *testing.T) {
+	raw, err := binaryCodec{}.Marshal(newTestPage(3))
+	require.NoError(t, err)
+	for _, n := range []int{0, 11, 13, len(raw) - 1} {
+		var page storage.PostsByUser
+		require.ErrorIs(t, binaryCodec{}.Unmarshal(raw[:n], &page), errMalformedEntry)
+	}
+}
+
+func TestInstancesWithDifferentCodecsShareCache(t *testing.T) {
+	server := miniredis.RunT(t)
+	persistent := inmemorystorage.NewStorage()
+	startInstance := func(format Format, compression Compression) *Storage {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		config := DefaultConfig()
+		config.Codec = CodecConfig{Format: format, Compression: compression}
+		return NewStorage(persistent, rediscache.NewBackend(client), nil, config)
+	}
+	oldInstance := startInstance(FormatJson, CompressionNone)
+	newInstance := startInstance(FormatBinary, CompressionSnappy)
+	post := newPost("user1", "shared")
+
+	require.NoError(t, newInstance.Save(ctx, post))
+	result, err := oldInstance.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, post, result)
+}
+
+func TestValuesWrittenBeforeVersioningAreMisses(t *testing.T) {
+	s, server := newTestStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.persistentStorage.Save(ctx, post))
+	legacy := encodeEntry(entry{softExpiresAt: time.Now().Add(time.Minute), payload: []byte(`{"text":"legacy"}`)})
+	require.NoError(t, server.Set(s.fullPostByIdKey(post.Id.Hex()), string(legacy)))
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	values := []struct {
+		name  string
+		value interface{}
+	}{
+		{"post", newPost("user1", strings.Repeat("lorem ipsum ", 10))},
+		{"page_100", newTestPage(100)},
+	}
+	for _, v := range values {
+		for _, format := range testFormats {
+			for _, compression := range testCompressions {
+				c := newValueCodec(CodecConfig{Format: format, Compression: compression})
+				name := fmt.Sprintf("%s/%s/%s", v.name, formatName(format), compressionName(compression))
+				b.Run(name, func(b *testing.B) {
+					benchmarkCodec(b, c, v.value)
+				})
+			}
+		}
+	}
+}
+
+func benchmarkCodec(b *testing.B, c valueCodec, value interface{}) {
+	var raw []byte
+	var err error
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		raw, err = c.encode(value)
+		if err != nil {
+			b.Fatal(err)
+		}
+		switch value.(type) {
+		case storage.PostData:
+			var decoded storage.PostData
+			err = c.decode(raw, &decoded)
+		default:
+			var decoded storage.PostsByUser
+			err = c.decode(raw, &decoded)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(raw)), "bytes")
+}
+
+func formatName(format Format) string {
+	for name, f := range formatNames {
+		if f == format {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+func compressionName(compression Compression) string {
+	for name, c := range compressionNames {
+		if c == compression {
+			return name
+		}
+	}
+	return "unknown"
+}
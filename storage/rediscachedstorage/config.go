@@ -0,0 +1,135 @@
+package rediscachedstorage
+
+import "time"
+
+// FamilyConfig controls caching of one family of keys (single posts or
+// timeline pages).
+type FamilyConfig struct {
+	// TTL is how long a cached value is considered fresh.
+	TTL time.Duration
+	// StaleTTL is how long after TTL a value may still be served while it is
+	// refreshed in the background.
+	StaleTTL time.Duration
+	// Beta scales probabilistic early expiration: values are refreshed
+	// before TTL with a probability growing with the time it took to load
+	// them. Zero disables early expiration.
+	Beta float64
+	// LockTTL bounds how long one instance may hold the right to repopulate
+	// a key.
+	LockTTL time.Duration
+	// LockWait is how long a request that lost the lock waits for the value
+	// to appear before loading it by itself.
+	LockWait time.Duration
+	// NegativeTTL is how long the absence of a value is cached. It should be
+	// short: a negative entry hides a value created by another writer until
+	// it expires. Zero disables negative caching.
+	NegativeTTL time.Duration
+	// PrimaryReadWindow is how long after a write values are loaded from
+	// the primary of a replicated storage, so a replica lagging behind does
+	// not get the value without the write cached for TTL. It should exceed
+	// the replication lag. Zero loads values with the storage defaults.
+	PrimaryReadWindow time.Duration
+}
+
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive cache backend failures opening
+	// the circuit. Zero disables the circuit breaker.
+	FailureThreshold int
+	// Cooldown is how long the backend is not called after the circuit opens.
+	Cooldown time.Duration
+}
+
+// LocalCacheConfig controls the in-process cache in front of the backend.
+// Instances notify each other about written keys through backend pub/sub,
+// TTL bounds staleness when a notification is lost.
+type LocalCacheConfig struct {
+	// MaxBytes limits the total size of locally cached keys and values.
+	// Zero disables the local cache.
+	MaxBytes int64
+	TTL      time.Duration
+}
+
+// CodecConfig controls how values are written, values are read with the
+// codec they were written with.
+type CodecConfig struct {
+	Format      Format
+	Compression Compression
+	// CompressionThreshold is the minimal serialized size of a compressed
+	// value, smaller values are not worth it.
+	CompressionThreshold int
+}
+
+// WarmUpConfig controls filling the cache on startup with the first timeline
+// pages of the most active authors.
+type WarmUpConfig struct {
+	// Authors is the number of warmed timelines. Zero disables warming.
+	Authors int
+	// PageSize should match the page size requested by most clients.
+	PageSize int
+}
+
+// WriteBehindConfig controls flushing of posts updated in write-behind mode.
+type WriteBehindConfig struct {
+	// BatchSize is the maximal number of updates received at once.
+	BatchSize int
+	// Block is how long the flusher waits for new updates in one call.
+	Block time.Duration
+	// MaxAttempts is the number of failed flushes after which an update is
+	// dead-lettered.
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, it doubles with
+	// every next one.
+	RetryBackoff time.Duration
+}
+
+type Config struct {
+	Post           FamilyConfig
+	Timeline       FamilyConfig
+	CircuitBreaker CircuitBreakerConfig
+	Local          LocalCacheConfig
+	Codec          CodecConfig
+	WarmUp         WarmUpConfig
+	WriteBehind    WriteBehindConfig
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Post: FamilyConfig{
+			TTL:         10 * time.Second,
+			StaleTTL:    30 * time.Second,
+			Beta:        1,
+			LockTTL:     2 * time.Second,
+			LockWait:    200 * time.Millisecond,
+			NegativeTTL: 2 * time.Second,
+		},
+		Timeline: FamilyConfig{
+			TTL:               10 * time.Second,
+			StaleTTL:          10 * time.Second,
+			Beta:              1,
+			LockTTL:           2 * time.Second,
+			LockWait:          200 * time.Millisecond,
+			PrimaryReadWindow: 5 * time.Second,
+		},
+		CircuitBreaker: CircuitBreakerConfig{
+			FailureThreshold: 5,
+			Cooldown:         10 * time.Second,
+		},
+		Local: LocalCacheConfig{
+			TTL: time.Second,
+		},
+		Codec: CodecConfig{
+			Format:               FormatJson,
+			Compression:          CompressionNone,
+			CompressionThreshold: 1024,
+		},
+		WarmUp: WarmUpConfig{
+			PageSize: 10,
+		},
+		WriteBehind: WriteBehindConfig{
+			BatchSize:    32,
+			Block:        time.Second,
+			MaxAttempts:  5,
+			RetryBackoff: time.Second,
+		},
+	}
+}
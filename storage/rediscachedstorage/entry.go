@@ -0,0 +1,66 @@
+package rediscachedstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+const entryHeaderSize = 12
+
+var errMalformedEntry = errors.New("malformed cache entry")
+
+// negativePayload marks an entry caching the absence of a value. Encoded
+// values start with a non-zero version byte, so it can't collide with them.
+var negativePayload = []byte{0, 'n', 'f'}
+
+// entry is a cached value together with the moment it stops being fresh and
+// the time it took to compute, which drives probabilistic early expiration.
+// It is stored as a 12 byte header (expiration in unix milliseconds and
+// delta in milliseconds) followed by the encoded value.
+type entry struct {
+	softExpiresAt time.Time
+	delta         time.Duration
+	payload       []byte
+}
+
+func encodeEntry(e entry) []byte {
+	buf := make([]byte, entryHeaderSize+len(e.payload))
+	binary.BigEndian.PutUint64(buf[0:8], uint64(e.softExpiresAt.UnixNano()/int64(time.Millisecond)))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(e.delta.Milliseconds()))
+	copy(buf[entryHeaderSize:], e.payload)
+	return buf
+}
+
+func decodeEntry(raw []byte) (entry, error) {
+	if len(raw) < entryHeaderSize {
+		return entry{}, errMalformedEntry
+	}
+	softExpiresAt := int64(binary.BigEndian.Uint64(raw[0:8]))
+	delta := binary.BigEndian.Uint32(raw[8:12])
+	return entry{
+		softExpiresAt: time.Unix(0, softExpiresAt*int64(time.Millisecond)),
+		delta:         time.Duration(delta) * time.Millisecond,
+		payload:       raw[entryHeaderSize:],
+	}, nil
+}
+
+func (e entry) negative() bool {
+	return bytes.Equal(e.payload, negativePayload)
+}
+
+// shouldRefresh implements the XFetch algorithm: a value is refreshed when
+// now - delta * beta * ln(random) reaches its expiration, where random is
+// uniformly distributed in (0, 1].
+func (e entry) shouldRefresh(now time.Time, beta float64, random float64) bool {
+	if !now.Before(e.softExpiresAt) {
+		return true
+	}
+	if beta <= 0 || e.delta <= 0 {
+		return false
+	}
+	gap := -float64(e.delta) * beta * math.Log(random)
+	return float64(e.softExpiresAt.Sub(now)) <= gap
+}
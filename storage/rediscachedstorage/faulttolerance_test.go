@@ -0,0 +1,109 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+	"twitter/cache/rediscache"
+	"twitter/metrics"
+	"twitter/storage/inmemorystorage"
+)
+
+func newFaultTolerantStorage(t *testing.T, config Config) (*Storage, *miniredis.Miniredis, *metrics.Metrics) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{
+		Addr:        server.Addr(),
+		DialTimeout: 50 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	t.Cleanup(func() { _ = client.Close() })
+	m := metrics.New()
+	return NewStorage(inmemorystorage.NewStorage(), rediscache.NewBackend(client), m, config), server, m
+}
+
+func TestReadsAndWritesSucceedWhenRedisIsDown(t *testing.T) {
+	config := DefaultConfig()
+	config.CircuitBreaker.FailureThreshold = 0
+	s, server, _ := newFaultTolerantStorage(t, config)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	server.Close()
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+
+	second := newPost("user1", "second")
+	require.NoError(t, s.Save(ctx, second))
+	second.Text = "edited"
+	require.NoError(t, s.Update(ctx, second))
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Posts, 2)
+	require.Equal(t, "edited", page.Posts[0].Text)
+}
+
+func TestCircuitBreakerSuspendsRedisCallsAndRecovers(t *testing.T) {
+	config := DefaultConfig()
+	config.CircuitBreaker = CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Minute}
+	s, server, m := newFaultTolerantStorage(t, config)
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	s.now = clock.Now
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	server.Close()
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, breakerOpen, s.breaker.currentState())
+
+	expected := `
+# HELP blog_cache_circuit_breaker_state Whether the cache circuit breaker is in the given state (closed, half_open, open).
+# TYPE blog_cache_circuit_breaker_state gauge
+blog_cache_circuit_breaker_state{state="closed"} 0
+blog_cache_circuit_breaker_state{state="open"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "blog_cache_circuit_breaker_state"))
+
+	require.NoError(t, server.Restart())
+	_, err = s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, breakerOpen, s.breaker.currentState())
+
+	clock.Advance(time.Minute)
+	_, err = s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, breakerClosed, s.breaker.currentState())
+}
+
+func TestCanceledCacheCallsDoNotCloseCircuit(t *testing.T) {
+	config := DefaultConfig()
+	config.CircuitBreaker = CircuitBreakerConfig{FailureThreshold: 2, Cooldown: time.Minute}
+	s, server, _ := newFaultTolerantStorage(t, config)
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	s.now = clock.Now
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	server.Close()
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, breakerOpen, s.breaker.currentState())
+
+	clock.Advance(time.Minute)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.get(canceled, s.fullPostByIdKey(post.Id.Hex()))
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, breakerHalfOpen, s.breaker.currentState())
+
+	_, err = s.get(ctx, s.fullPostByIdKey(post.Id.Hex()))
+	require.Error(t, err)
+	require.Equal(t, breakerOpen, s.breaker.currentState())
+}
@@ -0,0 +1,89 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+	"twitter/logging"
+)
+
+const invalidationChannel = "pd:invalidations"
+
+const resubscribeDelay = time.Second
+
+type invalidationMessage struct {
+	Instance string   `json:"instance"`
+	Keys     []string `json:"keys"`
+}
+
+// invalidateLocal drops keys from the local cache of this instance and asks
+// the other instances to do the same.
+func (s *Storage) invalidateLocal(ctx context.Context, keys ...string) {
+	if s.local == nil {
+		return
+	}
+	for _, key := range keys {
+		s.local.delete(key)
+	}
+	s.publishInvalidation(ctx, keys...)
+}
+
+// publishInvalidation asks the other instances to drop keys from their local
+// caches, leaving the local cache of this instance as it is.
+func (s *Storage) publishInvalidation(ctx context.Context, keys ...string) {
+	if s.local == nil || s.pubsub == nil {
+		return
+	}
+	rawMessage, err := json.Marshal(invalidationMessage{Instance: s.instanceId, Keys: keys})
+	if err != nil {
+		logging.FromContext(ctx).Error("failed to encode invalidation message", "error", err)
+		return
+	}
+	err = s.guard(func() error {
+		return s.pubsub.Publish(ctx, invalidationChannel, rawMessage)
+	})
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to publish invalidation message", err, "keys", keys)
+	}
+}
+
+// ListenForInvalidations applies invalidation messages published by other
+// instances to the local cache until ctx is done. Messages published while
+// the subscription is broken are lost, so the whole local cache is dropped
+// whenever it is (re)established.
+func (s *Storage) ListenForInvalidations(ctx context.Context) {
+	if s.local == nil || s.pubsub == nil {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	for {
+		err := s.pubsub.Subscribe(ctx, invalidationChannel, s.local.purge, func(message []byte) {
+			s.applyInvalidation(ctx, message)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		s.local.purge()
+		logger.Warn("failed to receive invalidation messages", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+func (s *Storage) applyInvalidation(ctx context.Context, payload []byte) {
+	var message invalidationMessage
+	err := json.Unmarshal(payload, &message)
+	if err != nil {
+		logging.FromContext(ctx).Warn("ignoring malformed invalidation message", "error", err)
+		return
+	}
+	if message.Instance == s.instanceId {
+		return
+	}
+	for _, key := range message.Keys {
+		s.local.delete(key)
+	}
+}
@@ -0,0 +1,122 @@
+package rediscachedstorage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// itemOverhead approximates the memory taken by the bookkeeping of one item
+// besides its key and value.
+const itemOverhead = 64
+
+// localCache is an in-process LRU cache bounded by the total size of stored
+// keys and values.
+type localCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ttl      time.Duration
+	items    map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+type localItem struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+func (i *localItem) size() int64 {
+	return int64(len(i.key) + len(i.value) + itemOverhead)
+}
+
+func newLocalCache(config LocalCacheConfig, now func() time.Time) *localCache {
+	if config.MaxBytes <= 0 {
+		return nil
+	}
+	return &localCache{
+		maxBytes: config.MaxBytes,
+		ttl:      config.TTL,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+		now:      now,
+	}
+}
+
+func (c *localCache) get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := element.Value.(*localItem)
+	if !c.now().Before(item.expiresAt) {
+		c.removeElement(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return item.value, true
+}
+
+func (c *localCache) set(key string, value []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+	item := &localItem{key: key, value: value, expiresAt: c.now().Add(c.ttl)}
+	if item.size() > c.maxBytes {
+		return
+	}
+	c.items[key] = c.order.PushFront(item)
+	c.bytes += item.size()
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *localCache) delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+func (c *localCache) purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[string]*list.Element{}
+	c.order.Init()
+	c.bytes = 0
+}
+
+func (c *localCache) size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+func (c *localCache) removeElement(element *list.Element) {
+	item := c.order.Remove(element).(*localItem)
+	delete(c.items, item.key)
+	c.bytes -= item.size()
+}
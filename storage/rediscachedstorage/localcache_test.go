@@ -0,0 +1,128 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"twitter/cache/rediscache"
+	"twitter/storage/inmemorystorage"
+)
+
+func TestLocalCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	clock := &fakeClock{}
+	c := newLocalCache(LocalCacheConfig{MaxBytes: 3 * (itemOverhead + 2), TTL: time.Minute}, clock.Now)
+
+	c.set("a", []byte("1"))
+	c.set("b", []byte("2"))
+	c.set("c", []byte("3"))
+	_, ok := c.get("a")
+	require.True(t, ok)
+	c.set("d", []byte("4"))
+
+	_, ok = c.get("b")
+	require.False(t, ok)
+	for _, key := range []string{"a", "c", "d"} {
+		_, ok = c.get(key)
+		require.True(t, ok, key)
+	}
+	require.Equal(t, int64(3*(itemOverhead+2)), c.size())
+}
+
+func TestLocalCacheExpiresItems(t *testing.T) {
+	clock := &fakeClock{}
+	c := newLocalCache(LocalCacheConfig{MaxBytes: 1024, TTL: time.Second}, clock.Now)
+	c.set("a", []byte("1"))
+
+	clock.Advance(time.Second)
+
+	_, ok := c.get("a")
+	require.False(t, ok)
+	require.Zero(t, c.size())
+}
+
+func TestLocalCacheSkipsItemsLargerThanLimit(t *testing.T) {
+	c := newLocalCache(LocalCacheConfig{MaxBytes: itemOverhead + 4, TTL: time.Minute}, time.Now)
+	c.set("small", []byte("1"))
+
+	c.set("big", make([]byte, 1024))
+
+	_, ok := c.get("big")
+	require.False(t, ok)
+	_, ok = c.get("small")
+	require.False(t, ok)
+}
+
+func TestDisabledLocalCache(t *testing.T) {
+	c := newLocalCache(LocalCacheConfig{}, time.Now)
+	require.Nil(t, c)
+
+	c.set("a", []byte("1"))
+	_, ok := c.get("a")
+	require.False(t, ok)
+}
+
+func TestWritesInvalidateLocalCachesOfOtherInstances(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := DefaultConfig()
+	config.Local = LocalCacheConfig{MaxBytes: 1 << 20, TTL: time.Minute}
+	persistent := inmemorystorage.NewStorage()
+	newInstance := func() *Storage {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { _ = client.Close() })
+		instance := NewStorage(persistent, rediscache.NewBackend(client), nil, config)
+		listenCtx, cancel := context.WithCancel(ctx)
+		t.Cleanup(cancel)
+		go instance.ListenForInvalidations(listenCtx)
+		return instance
+	}
+	reader, writer := newInstance(), newInstance()
+	require.Eventually(t, func() bool {
+		return len(server.PubSubChannels("")) == 1 && server.PubSubNumSub(invalidationChannel)[invalidationChannel] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	post := newPost("user1", "first")
+	require.NoError(t, writer.Save(ctx, post))
+	_, err := reader.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	page, err := reader.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Posts, 1)
+	_, ok := reader.local.get(reader.fullPostByIdKey(post.Id.Hex()))
+	require.True(t, ok)
+
+	post.Text = "edited"
+	require.NoError(t, writer.Update(ctx, post))
+	require.NoError(t, writer.Save(ctx, newPost("user1", "second")))
+
+	require.Eventually(t, func() bool {
+		result, err := reader.GetPostById(ctx, post.Id.Hex())
+		return err == nil && result.Text == "edited"
+	}, time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		page, err := reader.GetPostsByUserId(ctx, "user1", 10, "")
+		return err == nil && len(page.Posts) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWritesKeepWrittenPostInLocalCache(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	s.local = newLocalCache(LocalCacheConfig{MaxBytes: 1 << 20, TTL: time.Minute}, time.Now)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	_, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	require.NoError(t, s.backend.Delete(ctx, s.fullPostByIdKey(post.Id.Hex())))
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "edited", result.Text)
+	require.Equal(t, 0, persistent.Loads())
+	_, ok := s.local.get(s.timelineVersionKey("user1"))
+	require.False(t, ok)
+}
@@ -0,0 +1,99 @@
+package rediscachedstorage
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+	"twitter/metrics"
+	"twitter/storage"
+)
+
+func TestMissingPostIsCachedAsNegative(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	m := metrics.New()
+	s.metrics = m
+	id := newPost("user1", "").Id.Hex()
+
+	for i := 0; i < 3; i++ {
+		_, err := s.GetPostById(ctx, id)
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+	}
+
+	require.Equal(t, 1, persistent.Loads())
+	expected := `
+# HELP blog_cache_requests_total Number of cache lookups by key family and result (hit, miss, stale, negative_hit, error).
+# TYPE blog_cache_requests_total counter
+blog_cache_requests_total{family="post",result="miss"} 1
+blog_cache_requests_total{family="post",result="negative_hit"} 2
+`
+	require.NoError(t, testutil.GatherAndCompare(m.Registry(), strings.NewReader(expected), "blog_cache_requests_total"))
+}
+
+func TestInvalidIdIsMissingWithoutLoad(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := s.GetPostById(ctx, "UNKNOWNURL")
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+	}
+
+	require.Equal(t, 0, persistent.Loads())
+}
+
+func TestNegativeEntryExpiresAfterNegativeTTL(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	s.now = clock.Now
+	post := newPost("user1", "late")
+
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.ErrorIs(t, err, storage.ErrorNotFound)
+	require.NoError(t, persistent.Save(ctx, post))
+
+	clock.Advance(s.config.Post.NegativeTTL)
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "late", result.Text)
+}
+
+func TestSaveReplacesNegativeEntry(t *testing.T) {
+	s, _ := newTestStorage(t)
+	post := newPost("user1", "first")
+
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.ErrorIs(t, err, storage.ErrorNotFound)
+
+	require.NoError(t, s.Save(ctx, post))
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+}
+
+func TestNegativeEntryDoesNotOverwriteWrittenPost(t *testing.T) {
+	s, _ := newTestStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	// a reader which missed the post in persistence before it was saved
+	require.NoError(t, s.storeNegative(ctx, s.config.Post, s.fullPostByIdKey(post.Id.Hex())))
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", result.Text)
+}
+
+func TestNegativeCachingCanBeDisabled(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	s.config.Post.NegativeTTL = 0
+	id := newPost("user1", "").Id.Hex()
+
+	for i := 0; i < 2; i++ {
+		_, err := s.GetPostById(ctx, id)
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+	}
+
+	require.Equal(t, 2, persistent.Loads())
+}
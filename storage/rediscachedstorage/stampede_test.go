@@ -0,0 +1,242 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+)
+
+type countingStorage struct {
+	storage.Storage
+	delay time.Duration
+	loads int32
+	// timelineLoads counts GetPostsByUserId calls, primaryTimelineLoads
+	// the ones asking for primary reads.
+	timelineLoads        int32
+	primaryTimelineLoads int32
+	// batches records ids requested by every GetPostsByIds call.
+	batchesMu sync.Mutex
+	batches   [][]string
+	// updates records texts of persisted updates, failures is the number
+	// of the next updates which fail.
+	updatesMu sync.Mutex
+	failures  int
+	updates   []string
+}
+
+func (c *countingStorage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	c.batchesMu.Lock()
+	c.batches = append(c.batches, ids)
+	c.batchesMu.Unlock()
+	return c.Storage.GetPostsByIds(ctx, ids)
+}
+
+func (c *countingStorage) Batches() [][]string {
+	c.batchesMu.Lock()
+	defer c.batchesMu.Unlock()
+	return c.batches
+}
+
+func (c *countingStorage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	atomic.AddInt32(&c.loads, 1)
+	select {
+	case <-ctx.Done():
+		return storage.PostData{}, ctx.Err()
+	case <-time.After(c.delay):
+	}
+	return c.Storage.GetPostById(ctx, id)
+}
+
+func (c *countingStorage) Loads() int {
+	return int(atomic.LoadInt32(&c.loads))
+}
+
+func (c *countingStorage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	atomic.AddInt32(&c.timelineLoads, 1)
+	if storage.PrimaryReadsRequired(ctx) {
+		atomic.AddInt32(&c.primaryTimelineLoads, 1)
+	}
+	return c.Storage.GetPostsByUserId(ctx, userId, pageSize, pageId)
+}
+
+func (c *countingStorage) TimelineLoads() int {
+	return int(atomic.LoadInt32(&c.timelineLoads))
+}
+
+func (c *countingStorage) PrimaryTimelineLoads() int {
+	return int(atomic.LoadInt32(&c.primaryTimelineLoads))
+}
+
+func (c *countingStorage) Update(ctx context.Context, data storage.PostData) error {
+	c.updatesMu.Lock()
+	defer c.updatesMu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		return fmt.Errorf("update failed - %w", storage.CommonStorageError)
+	}
+	c.updates = append(c.updates, data.Text)
+	return c.Storage.Update(ctx, data)
+}
+
+func (c *countingStorage) Updates() []string {
+	c.updatesMu.Lock()
+	defer c.updatesMu.Unlock()
+	return append([]string(nil), c.updates...)
+}
+
+type fakeClock struct {
+	now int64
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.now))
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	atomic.AddInt64(&c.now, int64(d))
+}
+
+func newCountingStorage(t *testing.T, delay time.Duration) (*Storage, *countingStorage) {
+	s, _ := newTestStorage(t)
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage(), delay: delay}
+	s.persistentStorage = persistent
+	return s, persistent
+}
+
+func TestConcurrentMissesAreCoalesced(t *testing.T) {
+	s, persistent := newCountingStorage(t, 50*time.Millisecond)
+	post := newPost("user1", "hot")
+	require.NoError(t, persistent.Save(ctx, post))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := s.GetPostById(ctx, post.Id.Hex())
+			assert.NoError(t, err)
+			assert.Equal(t, "hot", result.Text)
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, persistent.Loads())
+}
+
+func TestCoalescedMissSurvivesCancellationOfFirstRequest(t *testing.T) {
+	s, persistent := newCountingStorage(t, 50*time.Millisecond)
+	post := newPost("user1", "hot")
+	require.NoError(t, persistent.Save(ctx, post))
+
+	firstCtx, cancel := context.WithCancel(ctx)
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := s.GetPostById(firstCtx, post.Id.Hex())
+		firstErr <- err
+	}()
+	require.Eventually(t, func() bool { return persistent.Loads() == 1 }, time.Second, time.Millisecond)
+	secondErr := make(chan error, 1)
+	var second storage.PostData
+	go func() {
+		var err error
+		second, err = s.GetPostById(ctx, post.Id.Hex())
+		secondErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	require.ErrorIs(t, <-firstErr, context.Canceled)
+	require.NoError(t, <-secondErr)
+	require.Equal(t, "hot", second.Text)
+	require.Equal(t, 1, persistent.Loads())
+}
+
+func TestMissWaitsForLockHolderOfAnotherInstance(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	post := newPost("user1", "hot")
+	require.NoError(t, persistent.Save(ctx, post))
+	fullKey := s.fullPostByIdKey(post.Id.Hex())
+	_, acquired, err := s.lock(ctx, fullKey, time.Second)
+	require.NoError(t, err)
+	require.True(t, acquired)
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		assert.NoError(t, s.cachePost(ctx, post))
+	}()
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+
+	require.NoError(t, err)
+	require.Equal(t, "hot", result.Text)
+	require.Equal(t, 0, persistent.Loads())
+}
+
+func TestMissLoadsByItselfWhenLockHolderIsTooSlow(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	s.config.Post.LockWait = 30 * time.Millisecond
+	post := newPost("user1", "hot")
+	require.NoError(t, persistent.Save(ctx, post))
+	_, _, err := s.lock(ctx, s.fullPostByIdKey(post.Id.Hex()), time.Second)
+	require.NoError(t, err)
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+
+	require.NoError(t, err)
+	require.Equal(t, "hot", result.Text)
+	require.Equal(t, 1, persistent.Loads())
+}
+
+func TestStaleValueIsServedWhileRefreshed(t *testing.T) {
+	s, persistent := newCountingStorage(t, 0)
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	s.now = clock.Now
+	post := newPost("user1", "old")
+	require.NoError(t, persistent.Save(ctx, post))
+	_, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+
+	post.Text = "new"
+	require.NoError(t, persistent.Update(ctx, post))
+	clock.Advance(s.config.Post.TTL + time.Second)
+
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "old", result.Text)
+	require.Eventually(t, func() bool {
+		result, err := s.GetPostById(ctx, post.Id.Hex())
+		return err == nil && result.Text == "new"
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 2, persistent.Loads())
+}
+
+func TestShouldRefresh(t *testing.T) {
+	now := time.Now()
+	cached := entry{softExpiresAt: now.Add(time.Second), delta: 100 * time.Millisecond}
+
+	require.False(t, cached.shouldRefresh(now, 1, 1))
+	require.False(t, cached.shouldRefresh(now, 1, 0.5))
+	require.True(t, cached.shouldRefresh(now.Add(900*time.Millisecond), 1, 0.1))
+	require.False(t, cached.shouldRefresh(now.Add(900*time.Millisecond), 0, 0.1))
+	require.True(t, cached.shouldRefresh(now.Add(time.Second), 0, 1))
+}
+
+func TestEntryRoundTrip(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 123000000)
+	raw := encodeEntry(entry{softExpiresAt: expiresAt, delta: 42 * time.Millisecond, payload: []byte("payload")})
+
+	decoded, err := decodeEntry(raw)
+	require.NoError(t, err)
+	require.True(t, expiresAt.Equal(decoded.softExpiresAt))
+	require.Equal(t, 42*time.Millisecond, decoded.delta)
+	require.Equal(t, []byte("payload"), decoded.payload)
+
+	_, err = decodeEntry([]byte("short"))
+	require.ErrorIs(t, err, errMalformedEntry)
+}
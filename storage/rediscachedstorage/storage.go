@@ -1,151 +1,738 @@
 package rediscachedstorage
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"github.com/go-redis/redis/v8"
-	_ "github.com/go-redis/redis/v8"
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	mathrand "math/rand"
 	"strconv"
 	"time"
+	"twitter/cache"
+	"twitter/logging"
+	"twitter/metrics"
 	"twitter/storage"
 )
 
-const cacheTTL = 10 * time.Second
+// timelineVersionTTL must be much longer than any timeline TTL: when a version
+// key expires its counter restarts from zero, and no page cached under an old
+// zero version may still be alive by then.
+const timelineVersionTTL = 24 * time.Hour
 
-func NewStorage(persistentStorage storage.Storage, client *redis.Client) *Storage {
-	return &Storage{
-		client:            client,
+const lockPollInterval = 10 * time.Millisecond
+
+const instrumentationName = "twitter/storage/rediscachedstorage"
+
+const (
+	postFamily     = "post"
+	timelineFamily = "timeline"
+)
+
+var errCacheUnavailable = errors.New("cache circuit breaker is open")
+
+// errCachedAsMissing is returned by loads that found no value and cached its
+// absence instead.
+var errCachedAsMissing = errors.New("value is cached as missing")
+
+// NewStorage caches persistentStorage in backend. Local caches of instances
+// are kept coherent only if backend implements cache.PubSub, and the cache
+// can only be warmed if it implements cache.Ranking.
+func NewStorage(persistentStorage storage.Storage, backend cache.Backend, m *metrics.Metrics, config Config) *Storage {
+	pubsub, _ := backend.(cache.PubSub)
+	ranking, _ := backend.(cache.Ranking)
+	s := &Storage{
+		backend:           backend,
+		pubsub:            pubsub,
+		ranking:           ranking,
 		persistentStorage: persistentStorage,
+		metrics:           m,
+		config:            config,
+		now:               time.Now,
+		random:            func() float64 { return 1 - mathrand.Float64() },
 	}
+	s.breaker = newCircuitBreaker(config.CircuitBreaker, func() time.Time { return s.now() }, s.onBreakerStateChanged)
+	s.local = newLocalCache(config.Local, func() time.Time { return s.now() })
+	s.codec = newValueCodec(config.Codec)
+	s.instanceId = newToken()
+	return s
 }
 
 type Storage struct {
-	client            *redis.Client
+	backend cache.Backend
+	pubsub  cache.PubSub
+	ranking cache.Ranking
+	// writeBehind is nil unless updates are written behind.
+	writeBehind       cache.Queue
 	persistentStorage storage.Storage
+	metrics           *metrics.Metrics
+	config            Config
+	codec             valueCodec
+	// group coalesces concurrent loads of the same key within the instance,
+	// the backend lock does the same across instances.
+	group   singleflight.Group
+	breaker *circuitBreaker
+	// local is nil when the in-process cache is disabled.
+	local      *localCache
+	instanceId string
+	now        func() time.Time
+	random     func() float64
 }
 
+type loader func(ctx context.Context) (interface{}, error)
+
 func (s *Storage) Save(ctx context.Context, data storage.PostData) error {
 	err := s.persistentStorage.Save(ctx, data)
 	if err != nil {
 		return err
 	}
-	fullKey := s.fullPostByIdKey(data.Id.Hex())
-	rawResponse, err := json.Marshal(data)
+	s.refreshCachedPost(ctx, data)
+	s.recordActivity(ctx, data.AuthorId)
+	return nil
+}
+
+// GetPostById caches posts under their canonical ids, so every spelling of
+// an id shares one entry and writes invalidate all of them. Invalid ids are
+// missing without a lookup.
+func (s *Storage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
+	postId, err := storage.ParsePostID(id)
 	if err != nil {
-		return err
+		return storage.PostData{}, fmt.Errorf("no posts with id %v - %w", id, storage.ErrorNotFound)
+	}
+	id = postId.Hex()
+	result := storage.PostData{}
+	err = s.fetch(ctx, postFamily, s.config.Post, s.fullPostByIdKey(id), &result, func(ctx context.Context) (interface{}, error) {
+		return s.persistentStorage.GetPostById(ctx, id)
+	})
+	if err != nil {
+		return storage.PostData{}, err
 	}
+	return result, nil
+}
 
-	resp := s.client.Set(ctx, fullKey, rawResponse, cacheTTL)
-	if err := resp.Err(); err != nil {
-		log.Printf("Failed to save key %s to redis", fullKey)
-		return err
+// GetPostsByIds reads all posts with one multi-get and loads the missing ones
+// from persistence with one query. Unlike GetPostById it takes no locks, and
+// values due for refresh are reloaded together with the misses.
+func (s *Storage) GetPostsByIds(ctx context.Context, ids []string) ([]storage.PostData, error) {
+	ids = canonicalIds(ids)
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.fullPostByIdKey(id)
 	}
-	return nil
+	rawEntries, err := s.getMany(ctx, keys)
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to read keys from cache", err, "keys", len(keys))
+	}
+
+	postsById := make(map[string]storage.PostData, len(ids))
+	var idsToLoad []string
+	for i, id := range ids {
+		if err != nil {
+			s.metrics.ObserveCacheLookup(postFamily, metrics.CacheError)
+			idsToLoad = append(idsToLoad, id)
+			continue
+		}
+		post, result := s.cachedPost(ctx, keys[i], rawEntries[i])
+		s.metrics.ObserveCacheLookup(postFamily, result)
+		switch result {
+		case metrics.CacheHit:
+			postsById[id] = post
+		case metrics.CacheMiss, metrics.CacheStale:
+			idsToLoad = append(idsToLoad, id)
+		}
+	}
+
+	if len(idsToLoad) > 0 {
+		err = s.loadPosts(ctx, idsToLoad, postsById)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	posts := make([]storage.PostData, 0, len(postsById))
+	for _, id := range ids {
+		post, ok := postsById[id]
+		if ok {
+			posts = append(posts, post)
+		}
+	}
+	return posts, nil
 }
 
-func (s *Storage) GetPostById(ctx context.Context, id string) (storage.PostData, error) {
-	fullKey := s.fullPostByIdKey(id)
-	rawData, err := s.client.Get(ctx, fullKey).Result()
-	result := storage.PostData{}
-	switch {
-	case err == redis.Nil:
-	// go to persistence
-	case err != nil:
-		return result, err
-	default:
-		log.Println("Successfully loaded key from cache")
-		err = json.Unmarshal([]byte(rawData), &result)
+// cachedPost classifies a raw entry returned by a multi-get, decoding fresh
+// posts.
+func (s *Storage) cachedPost(ctx context.Context, fullKey string, rawEntry []byte) (storage.PostData, metrics.CacheResult) {
+	if rawEntry == nil {
+		return storage.PostData{}, metrics.CacheMiss
+	}
+	cached, err := decodeEntry(rawEntry)
+	if err == nil && !cached.negative() && !readable(cached.payload) {
+		err = errMalformedEntry
+	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("ignoring malformed cache entry", "key", fullKey, "error", err)
+		return storage.PostData{}, metrics.CacheMiss
+	}
+	now := s.now()
+	if cached.negative() {
+		if now.Before(cached.softExpiresAt) {
+			return storage.PostData{}, metrics.CacheNegativeHit
+		}
+		return storage.PostData{}, metrics.CacheMiss
+	}
+	if cached.shouldRefresh(now, s.config.Post.Beta, s.random()) {
+		return storage.PostData{}, metrics.CacheStale
+	}
+	var post storage.PostData
+	err = s.decode(ctx, cached.payload, &post)
+	if err != nil {
+		logging.FromContext(ctx).Warn("ignoring undecodable cache entry", "key", fullKey, "error", err)
+		return storage.PostData{}, metrics.CacheMiss
+	}
+	return post, metrics.CacheHit
+}
+
+// loadPosts loads posts missing in the cache with a single query, caching
+// both found posts and the absence of the others.
+func (s *Storage) loadPosts(ctx context.Context, ids []string, postsById map[string]storage.PostData) error {
+	start := s.now()
+	loaded, err := s.persistentStorage.GetPostsByIds(ctx, ids)
+	if err != nil {
+		return err
+	}
+	delta := s.now().Sub(start)
+	for _, post := range loaded {
+		id := post.Id.Hex()
+		postsById[id] = post
+		payload, err := s.encode(ctx, post)
+		if err == nil {
+			err = s.store(ctx, s.config.Post, s.fullPostByIdKey(id), payload, delta)
+		}
 		if err != nil {
-			return storage.PostData{}, err
+			s.warnCacheFailure(ctx, "failed to save key to cache", err, "key", s.fullPostByIdKey(id))
 		}
-		return result, nil
 	}
+	if s.config.Post.NegativeTTL <= 0 {
+		return nil
+	}
+	for _, id := range ids {
+		_, ok := postsById[id]
+		if ok {
+			continue
+		}
+		err = s.storeNegative(ctx, s.config.Post, s.fullPostByIdKey(id))
+		if err != nil {
+			s.warnCacheFailure(ctx, "failed to save negative key to cache", err, "key", s.fullPostByIdKey(id))
+		}
+	}
+	return nil
+}
 
-	result, err = s.persistentStorage.GetPostById(ctx, id)
+func (s *Storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
+	version, err := s.timelineVersion(ctx, userId)
 	if err != nil {
-		return storage.PostData{}, err
+		s.metrics.ObserveCacheLookup(timelineFamily, metrics.CacheError)
+		s.warnCacheFailure(ctx, "reading timeline bypassing cache", err, "userId", userId)
+		return s.persistentStorage.GetPostsByUserId(ctx, userId, pageSize, pageId)
+	}
+	fullKey := s.fullPostsByUserIdKey(userId, version, pageSize, pageId)
+	result := storage.PostsByUser{}
+	err = s.fetch(ctx, timelineFamily, s.config.Timeline, fullKey, &result, func(ctx context.Context) (interface{}, error) {
+		return s.persistentStorage.GetPostsByUserId(s.timelineLoadContext(ctx, userId), userId, pageSize, pageId)
+	})
+	if err != nil {
+		return storage.PostsByUser{}, err
 	}
+	return result, nil
+}
 
-	rawPost, err := json.Marshal(result)
+func (s *Storage) Update(ctx context.Context, data storage.PostData) error {
+	if s.writeBehind != nil && s.updateBehind(ctx, data) {
+		s.recordActivity(ctx, data.AuthorId)
+		return nil
+	}
+	err := s.persistentStorage.Update(ctx, data)
 	if err != nil {
-		return storage.PostData{}, err
+		return err
 	}
+	s.refreshCachedPost(ctx, data)
+	s.recordActivity(ctx, data.AuthorId)
+	return nil
+}
 
-	resp := s.client.Set(ctx, fullKey, string(rawPost), cacheTTL)
-	if err := resp.Err(); err != nil {
-		log.Printf("Failed to save key %s to redis", fullKey)
-		return storage.PostData{}, err
+// refreshCachedPost brings the cache in line with a successful write. Caching
+// the post also replaces a negative entry left for its id, locally as well,
+// so the next read of this instance does not go to the backend. Failures are
+// only logged: the write itself has already succeeded, and entries left stale
+// by an unavailable backend expire after TTL + StaleTTL.
+func (s *Storage) refreshCachedPost(ctx context.Context, data storage.PostData) {
+	postKey, versionKey := s.fullPostByIdKey(data.Id.Hex()), s.timelineVersionKey(data.AuthorId)
+	err := s.cachePost(ctx, data)
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to cache written post", err, "id", data.Id.Hex())
+		s.local.delete(postKey)
+	}
+	err = s.invalidateTimeline(ctx, data.AuthorId)
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to invalidate timeline of written post", err, "userId", data.AuthorId)
 	}
+	s.local.delete(versionKey)
+	s.publishInvalidation(ctx, postKey, versionKey)
+}
 
-	log.Println("Successfully loaded key from persistence")
-	return result, nil
+func (s *Storage) cachePost(ctx context.Context, data storage.PostData) error {
+	rawPostData, err := s.encode(ctx, data)
+	if err != nil {
+		return err
+	}
+	return s.store(ctx, s.config.Post, s.fullPostByIdKey(data.Id.Hex()), rawPostData, 0)
 }
 
-func (s *Storage) GetPostsByUserId(ctx context.Context, userId string, pageSize int, pageId string) (storage.PostsByUser, error) {
-	fullKey := s.fullPostsByUserIdKey(userId, pageSize, pageId)
-	rawData, err := s.client.Get(ctx, fullKey).Result()
-	result := storage.PostsByUser{}
+// fetch decodes the cached value of fullKey into value. Stale values and
+// values picked for early expiration are still returned, but refreshed in
+// the background. On a miss only one request per key loads the value. Cache
+// failures are treated as misses.
+func (s *Storage) fetch(ctx context.Context, familyName string, family FamilyConfig, fullKey string, value interface{}, load loader) error {
+	cached, ok, err := s.lookup(ctx, fullKey)
 	switch {
-	case err == redis.Nil:
-	// go to persistence
 	case err != nil:
-		// this is similar to returning null
-		return result, err
+		s.metrics.ObserveCacheLookup(familyName, metrics.CacheError)
+		s.warnCacheFailure(ctx, "failed to read key from cache", err, "key", fullKey)
+	case !ok:
+		s.metrics.ObserveCacheLookup(familyName, metrics.CacheMiss)
+	// go to persistence
+	case cached.negative():
+		if s.now().Before(cached.softExpiresAt) {
+			s.metrics.ObserveCacheLookup(familyName, metrics.CacheNegativeHit)
+			return s.missing(fullKey)
+		}
+		// an expired negative entry may only survive in the local cache
+		s.metrics.ObserveCacheLookup(familyName, metrics.CacheMiss)
 	default:
-		log.Println("Successfully loaded key from cache")
-		err = json.Unmarshal([]byte(rawData), &result)
-		if err != nil {
-			return storage.PostsByUser{}, err
+		if cached.shouldRefresh(s.now(), family.Beta, s.random()) {
+			s.metrics.ObserveCacheLookup(familyName, metrics.CacheStale)
+			s.refreshAsync(ctx, family, fullKey, load)
+		} else {
+			s.metrics.ObserveCacheLookup(familyName, metrics.CacheHit)
 		}
-		return result, nil
+		logging.FromContext(ctx).Debug("loaded key from cache", "key", fullKey)
+		return s.decode(ctx, cached.payload, value)
 	}
 
-	result, err = s.persistentStorage.GetPostsByUserId(ctx, userId, pageSize, pageId)
+	// the load is shared by every coalesced request, so it must not fail
+	// when the one that started it goes away
+	results := s.group.DoChan(fullKey, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detach(ctx), family.LockWait+family.LockTTL)
+		defer cancel()
+		return s.populate(ctx, family, fullKey, load)
+	})
+	var result singleflight.Result
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case result = <-results:
+	}
+	payload, err := result.Val, result.Err
+	if err == errCachedAsMissing || (err == nil && bytes.Equal(payload.([]byte), negativePayload)) {
+		return s.missing(fullKey)
+	}
 	if err != nil {
-		return storage.PostsByUser{}, err
+		return err
 	}
+	logging.FromContext(ctx).Debug("loaded key from persistence", "key", fullKey)
+	return s.decode(ctx, payload.([]byte), value)
+}
 
-	rawPostsByUser, err := json.Marshal(result)
+func (s *Storage) missing(fullKey string) error {
+	return fmt.Errorf("no value for key %v - %w", fullKey, storage.ErrorNotFound)
+}
+
+func (s *Storage) lookup(ctx context.Context, fullKey string) (entry, bool, error) {
+	rawData, err := s.get(ctx, fullKey)
+	if err == cache.ErrMiss {
+		return entry{}, false, nil
+	}
 	if err != nil {
-		return storage.PostsByUser{}, err
+		return entry{}, false, err
+	}
+	cached, err := decodeEntry(rawData)
+	if err == nil && !cached.negative() && !readable(cached.payload) {
+		err = errMalformedEntry
 	}
+	if err != nil {
+		logging.FromContext(ctx).Warn("ignoring malformed cache entry", "key", fullKey, "error", err)
+		return entry{}, false, nil
+	}
+	return cached, true, nil
+}
 
-	resp := s.client.Set(ctx, fullKey, string(rawPostsByUser), cacheTTL)
-	if err := resp.Err(); err != nil {
-		log.Printf("Failed to save key %s to redis", fullKey)
-		return storage.PostsByUser{}, err
+// populate loads a missing value, making sure that across all instances only
+// the holder of the key lock hits persistence. Requests that lost the lock
+// wait for the holder to store the value and load it by themselves only if
+// that takes longer than LockWait.
+func (s *Storage) populate(ctx context.Context, family FamilyConfig, fullKey string, load loader) ([]byte, error) {
+	token, acquired, err := s.lock(ctx, fullKey, family.LockTTL)
+	if err != nil {
+		return s.load(ctx, family, fullKey, load)
+	}
+	if acquired {
+		defer s.unlock(ctx, fullKey, token)
+	} else {
+		cached, ok, err := s.waitForValue(ctx, fullKey, family.LockWait)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err == nil && ok {
+			return cached.payload, nil
+		}
 	}
+	return s.load(ctx, family, fullKey, load)
+}
 
-	log.Println("Successfully loaded key from persistence")
-	return result, nil
+func (s *Storage) load(ctx context.Context, family FamilyConfig, fullKey string, load loader) ([]byte, error) {
+	start := s.now()
+	value, err := load(ctx)
+	if err != nil && family.NegativeTTL > 0 && (errors.Is(err, storage.ErrorNotFound) || errors.Is(err, storage.ErrorInvalidId)) {
+		storeErr := s.storeNegative(ctx, family, fullKey)
+		if storeErr != nil {
+			s.warnCacheFailure(ctx, "failed to save negative key to cache", storeErr, "key", fullKey)
+			return nil, err
+		}
+		return nil, errCachedAsMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+	payload, err := s.encode(ctx, value)
+	if err != nil {
+		return nil, err
+	}
+	err = s.store(ctx, family, fullKey, payload, s.now().Sub(start))
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to save key to cache", err, "key", fullKey)
+	}
+	return payload, nil
 }
 
-func (s *Storage) Update(ctx context.Context, data storage.PostData) error {
-	err := s.persistentStorage.Update(ctx, data)
+func (s *Storage) refreshAsync(ctx context.Context, family FamilyConfig, fullKey string, load loader) {
+	logger := logging.FromContext(ctx)
+	detached := detach(ctx)
+	go func() {
+		ctx, cancel := context.WithTimeout(detached, family.LockTTL)
+		defer cancel()
+		_, err, _ := s.group.Do("refresh:"+fullKey, func() (interface{}, error) {
+			token, acquired, err := s.lock(ctx, fullKey, family.LockTTL)
+			if err != nil || !acquired {
+				return nil, err
+			}
+			defer s.unlock(ctx, fullKey, token)
+			return s.load(ctx, family, fullKey, load)
+		})
+		if err != nil && err != errCachedAsMissing {
+			logger.Warn("failed to refresh cache entry", "key", fullKey, "error", err)
+		}
+	}()
+}
+
+// detach returns a context for loads outliving the request that started
+// them. It keeps the logger, the trace span and primary reads of ctx, but not
+// its cancellation and deadline.
+func detach(ctx context.Context) context.Context {
+	detached := logging.WithContext(context.Background(), logging.FromContext(ctx))
+	detached = trace.ContextWithSpan(detached, trace.SpanFromContext(ctx))
+	if storage.PrimaryReadsRequired(ctx) {
+		detached = storage.WithPrimaryReads(detached)
+	}
+	return detached
+}
+
+func (s *Storage) store(ctx context.Context, family FamilyConfig, fullKey string, payload []byte, delta time.Duration) error {
+	rawEntry := encodeEntry(entry{
+		softExpiresAt: s.now().Add(family.TTL),
+		delta:         delta,
+		payload:       payload,
+	})
+	s.local.set(fullKey, rawEntry)
+	return s.guard(func() error {
+		return s.backend.Set(ctx, fullKey, rawEntry, family.TTL+family.StaleTTL)
+	})
+}
+
+// storeNegative caches the absence of a value. It never overwrites an existing
+// key: a value stored by a writer after the load must not be hidden.
+func (s *Storage) storeNegative(ctx context.Context, family FamilyConfig, fullKey string) error {
+	rawEntry := encodeEntry(entry{
+		softExpiresAt: s.now().Add(family.NegativeTTL),
+		payload:       negativePayload,
+	})
+	var stored bool
+	err := s.guard(func() error {
+		var err error
+		stored, err = s.backend.SetNX(ctx, fullKey, rawEntry, family.NegativeTTL)
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	fullKey := s.fullPostByIdKey(data.Id.Hex())
-	rawPostData, err := json.Marshal(data)
+	if stored {
+		s.local.set(fullKey, rawEntry)
+	}
+	return nil
+}
+
+// get reads a key from the local cache, falling back to the backend.
+func (s *Storage) get(ctx context.Context, fullKey string) ([]byte, error) {
+	rawData, ok := s.local.get(fullKey)
+	if ok {
+		return rawData, nil
+	}
+	err := s.guard(func() error {
+		var err error
+		rawData, err = s.backend.Get(ctx, fullKey)
+		return err
+	})
 	if err != nil {
+		return nil, err
+	}
+	s.local.set(fullKey, rawData)
+	return rawData, nil
+}
+
+// getMany reads keys from the local cache, reading the rest from the backend
+// with a single call. Missing keys have nil values.
+func (s *Storage) getMany(ctx context.Context, fullKeys []string) ([][]byte, error) {
+	values := make([][]byte, len(fullKeys))
+	var remoteKeys []string
+	var remoteIndexes []int
+	for i, fullKey := range fullKeys {
+		rawData, ok := s.local.get(fullKey)
+		if ok {
+			values[i] = rawData
+		} else {
+			remoteKeys = append(remoteKeys, fullKey)
+			remoteIndexes = append(remoteIndexes, i)
+		}
+	}
+	if len(remoteKeys) == 0 {
+		return values, nil
+	}
+
+	var remoteValues [][]byte
+	err := s.guard(func() error {
+		var err error
+		remoteValues, err = s.backend.MGet(ctx, remoteKeys...)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
+	for j, rawData := range remoteValues {
+		if rawData != nil {
+			values[remoteIndexes[j]] = rawData
+			s.local.set(remoteKeys[j], rawData)
+		}
+	}
+	return values, nil
+}
 
-	resp := s.client.Set(ctx, fullKey, rawPostData, cacheTTL)
-	if err := resp.Err(); err != nil {
-		log.Printf("Failed to update data by key %s in cache", fullKey)
+func (s *Storage) lock(ctx context.Context, fullKey string, ttl time.Duration) (string, bool, error) {
+	token := newToken()
+	var acquired bool
+	err := s.guard(func() error {
+		var err error
+		acquired, err = s.backend.SetNX(ctx, s.lockKey(fullKey), []byte(token), ttl)
 		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return token, acquired, nil
+}
+
+func (s *Storage) unlock(ctx context.Context, fullKey string, token string) {
+	err := s.guard(func() error {
+		_, err := s.backend.DeleteIfEqual(ctx, s.lockKey(fullKey), []byte(token))
+		return err
+	})
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to release cache lock", err, "key", fullKey)
+	}
+}
+
+func (s *Storage) waitForValue(ctx context.Context, fullKey string, wait time.Duration) (entry, bool, error) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return entry{}, false, ctx.Err()
+		case <-timer.C:
+			return entry{}, false, nil
+		case <-ticker.C:
+			cached, ok, err := s.lookup(ctx, fullKey)
+			if err != nil || ok {
+				return cached, ok, err
+			}
+		}
+	}
+}
+
+// timelineVersion returns the current version of the user timeline. Every
+// cached page of the timeline is stored under a key containing the version,
+// so bumping it invalidates all pages at once.
+func (s *Storage) timelineVersion(ctx context.Context, userId string) (string, error) {
+	version, err := s.get(ctx, s.timelineVersionKey(userId))
+	if err == cache.ErrMiss {
+		return "0", nil
+	}
+	return string(version), err
+}
+
+func (s *Storage) invalidateTimeline(ctx context.Context, userId string) error {
+	fullKey := s.timelineVersionKey(userId)
+	return s.guard(func() error {
+		// the mark goes first, a load seeing the new version must see it
+		window := s.config.Timeline.PrimaryReadWindow
+		if window > 0 {
+			err := s.backend.Set(ctx, s.timelineWrittenKey(userId), []byte("1"), window)
+			if err != nil {
+				return err
+			}
+		}
+		_, err := s.backend.Incr(ctx, fullKey, timelineVersionTTL)
+		return err
+	})
+}
+
+// timelineLoadContext asks for primary reads when the timeline was written
+// within PrimaryReadWindow, so the loaded page, cached for TTL, includes the
+// write even if replicas lag behind.
+func (s *Storage) timelineLoadContext(ctx context.Context, userId string) context.Context {
+	if s.config.Timeline.PrimaryReadWindow <= 0 {
+		return ctx
+	}
+	err := s.guard(func() error {
+		_, err := s.backend.Get(ctx, s.timelineWrittenKey(userId))
+		return err
+	})
+	if err == cache.ErrMiss {
+		return ctx
+	}
+	// the mark may be there when the backend fails
+	return storage.WithPrimaryReads(ctx)
+}
+
+// guard runs a cache call through the circuit breaker. Missing keys are not
+// failures of the cache, and calls canceled by the caller count neither way.
+func (s *Storage) guard(call func() error) error {
+	if !s.breaker.allow() {
+		return errCacheUnavailable
+	}
+	err := call()
+	switch {
+	case err == nil || err == cache.ErrMiss:
+		s.breaker.success()
+	case errors.Is(err, context.Canceled):
+		s.breaker.abandoned()
+	default:
+		s.breaker.failure()
+	}
+	return err
+}
+
+// warnCacheFailure logs a failed cache call. While the circuit breaker is
+// open every call fails the same way, so those failures are logged at debug
+// level to keep logs readable.
+func (s *Storage) warnCacheFailure(ctx context.Context, msg string, err error, keysAndValues ...interface{}) {
+	keysAndValues = append(keysAndValues, "error", err)
+	if errors.Is(err, errCacheUnavailable) {
+		logging.FromContext(ctx).Debug(msg, keysAndValues...)
+	} else {
+		logging.FromContext(ctx).Warn(msg, keysAndValues...)
 	}
-	return nil
 }
 
+func (s *Storage) onBreakerStateChanged(from, to breakerState) {
+	s.metrics.ObserveCacheCircuitTransition(from.String(), to.String())
+	if to == breakerOpen {
+		logging.Default().Error("cache circuit breaker opened, cache calls are suspended", "cooldown", s.config.CircuitBreaker.Cooldown.String())
+	} else {
+		logging.Default().Warn("cache circuit breaker changed state", "from", from.String(), "to", to.String())
+	}
+}
+
+func (s *Storage) encode(ctx context.Context, value interface{}) ([]byte, error) {
+	_, span := otel.Tracer(instrumentationName).Start(ctx, "cache.encode")
+	defer span.End()
+	return s.codec.encode(value)
+}
+
+func (s *Storage) decode(ctx context.Context, rawData []byte, value interface{}) error {
+	_, span := otel.Tracer(instrumentationName).Start(ctx, "cache.decode")
+	defer span.End()
+	return s.codec.decode(rawData, value)
+}
+
+// Keys put ids into redis cluster hash tags: the version and all pages of a
+// timeline share a slot, as do a key and its lock.
 func (s *Storage) fullPostByIdKey(id string) string {
-	return "pd:" + id
+	return "pd:{" + id + "}"
+}
+
+func (s *Storage) fullPostsByUserIdKey(userId string, version string, pageSize int, pageId string) string {
+	return "pd:{" + userId + "};" + version + ";" + strconv.Itoa(pageSize) + ";" + pageId
+}
+
+func (s *Storage) timelineVersionKey(userId string) string {
+	return "pd:tv:{" + userId + "}"
+}
+
+func (s *Storage) timelineWrittenKey(userId string) string {
+	return "pd:tw:{" + userId + "}"
+}
+
+// canonicalIds returns the canonical form of every valid id once, in the
+// order of their first occurrence. Invalid ids are missing anyway.
+func canonicalIds(ids []string) []string {
+	canonical := make([]string, 0, len(ids))
+	for _, id := range ids {
+		postId, err := storage.ParsePostID(id)
+		if err == nil {
+			canonical = append(canonical, postId.Hex())
+		}
+	}
+	return uniqueIds(canonical)
+}
+
+func uniqueIds(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+func newToken() string {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(buf)
 }
 
-func (s *Storage) fullPostsByUserIdKey(userId string, pageSize int, pageId string) string {
-	return "pd:" + userId + ";" + strconv.Itoa(pageSize) + ";" + pageId
+func (s *Storage) lockKey(fullKey string) string {
+	return "lock:" + fullKey
 }
 
 var _ storage.Storage = (*Storage)(nil)
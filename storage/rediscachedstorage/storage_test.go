@@ -0,0 +1,151 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+	"twitter/cache/memorycache"
+	"twitter/cache/rediscache"
+	"twitter/generator"
+	"twitter/storage"
+	"twitter/storage/inmemorystorage"
+)
+
+var idGenerator = generator.NewObjectIdGenerator()
+
+var ctx = context.Background()
+
+func newTestStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewStorage(inmemorystorage.NewStorage(), rediscache.NewBackend(client), nil, DefaultConfig()), server
+}
+
+func newPost(authorId, text string) storage.PostData {
+	return storage.PostData{Id: idGenerator.NewPostID(), AuthorId: authorId, Text: text}
+}
+
+func TestTimelineReadYourWritesAfterSave(t *testing.T) {
+	s, _ := newTestStorage(t)
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Empty(t, page.Posts)
+
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	page, err = s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Posts, 1)
+	require.Equal(t, post.Id, page.Posts[0].Id)
+}
+
+func TestTimelineReadYourWritesAfterUpdate(t *testing.T) {
+	s, _ := newTestStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	_, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Len(t, page.Posts, 1)
+	require.Equal(t, "edited", page.Posts[0].Text)
+}
+
+func TestSaveInvalidatesEveryCachedPageOfAuthorOnly(t *testing.T) {
+	s, server := newTestStorage(t)
+	require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+	require.NoError(t, s.Save(ctx, newPost("user2", "other")))
+	for _, pageSize := range []int{5, 10, 20} {
+		_, err := s.GetPostsByUserId(ctx, "user1", pageSize, "")
+		require.NoError(t, err)
+	}
+	_, err := s.GetPostsByUserId(ctx, "user2", 10, "")
+	require.NoError(t, err)
+	otherVersion, err := server.Get(s.timelineVersionKey("user2"))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Save(ctx, newPost("user1", "second")))
+
+	for _, pageSize := range []int{5, 10, 20} {
+		page, err := s.GetPostsByUserId(ctx, "user1", pageSize, "")
+		require.NoError(t, err)
+		require.Len(t, page.Posts, 2)
+	}
+	version, err := server.Get(s.timelineVersionKey("user2"))
+	require.NoError(t, err)
+	require.Equal(t, otherVersion, version)
+}
+
+func TestTimelineIsServedFromCacheBetweenWrites(t *testing.T) {
+	s, server := newTestStorage(t)
+	require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+	_, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+
+	version, err := s.timelineVersion(ctx, "user1")
+	require.NoError(t, err)
+	require.True(t, server.Exists(s.fullPostsByUserIdKey("user1", version, 10, "")))
+	require.Greater(t, server.TTL(s.timelineVersionKey("user1")), DefaultConfig().Timeline.TTL)
+}
+
+func TestTimelineIsLoadedFromPrimaryAfterWrite(t *testing.T) {
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage()}
+	s := NewStorage(persistent, memorycache.NewBackendWithClock(clock.Now), nil, DefaultConfig())
+	s.now = clock.Now
+	require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+
+	_, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, persistent.TimelineLoads())
+	require.Equal(t, 1, persistent.PrimaryTimelineLoads())
+
+	config := s.config.Timeline
+	clock.Advance(config.PrimaryReadWindow + config.TTL + config.StaleTTL)
+	_, err = s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, 2, persistent.TimelineLoads())
+	require.Equal(t, 1, persistent.PrimaryTimelineLoads())
+}
+
+// hashTag returns the part of key redis cluster hashes to pick a slot.
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+func TestRelatedKeysShareHashSlot(t *testing.T) {
+	s, _ := newTestStorage(t)
+	post := newPost("user1", "first")
+	postKey := s.fullPostByIdKey(post.Id.Hex())
+
+	require.Equal(t, post.Id.Hex(), hashTag(postKey))
+	require.Equal(t, hashTag(postKey), hashTag(s.lockKey(postKey)))
+	for _, key := range []string{
+		s.timelineVersionKey("user1"),
+		s.timelineWrittenKey("user1"),
+		s.fullPostsByUserIdKey("user1", "0", 10, ""),
+		s.fullPostsByUserIdKey("user1", "3", 20, post.Id.Hex()),
+		s.lockKey(s.fullPostsByUserIdKey("user1", "0", 10, "")),
+	} {
+		require.Equal(t, "user1", hashTag(key), key)
+	}
+}
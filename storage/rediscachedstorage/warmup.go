@@ -0,0 +1,54 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"twitter/logging"
+)
+
+const activeAuthorsKey = "pd:authors"
+
+// recordActivity ranks authors by the number of their writes for WarmUp.
+func (s *Storage) recordActivity(ctx context.Context, authorId string) {
+	if s.ranking == nil || s.config.WarmUp.Authors == 0 {
+		return
+	}
+	err := s.guard(func() error {
+		return s.ranking.IncrScore(ctx, activeAuthorsKey, authorId, 1)
+	})
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to record author activity", err, "userId", authorId)
+	}
+}
+
+// WarmUp loads the first timeline pages of the most active authors into the
+// cache, so that a fresh instance does not send all of them to the
+// persistent storage at once.
+func (s *Storage) WarmUp(ctx context.Context) {
+	if s.ranking == nil || s.config.WarmUp.Authors == 0 {
+		return
+	}
+	logger := logging.FromContext(ctx)
+	var authors []string
+	err := s.guard(func() error {
+		var err error
+		authors, err = s.ranking.TopMembers(ctx, activeAuthorsKey, s.config.WarmUp.Authors)
+		return err
+	})
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to read most active authors", err)
+		return
+	}
+	warmed := 0
+	for _, authorId := range authors {
+		_, err = s.GetPostsByUserId(ctx, authorId, s.config.WarmUp.PageSize, "")
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("failed to warm timeline", "userId", authorId, "error", err)
+			continue
+		}
+		warmed++
+	}
+	logger.Info("warmed cache", "timelines", warmed)
+}
@@ -0,0 +1,48 @@
+package rediscachedstorage
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"twitter/cache/memorycache"
+	"twitter/storage/inmemorystorage"
+)
+
+func TestWarmUpLoadsTimelinesOfMostActiveAuthors(t *testing.T) {
+	backend := memorycache.NewBackend()
+	config := DefaultConfig()
+	config.WarmUp.Authors = 2
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage()}
+	writer := NewStorage(persistent, backend, nil, config)
+	for author, posts := range map[string]int{"user1": 3, "user2": 1, "user3": 2} {
+		for i := 0; i < posts; i++ {
+			require.NoError(t, writer.Save(ctx, newPost(author, "text")))
+		}
+	}
+
+	NewStorage(persistent, backend, nil, config).WarmUp(ctx)
+	require.Equal(t, 2, persistent.TimelineLoads())
+
+	reader := NewStorage(persistent, backend, nil, config)
+	for _, author := range []string{"user1", "user3"} {
+		page, err := reader.GetPostsByUserId(ctx, author, config.WarmUp.PageSize, "")
+		require.NoError(t, err)
+		require.NotEmpty(t, page.Posts)
+	}
+	require.Equal(t, 2, persistent.TimelineLoads())
+	_, err := reader.GetPostsByUserId(ctx, "user2", config.WarmUp.PageSize, "")
+	require.NoError(t, err)
+	require.Equal(t, 3, persistent.TimelineLoads())
+}
+
+func TestWarmUpIsDisabledByDefault(t *testing.T) {
+	backend := memorycache.NewBackend()
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage()}
+	s := NewStorage(persistent, backend, nil, DefaultConfig())
+	require.NoError(t, s.Save(ctx, newPost("user1", "text")))
+
+	s.WarmUp(ctx)
+	require.Zero(t, persistent.TimelineLoads())
+	members, err := backend.TopMembers(ctx, activeAuthorsKey, 10)
+	require.NoError(t, err)
+	require.Empty(t, members)
+}
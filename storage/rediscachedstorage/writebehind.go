@@ -0,0 +1,245 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+	"twitter/cache"
+	"twitter/logging"
+	"twitter/metrics"
+	"twitter/storage"
+)
+
+// writeBehindSequenceTTL must be longer than any update may wait to be
+// flushed: once the sequence key expires, older updates of the post are no
+// longer recognized as superseded.
+const writeBehindSequenceTTL = 24 * time.Hour
+
+const receiveRetryDelay = time.Second
+
+type writeBehindEntry struct {
+	Post storage.PostData `json:"post"`
+	// Sequence orders updates of the same post, only the last one is
+	// flushed.
+	Sequence int64 `json:"sequence"`
+	// Attempt is the number of failed flushes.
+	Attempt int `json:"attempt"`
+	// NotBefore is the unix time in milliseconds before which the entry is
+	// not flushed.
+	NotBefore int64 `json:"notBefore"`
+}
+
+// EnableWriteBehind makes Update cache posts and queue them for persisting
+// instead of persisting them before returning. RunWriteBehind flushes the
+// queue. Until an update is flushed, timelines show the previous version of
+// the post, and so may single post reads if the cached post expires.
+func (s *Storage) EnableWriteBehind(queue cache.Queue) {
+	s.writeBehind = queue
+}
+
+// updateBehind caches data and queues it for flushing. It reports false when
+// the cache fails and the update must be written through instead.
+func (s *Storage) updateBehind(ctx context.Context, data storage.PostData) bool {
+	id := data.Id.Hex()
+	var sequence int64
+	err := s.guard(func() error {
+		var err error
+		sequence, err = s.backend.Incr(ctx, s.writeBehindSequenceKey(id), writeBehindSequenceTTL)
+		return err
+	})
+	if err == nil {
+		err = s.cachePost(ctx, data)
+	}
+	var rawEntry []byte
+	if err == nil {
+		rawEntry, err = json.Marshal(writeBehindEntry{Post: data, Sequence: sequence})
+	}
+	if err == nil {
+		err = s.guard(func() error {
+			return s.writeBehind.Enqueue(ctx, rawEntry)
+		})
+	}
+	if err != nil {
+		// the bumped sequence makes queued updates of the post superseded
+		// by the written through one
+		s.warnCacheFailure(ctx, "writing post through after failed write-behind", err, "id", id)
+		return false
+	}
+	// the local cache already holds the update
+	s.publishInvalidation(ctx, s.fullPostByIdKey(id))
+	return true
+}
+
+// RunWriteBehind flushes updates queued in write-behind mode to the
+// persistent storage until ctx is done. Every instance may run it, consumer
+// must be unique among them.
+func (s *Storage) RunWriteBehind(ctx context.Context, consumer string) {
+	if s.writeBehind == nil {
+		return
+	}
+	config := s.config.WriteBehind
+	for {
+		messages, err := s.writeBehind.Receive(ctx, consumer, config.BatchSize, config.Block)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to receive write-behind updates", "error", err)
+			if !sleep(ctx, receiveRetryDelay) {
+				return
+			}
+			continue
+		}
+		deferred := 0
+		wait := config.Block
+		for _, message := range messages {
+			delay := s.flush(ctx, message)
+			if delay > 0 {
+				deferred++
+				if delay < wait {
+					wait = delay
+				}
+			}
+		}
+		// do not spin on updates waiting for their retry
+		if len(messages) > 0 && deferred == len(messages) && !sleep(ctx, wait) {
+			return
+		}
+	}
+}
+
+// flush persists one queued update. It returns how long is left until an
+// update waiting for its retry is due.
+func (s *Storage) flush(ctx context.Context, message cache.Message) time.Duration {
+	var entry writeBehindEntry
+	err := json.Unmarshal(message.Payload, &entry)
+	if err != nil {
+		s.deadLetter(ctx, message, "malformed entry: "+err.Error())
+		return 0
+	}
+	delay := time.Duration(entry.NotBefore-s.now().UnixMilli()) * time.Millisecond
+	if delay > 0 {
+		err = s.writeBehind.Requeue(ctx, message, message.Payload)
+		if err != nil {
+			logging.FromContext(ctx).Warn("failed to requeue write-behind update", "messageId", message.Id, "error", err)
+		}
+		return delay
+	}
+
+	id := entry.Post.Id.Hex()
+	superseded, err := s.superseded(ctx, id, entry.Sequence)
+	if err != nil {
+		s.retry(ctx, message, entry, err)
+		return 0
+	}
+	if superseded {
+		s.ack(ctx, message)
+		s.metrics.ObserveCacheWriteBehind(metrics.WriteBehindSkipped)
+		return 0
+	}
+	err = s.persistentStorage.Update(ctx, entry.Post)
+	if errors.Is(err, storage.ErrorNotFound) {
+		s.deadLetter(ctx, message, err.Error())
+		return 0
+	}
+	if err != nil {
+		s.retry(ctx, message, entry, err)
+		return 0
+	}
+	s.ack(ctx, message)
+	s.metrics.ObserveCacheWriteBehind(metrics.WriteBehindFlushed)
+
+	// a newer update cached meanwhile must not be overwritten
+	superseded, err = s.superseded(ctx, id, entry.Sequence)
+	if err == nil && !superseded {
+		s.refreshCachedPost(ctx, entry.Post)
+		return 0
+	}
+	err = s.invalidateTimeline(ctx, entry.Post.AuthorId)
+	if err != nil {
+		s.warnCacheFailure(ctx, "failed to invalidate timeline of flushed post", err, "userId", entry.Post.AuthorId)
+	}
+	s.invalidateLocal(ctx, s.timelineVersionKey(entry.Post.AuthorId))
+	return 0
+}
+
+// superseded reports whether the post was updated again after the update
+// with the given sequence. The sequence is read from the backend only, the
+// local cache does not see updates of other instances in time.
+func (s *Storage) superseded(ctx context.Context, id string, sequence int64) (bool, error) {
+	var rawSequence []byte
+	err := s.guard(func() error {
+		var err error
+		rawSequence, err = s.backend.Get(ctx, s.writeBehindSequenceKey(id))
+		return err
+	})
+	if err == cache.ErrMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	current, err := strconv.ParseInt(string(rawSequence), 10, 64)
+	if err != nil {
+		return false, err
+	}
+	return current > sequence, nil
+}
+
+func (s *Storage) retry(ctx context.Context, message cache.Message, entry writeBehindEntry, cause error) {
+	config := s.config.WriteBehind
+	entry.Attempt++
+	if entry.Attempt >= config.MaxAttempts {
+		s.deadLetter(ctx, message, cause.Error())
+		return
+	}
+	entry.NotBefore = s.now().Add(config.RetryBackoff << (entry.Attempt - 1)).UnixMilli()
+	rawEntry, err := json.Marshal(entry)
+	if err == nil {
+		err = s.writeBehind.Requeue(ctx, message, rawEntry)
+	}
+	if err != nil {
+		// the message is received again once it is claimed
+		logging.FromContext(ctx).Warn("failed to requeue write-behind update", "messageId", message.Id, "error", err)
+		return
+	}
+	s.metrics.ObserveCacheWriteBehind(metrics.WriteBehindRetried)
+	logging.FromContext(ctx).Warn("failed to flush write-behind update, retrying",
+		"id", entry.Post.Id.Hex(), "attempt", entry.Attempt, "error", cause)
+}
+
+func (s *Storage) deadLetter(ctx context.Context, message cache.Message, reason string) {
+	err := s.writeBehind.DeadLetter(ctx, message, reason)
+	if err != nil {
+		logging.FromContext(ctx).Warn("failed to dead-letter write-behind update", "messageId", message.Id, "error", err)
+		return
+	}
+	s.metrics.ObserveCacheWriteBehind(metrics.WriteBehindDeadLettered)
+	logging.FromContext(ctx).Error("dead-lettered write-behind update", "messageId", message.Id, "reason", reason)
+}
+
+func (s *Storage) ack(ctx context.Context, message cache.Message) {
+	err := s.writeBehind.Ack(ctx, message.Id)
+	if err != nil {
+		// flushing is idempotent, the message is flushed again once claimed
+		logging.FromContext(ctx).Warn("failed to acknowledge write-behind update", "messageId", message.Id, "error", err)
+	}
+}
+
+func (s *Storage) writeBehindSequenceKey(id string) string {
+	return "pd:wb:{" + id + "}"
+}
+
+// sleep waits for d and reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
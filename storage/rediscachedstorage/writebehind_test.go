@@ -0,0 +1,183 @@
+package rediscachedstorage
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"time"
+	"twitter/cache"
+	"twitter/cache/memorycache"
+	"twitter/metrics"
+	"twitter/storage/inmemorystorage"
+)
+
+type failingQueue struct {
+	cache.Queue
+}
+
+func (failingQueue) Enqueue(ctx context.Context, payload []byte) error {
+	return errors.New("queue is unavailable")
+}
+
+func newWriteBehindStorage(t *testing.T) (*Storage, *countingStorage, *memorycache.Queue, *fakeClock) {
+	clock := &fakeClock{now: time.Now().UnixNano()}
+	persistent := &countingStorage{Storage: inmemorystorage.NewStorage()}
+	queue := memorycache.NewQueueWithClock(time.Minute, clock.Now)
+	s := NewStorage(persistent, memorycache.NewBackendWithClock(clock.Now), metrics.New(), DefaultConfig())
+	s.now = clock.Now
+	s.EnableWriteBehind(queue)
+	return s, persistent, queue, clock
+}
+
+// flushQueued flushes the updates received at once and returns their number.
+func flushQueued(t *testing.T, s *Storage) int {
+	messages, err := s.writeBehind.Receive(ctx, "consumer", 100, 0)
+	require.NoError(t, err)
+	for _, message := range messages {
+		s.flush(ctx, message)
+	}
+	return len(messages)
+}
+
+func TestWriteBehindUpdateIsReadBeforeFlush(t *testing.T) {
+	s, persistent, _, _ := newWriteBehindStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "edited", result.Text)
+	stored, err := persistent.Storage.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "first", stored.Text)
+	page, err = s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, "first", page.Posts[0].Text)
+
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Equal(t, []string{"edited"}, persistent.Updates())
+	page, err = s.GetPostsByUserId(ctx, "user1", 10, "")
+	require.NoError(t, err)
+	require.Equal(t, "edited", page.Posts[0].Text)
+	require.Equal(t, 0, flushQueued(t, s))
+}
+
+func TestWriteBehindFlushesOnlyTheLastUpdate(t *testing.T) {
+	s, persistent, _, _ := newWriteBehindStorage(t)
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	for _, text := range []string{"second", "third"} {
+		post.Text = text
+		require.NoError(t, s.Update(ctx, post))
+	}
+	require.Equal(t, 2, flushQueued(t, s))
+
+	require.Equal(t, []string{"third"}, persistent.Updates())
+	expected := `
+# HELP blog_cache_write_behind_total Number of processed write-behind entries by result (flushed, retried, skipped, dead_lettered).
+# TYPE blog_cache_write_behind_total counter
+blog_cache_write_behind_total{result="flushed"} 1
+blog_cache_write_behind_total{result="skipped"} 1
+`
+	require.NoError(t, testutil.GatherAndCompare(s.metrics.Registry(), strings.NewReader(expected), "blog_cache_write_behind_total"))
+}
+
+func TestWriteBehindRetriesWithBackoff(t *testing.T) {
+	s, persistent, _, clock := newWriteBehindStorage(t)
+	persistent.failures = 2
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Equal(t, 1, persistent.failures)
+	// not due before the backoff passes
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Equal(t, 1, persistent.failures)
+
+	clock.Advance(s.config.WriteBehind.RetryBackoff)
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Empty(t, persistent.Updates())
+
+	// the second retry waits twice as long
+	clock.Advance(s.config.WriteBehind.RetryBackoff)
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Empty(t, persistent.Updates())
+	clock.Advance(s.config.WriteBehind.RetryBackoff)
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Equal(t, []string{"edited"}, persistent.Updates())
+	require.Equal(t, 0, flushQueued(t, s))
+}
+
+func TestWriteBehindDeadLettersAfterMaxAttempts(t *testing.T) {
+	s, persistent, queue, clock := newWriteBehindStorage(t)
+	persistent.failures = s.config.WriteBehind.MaxAttempts
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+
+	for i := 0; i < s.config.WriteBehind.MaxAttempts; i++ {
+		require.Equal(t, 1, flushQueued(t, s))
+		clock.Advance(s.config.WriteBehind.RetryBackoff << i)
+	}
+	require.Equal(t, 0, flushQueued(t, s))
+	require.Empty(t, persistent.Updates())
+	require.Len(t, queue.DeadLetters(), 1)
+}
+
+func TestWriteBehindDeadLettersMalformedEntries(t *testing.T) {
+	s, _, queue, _ := newWriteBehindStorage(t)
+	require.NoError(t, queue.Enqueue(ctx, []byte("{")))
+
+	require.Equal(t, 1, flushQueued(t, s))
+	require.Len(t, queue.DeadLetters(), 1)
+}
+
+func TestWriteBehindFallsBackToWriteThrough(t *testing.T) {
+	s, persistent, _, _ := newWriteBehindStorage(t)
+	s.EnableWriteBehind(failingQueue{})
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	require.Equal(t, []string{"edited"}, persistent.Updates())
+	result, err := s.GetPostById(ctx, post.Id.Hex())
+	require.NoError(t, err)
+	require.Equal(t, "edited", result.Text)
+}
+
+func TestRunWriteBehindFlushesUntilCancelled(t *testing.T) {
+	s, persistent, _, _ := newWriteBehindStorage(t)
+	s.config.WriteBehind.Block = 10 * time.Millisecond
+	post := newPost("user1", "first")
+	require.NoError(t, s.Save(ctx, post))
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		s.RunWriteBehind(runCtx, "consumer")
+		close(done)
+	}()
+
+	post.Text = "edited"
+	require.NoError(t, s.Update(ctx, post))
+	require.Eventually(t, func() bool {
+		return len(persistent.Updates()) == 1
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flusher did not stop")
+	}
+}
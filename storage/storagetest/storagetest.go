@@ -0,0 +1,169 @@
+// Package storagetest checks that storages behave the same way.
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+	"twitter/generator"
+	"twitter/storage"
+)
+
+var ids = generator.NewObjectIdGenerator()
+
+func newPost(authorId, text string) storage.PostData {
+	return storage.PostData{
+		Id:             ids.NewPostID(),
+		AuthorId:       authorId,
+		Text:           text,
+		CreatedAt:      "2022-01-01T00:00:00Z",
+		LastModifiedAt: "2022-01-01T00:00:00Z",
+	}
+}
+
+// RunStorageTests runs the behavioral tests every storage.Storage must pass.
+// Transactions are only tested if the storage implements storage.Transactor.
+func RunStorageTests(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	ctx := context.Background()
+
+	t.Run("SaveAndGet", func(t *testing.T) {
+		s := newStorage(t)
+		post := newPost("user1", "first")
+		require.NoError(t, s.Save(ctx, post))
+		result, err := s.GetPostById(ctx, post.Id.Hex())
+		require.NoError(t, err)
+		require.Equal(t, post, result)
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		s := newStorage(t)
+		_, err := s.GetPostById(ctx, ids.NewPostID().Hex())
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+		_, err = s.GetPostById(ctx, "UNKNOWNURL")
+		require.ErrorIs(t, err, storage.CommonStorageError)
+	})
+
+	t.Run("SaveExistingIdCollides", func(t *testing.T) {
+		s := newStorage(t)
+		post := newPost("user1", "first")
+		require.NoError(t, s.Save(ctx, post))
+		require.ErrorIs(t, s.Save(ctx, post), storage.ErrorCollision)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		s := newStorage(t)
+		post := newPost("user1", "first")
+		require.NoError(t, s.Save(ctx, post))
+		post.Text = "edited"
+		post.LastModifiedAt = "2022-01-02T00:00:00Z"
+		require.NoError(t, s.Update(ctx, post))
+
+		result, err := s.GetPostById(ctx, post.Id.Hex())
+		require.NoError(t, err)
+		require.Equal(t, post, result)
+		page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+		require.NoError(t, err)
+		require.Equal(t, []storage.PostData{post}, page.Posts)
+
+		require.ErrorIs(t, s.Update(ctx, newPost("user1", "missing")), storage.ErrorNotFound)
+	})
+
+	t.Run("GetPostsByIds", func(t *testing.T) {
+		s := newStorage(t)
+		first, second := newPost("user1", "first"), newPost("user2", "second")
+		require.NoError(t, s.Save(ctx, first))
+		require.NoError(t, s.Save(ctx, second))
+		missing := ids.NewPostID().Hex()
+
+		posts, err := s.GetPostsByIds(ctx, []string{second.Id.Hex(), missing, first.Id.Hex(), "UNKNOWNURL", second.Id.Hex()})
+		require.NoError(t, err)
+		require.Equal(t, []storage.PostData{second, first}, posts)
+		posts, err = s.GetPostsByIds(ctx, []string{missing})
+		require.NoError(t, err)
+		require.Empty(t, posts)
+	})
+
+	t.Run("UppercaseIds", func(t *testing.T) {
+		s := newStorage(t)
+		post := newPost("user1", "first")
+		require.NoError(t, s.Save(ctx, post))
+		id := strings.ToUpper(post.Id.Hex())
+
+		result, err := s.GetPostById(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, post, result)
+		posts, err := s.GetPostsByIds(ctx, []string{id, post.Id.Hex()})
+		require.NoError(t, err)
+		require.Equal(t, []storage.PostData{post}, posts)
+	})
+
+	t.Run("TimelinePages", func(t *testing.T) {
+		s := newStorage(t)
+		var posts []storage.PostData
+		for i := 0; i < 5; i++ {
+			post := newPost("user1", "post")
+			require.NoError(t, s.Save(ctx, post))
+			require.NoError(t, s.Save(ctx, newPost("user2", "other")))
+			posts = append([]storage.PostData{post}, posts...)
+		}
+
+		var pages [][]storage.PostData
+		pageId := ""
+		for {
+			page, err := s.GetPostsByUserId(ctx, "user1", 2, pageId)
+			require.NoError(t, err)
+			if len(page.Posts) == 0 {
+				require.Equal(t, storage.NilPostID, page.NextPageId)
+				break
+			}
+			require.Equal(t, page.Posts[len(page.Posts)-1].Id, page.NextPageId)
+			pages = append(pages, page.Posts)
+			pageId = page.NextPageId.Hex()
+		}
+		require.Equal(t, [][]storage.PostData{posts[:2], posts[2:4], posts[4:]}, pages)
+	})
+
+	t.Run("TimelineOfUnknownUser", func(t *testing.T) {
+		s := newStorage(t)
+		page, err := s.GetPostsByUserId(ctx, "nobody", 10, "")
+		require.NoError(t, err)
+		require.Empty(t, page.Posts)
+		require.Equal(t, storage.NilPostID, page.NextPageId)
+	})
+
+	t.Run("InvalidPage", func(t *testing.T) {
+		s := newStorage(t)
+		require.NoError(t, s.Save(ctx, newPost("user1", "first")))
+		_, err := s.GetPostsByUserId(ctx, "user1", 10, "UNKNOWNURL")
+		require.ErrorIs(t, err, storage.ErrorInvalidPage)
+	})
+
+	t.Run("Transaction", func(t *testing.T) {
+		s := newStorage(t)
+		transactor, ok := s.(storage.Transactor)
+		if !ok {
+			t.Skip("storage has no transactions")
+		}
+		committed, rolledBack := newPost("user1", "committed"), newPost("user1", "rolled back")
+		require.NoError(t, transactor.WithinTransaction(ctx, func(ctx context.Context) error {
+			return s.Save(ctx, committed)
+		}))
+		failure := errors.New("failed")
+		err := transactor.WithinTransaction(ctx, func(ctx context.Context) error {
+			require.NoError(t, s.Save(ctx, rolledBack))
+			result, err := s.GetPostById(ctx, rolledBack.Id.Hex())
+			require.NoError(t, err)
+			require.Equal(t, rolledBack, result)
+			return failure
+		})
+		require.ErrorIs(t, err, failure)
+
+		page, err := s.GetPostsByUserId(ctx, "user1", 10, "")
+		require.NoError(t, err)
+		require.Equal(t, []storage.PostData{committed}, page.Posts)
+		_, err = s.GetPostById(ctx, rolledBack.Id.Hex())
+		require.ErrorIs(t, err, storage.ErrorNotFound)
+	})
+}
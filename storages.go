@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"twitter/eventstream"
+	"twitter/health"
+	"twitter/logging"
+	"twitter/metrics"
+	"twitter/storage"
+	"twitter/storage/boltstorage"
+	"twitter/storage/inmemorystorage"
+	"twitter/storage/instrumentedstorage"
+	"twitter/storage/mongostorage"
+	"twitter/storage/postgresstorage"
+)
+
+// persistentStorage is the storage selected by STORAGE. run starts its
+// background work once the cache in front of it is able to handle changes.
+type persistentStorage struct {
+	storage      storage.Storage
+	dependencies []health.Dependency
+	run          func(ctx context.Context, changes storage.ChangeHandler)
+}
+
+func newPersistentStorage(ctx context.Context, m *metrics.Metrics) persistentStorage {
+	switch kind := envString("STORAGE", "mongo"); kind {
+	case "mongo":
+		return newMongoStorage(ctx, m)
+	case "memory":
+		return newMemoryStorage(ctx, m)
+	case "bolt":
+		return newBoltStorage(ctx, m)
+	case "postgres":
+		return newPostgresStorage(ctx, m)
+	default:
+		panic(fmt.Errorf("unknown storage %q", kind))
+	}
+}
+
+func newMongoStorage(ctx context.Context, m *metrics.Metrics) persistentStorage {
+	mongoStorage, err := mongostorage.DatabaseStorage(ctx, mongoOptions())
+	if err != nil {
+		panic(err)
+	}
+	if envBool("MONGO_MIGRATE_ON_START", true) {
+		migrator := mongoStorage.Migrator()
+		err = migrateOnStart(ctx, func(ctx context.Context) error {
+			_, err := migrator.Up(ctx, 0, false)
+			return err
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	return persistentStorage{
+		storage: instrumentedstorage.NewStorage("mongo", mongoStorage, m),
+		dependencies: []health.Dependency{
+			{Name: "mongo", Critical: true, Ping: mongoStorage.Ping},
+		},
+		run: func(ctx context.Context, changes storage.ChangeHandler) {
+			if envBool("MONGO_OUTBOX", false) {
+				events := eventstream.NewStream(newRedisClient(), envString("EVENTS_STREAM", "posts:events"), envInt64("EVENTS_STREAM_MAX_LEN", 1000000))
+				go mongoStorage.NewRelay(events, mongostorage.DefaultRelayOptions()).Run(ctx)
+			}
+			if envBool("MONGO_CHANGE_STREAM", false) {
+				go mongoStorage.NewWatcher(changes, mongostorage.DefaultWatcherOptions("cache")).Run(ctx)
+			}
+		},
+	}
+}
+
+// newMemoryStorage keeps posts in memory only, unless MEMORY_STORAGE_DIR
+// names a directory to persist them in.
+func newMemoryStorage(ctx context.Context, m *metrics.Metrics) persistentStorage {
+	dir := os.Getenv("MEMORY_STORAGE_DIR")
+	if dir == "" {
+		return persistentStorage{
+			storage: instrumentedstorage.NewStorage("memory", inmemorystorage.NewStorage(), m),
+			run:     func(ctx context.Context, changes storage.ChangeHandler) {},
+		}
+	}
+	options := inmemorystorage.DefaultPersistenceOptions(dir)
+	if name := os.Getenv("MEMORY_STORAGE_FSYNC"); name != "" {
+		var err error
+		options.Fsync, err = inmemorystorage.ParseFsyncPolicy(name)
+		if err != nil {
+			panic(fmt.Errorf("invalid value of MEMORY_STORAGE_FSYNC - %w", err))
+		}
+	}
+	options.SnapshotInterval = envDuration("MEMORY_STORAGE_SNAPSHOT_INTERVAL", options.SnapshotInterval)
+	memoryStorage, err := inmemorystorage.OpenStorage(options)
+	if err != nil {
+		panic(err)
+	}
+	logging.FromContext(ctx).Info("recovered memory storage", "dir", dir, "posts", len(memoryStorage.IdToPost))
+	return persistentStorage{
+		storage: instrumentedstorage.NewStorage("memory", memoryStorage, m),
+		run: func(ctx context.Context, changes storage.ChangeHandler) {
+			go memoryStorage.RunPersistence(ctx)
+		},
+	}
+}
+
+func newBoltStorage(ctx context.Context, m *metrics.Metrics) persistentStorage {
+	path := envString("BOLT_PATH", "posts.db")
+	boltStorage, err := boltstorage.OpenStorage(path)
+	if err != nil {
+		panic(err)
+	}
+	logging.FromContext(ctx).Info("opened bolt storage", "path", path)
+	return persistentStorage{
+		storage: instrumentedstorage.NewStorage("bolt", boltStorage, m),
+		run: func(ctx context.Context, changes storage.ChangeHandler) {
+			go func() {
+				<-ctx.Done()
+				err := boltStorage.Close()
+				if err != nil {
+					logging.FromContext(ctx).Error("failed to close bolt storage", "error", err)
+				}
+			}()
+		},
+	}
+}
+
+func postgresOptions() postgresstorage.Options {
+	options := postgresstorage.DefaultOptions(os.Getenv("POSTGRES_URL"))
+	options.MaxOpenConns = int(envInt64("POSTGRES_MAX_OPEN_CONNS", int64(options.MaxOpenConns)))
+	options.MaxIdleConns = int(envInt64("POSTGRES_MAX_IDLE_CONNS", int64(options.MaxIdleConns)))
+	return options
+}
+
+func newPostgresStorage(ctx context.Context, m *metrics.Metrics) persistentStorage {
+	postgresStorage, err := postgresstorage.OpenStorage(postgresOptions())
+	if err != nil {
+		panic(err)
+	}
+	if envBool("POSTGRES_MIGRATE_ON_START", true) {
+		migrator := postgresStorage.Migrator()
+		err = migrateOnStart(ctx, func(ctx context.Context) error {
+			_, err := migrator.Up(ctx, 0, false)
+			return err
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+	return persistentStorage{
+		storage: instrumentedstorage.NewStorage("postgres", postgresStorage, m),
+		dependencies: []health.Dependency{
+			{Name: "postgres", Critical: true, Ping: postgresStorage.Ping},
+		},
+		run: func(ctx context.Context, changes storage.ChangeHandler) {
+			go func() {
+				<-ctx.Done()
+				_ = postgresStorage.Close()
+			}()
+		},
+	}
+}